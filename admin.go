@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/hashicorp/raft"
+)
+
+// adminStatus is the JSON document served on "/status".
+type adminStatus struct {
+	Address      string `json:"address"`
+	State        string `json:"state"`
+	Leader       string `json:"leader"`
+	Term         uint64 `json:"term"`
+	LastIndex    uint64 `json:"last_index"`
+	AppliedIndex uint64 `json:"applied_index"`
+	CommitIndex  uint64 `json:"commit_index"`
+
+	Configuration []adminServer `json:"configuration"`
+
+	// application log, where 'LogLength' is the number of commands retained since the latest
+	// compaction, or logged on the beelog structure before being reduced
+	LogStrategy string `json:"log_strategy"`
+	LogCount    uint32 `json:"log_count"`
+	LogLength   uint64 `json:"log_length"`
+
+	Sessions  int             `json:"sessions"`
+	Snapshots []adminSnapshot `json:"snapshots"`
+}
+
+type adminServer struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+}
+
+type adminSnapshot struct {
+	ID    string `json:"id"`
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Size  int64  `json:"size"`
+}
+
+// ServeAdmin starts the admin HTTP listener at 'addr', closed on Exit. It serves:
+//
+//	GET  /status               replica state, as an adminStatus document
+//	POST /snapshot             takes a raft snapshot, returning its metadata
+//	POST /transfer-leadership  transfers leadership to the most up-to-date voter, or to
+//	                           the server informed by 'id' and 'address' parameters
+//	GET  /metrics              replica metrics, in the Prometheus text format
+func (svr *Server) ServeAdmin(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	svr.admin = &http.Server{Handler: svr.adminHandler()}
+	go svr.admin.Serve(listener)
+	return nil
+}
+
+func (svr *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", svr.handleStatus)
+	mux.HandleFunc("/snapshot", svr.handleSnapshot)
+	mux.HandleFunc("/transfer-leadership", svr.handleTransferLeadership)
+	mux.Handle("/metrics", metricsRegistry)
+	return mux
+}
+
+func (svr *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	st, err := svr.status()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, st)
+}
+
+// status collects the current adminStatus of the replica.
+func (svr *Server) status() (*adminStatus, error) {
+	s := svr.kvstore
+	stats := s.raft.Stats()
+	term, _ := strconv.ParseUint(stats["term"], 10, 64)
+	commit, _ := strconv.ParseUint(stats["commit_index"], 10, 64)
+
+	st := &adminStatus{
+		Address:      string(s.transport.LocalAddr()),
+		State:        s.raft.State().String(),
+		Leader:       string(s.raft.Leader()),
+		Term:         term,
+		LastIndex:    s.raft.LastIndex(),
+		AppliedIndex: s.raft.AppliedIndex(),
+		CommitIndex:  commit,
+		LogStrategy:  s.Logging.String(),
+		LogCount:     atomic.LoadUint32(&s.logCount),
+		LogLength:    atomic.LoadUint64(&s.logLen),
+		Sessions:     len(svr.sessions()),
+	}
+
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return nil, err
+	}
+	st.Configuration = make([]adminServer, 0)
+	for _, rep := range configFuture.Configuration().Servers {
+		st.Configuration = append(st.Configuration, adminServer{
+			ID:       string(rep.ID),
+			Address:  string(rep.Address),
+			Suffrage: rep.Suffrage.String(),
+		})
+	}
+
+	list, err := s.snapshots.List()
+	if err != nil {
+		return nil, err
+	}
+	st.Snapshots = make([]adminSnapshot, 0, len(list))
+	for _, meta := range list {
+		st.Snapshots = append(st.Snapshots, newAdminSnapshot(meta))
+	}
+	return st, nil
+}
+
+func newAdminSnapshot(meta *raft.SnapshotMeta) adminSnapshot {
+	return adminSnapshot{
+		ID:    meta.ID,
+		Index: meta.Index,
+		Term:  meta.Term,
+		Size:  meta.Size,
+	}
+}
+
+func (svr *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	f := svr.kvstore.raft.Snapshot()
+	if err := f.Error(); err != nil {
+		code := http.StatusInternalServerError
+		if err == raft.ErrNothingNewToSnapshot {
+			code = http.StatusConflict
+		}
+		writeAdminError(w, code, err)
+		return
+	}
+
+	meta, rc, err := f.Open()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rc.Close()
+	writeAdminJSON(w, http.StatusOK, newAdminSnapshot(meta))
+}
+
+func (svr *Server) handleTransferLeadership(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var f raft.Future
+	id, addr := r.FormValue("id"), r.FormValue("address")
+	switch {
+	case id == "" && addr == "":
+		f = svr.kvstore.raft.LeadershipTransfer()
+	case id != "" && addr != "":
+		f = svr.kvstore.raft.LeadershipTransferToServer(raft.ServerID(id), raft.ServerAddress(addr))
+	default:
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("both 'id' and 'address' must be informed"))
+		return
+	}
+
+	if err := f.Error(); err != nil {
+		code := http.StatusInternalServerError
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipTransferInProgress {
+			code = http.StatusConflict
+		}
+		writeAdminError(w, code, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]string{"leader": string(svr.kvstore.raft.Leader())})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"beelog-hraft/kvpb"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+)
+
+func TestAdminStatusAndSnapshot(t *testing.T) {
+	s := startClusterNode(t, "node0", freeAddr(t), "", true)
+	defer stopClusterNode(s)
+	waitLeader(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svr := startTestServer(ctx, s)
+	admin := httptest.NewServer(svr.adminHandler())
+	defer admin.Close()
+
+	cmd := &kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar"}
+	raw, _ := proto.Marshal(cmd)
+	if err := s.Propose(raw, nil, nil); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	st := &adminStatus{}
+	if code := adminRequest(t, http.MethodGet, admin.URL+"/status", st); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	if st.State != raft.Leader.String() || st.Leader != st.Address {
+		t.Fatalf("expected a leader, got state %s and leader '%s'", st.State, st.Leader)
+	}
+	if len(st.Configuration) != 1 || st.Configuration[0].ID != "node0" || st.Configuration[0].Suffrage != "Voter" {
+		t.Fatalf("unexpected configuration: %+v", st.Configuration)
+	}
+	if st.Term == 0 || st.CommitIndex != st.LastIndex || st.AppliedIndex != st.LastIndex {
+		t.Fatalf("unexpected indexes: %+v", st)
+	}
+	if st.LogStrategy != s.Logging.String() || len(st.Snapshots) != 0 {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+
+	if code := adminRequest(t, http.MethodGet, admin.URL+"/snapshot", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected snapshot to require POST, got status code %d", code)
+	}
+	snap := &adminSnapshot{}
+	if code := adminRequest(t, http.MethodPost, admin.URL+"/snapshot", snap); code != http.StatusOK {
+		t.Fatalf("failed to take snapshot, status code %d", code)
+	}
+	if snap.Index != st.LastIndex {
+		t.Fatalf("expected snapshot at index %d, got %d", st.LastIndex, snap.Index)
+	}
+
+	if code := adminRequest(t, http.MethodGet, admin.URL+"/status", st); code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	if len(st.Snapshots) != 1 || st.Snapshots[0].ID != snap.ID {
+		t.Fatalf("expected snapshot %s on status, got: %+v", snap.ID, st.Snapshots)
+	}
+
+	resp, err := http.Get(admin.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, exp := range []string{
+		"# TYPE beelog_apply_duration_seconds histogram",
+		fmt.Sprintf("beelog_log_command_duration_seconds_count{strategy=%q}", s.Logging),
+		"# TYPE beelog_sessions gauge",
+	} {
+		if !strings.Contains(string(body), exp) {
+			t.Fatalf("expected %q on metrics, got:\n%s", exp, body)
+		}
+	}
+
+	// no voter to transfer leadership to
+	if code := adminRequest(t, http.MethodPost, admin.URL+"/transfer-leadership", nil); code == http.StatusOK {
+		t.Fatalf("expected leadership transfer to fail on a single node")
+	}
+}
+
+func TestAdminTransferLeadership(t *testing.T) {
+	nodes := startTestCluster(t, 2)
+	defer func() {
+		for _, n := range nodes {
+			n.kill()
+		}
+	}()
+	admin := httptest.NewServer(nodes[0].server.adminHandler())
+	defer admin.Close()
+
+	if code := adminRequest(t, http.MethodPost, admin.URL+"/transfer-leadership?id=node1", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected bad request without address, got status code %d", code)
+	}
+
+	params := url.Values{"id": {"node1"}, "address": {nodes[1].raftAddr}}
+	rep := make(map[string]string)
+	if code := adminRequest(t, http.MethodPost, admin.URL+"/transfer-leadership?"+params.Encode(), &rep); code != http.StatusOK {
+		t.Fatalf("failed to transfer leadership, status code %d: %v", code, rep)
+	}
+	waitFor(t, "node1 to become leader", func() bool {
+		return nodes[1].store.raft.State() == raft.Leader
+	})
+}
+
+// adminRequest sends a request to the admin endpoint, decoding its JSON response into 'v',
+// if not nil. Returns the response status code.
+func adminRequest(t *testing.T, method, url string, v interface{}) int {
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("admin request failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("failed to decode response: %s", err.Error())
+		}
+	}
+	return resp.StatusCode
+}
@@ -0,0 +1,192 @@
+// Package applog interprets the application log kept by beelog-hraft replicas, shared by
+// replicas serving watches and by recovering replicas installing the log.
+//
+// Beelog reduction only retains the latest SET on each key, discarding any other operation
+// as a read, so writes besides plain SETs are logged as SETs too. These are tagged by their
+// Kind on a dedicated field, number 'kindField', unknown to pb.Command and thus preserved
+// on its XXX_unrecognized bytes by beelog structures and protobuf encoding:
+//
+//   - a DELETE is logged by beelog structures as a Tombstone SET on its key;
+//   - a transaction writing several keys may be logged as a single Txn SET on a unique key,
+//     holding every write encoded by EncodeTxn. These entries are never reduced.
+//
+// Transactions override any previous write on their keys, so logs must be replayed in
+// index order by Replay, even though reduced logs are unordered.
+package applog
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+
+	"beelog-hraft/record"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+)
+
+// Kind identifies how a logged SET is interpreted.
+type Kind uint64
+
+const (
+	// Plain SETs write their value on their key.
+	Plain Kind = iota
+
+	// Tombstone SETs delete their key.
+	Tombstone
+
+	// Txn SETs apply every write encoded on their value by EncodeTxn.
+	Txn
+)
+
+// kindField is the number of the protobuf field holding the Kind of a logged command, above
+// every field of pb.Command.
+const kindField = 16
+
+// txnKeyPrefix prefixes the unique key of Txn SETs, followed by their index.
+const txnKeyPrefix = "\x00txn/"
+
+// ErrMalformedTxn is returned when replaying a Txn SET whose writes can't be decoded.
+var ErrMalformedTxn = errors.New("malformed transaction")
+
+// Write is a new value, or a delete, applied on 'Key' by a logged command.
+type Write struct {
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+// NewTombstone returns the Tombstone SET logged in place of a DELETE of 'key' at 'index'.
+func NewTombstone(index uint64, key string) pb.Command {
+	return withKind(pb.Command{Id: index, Op: pb.Command_SET, Key: key}, Tombstone)
+}
+
+// NewTxn returns the Txn SET holding 'writes', applied by a transaction at 'index'.
+func NewTxn(index uint64, writes []Write) pb.Command {
+	cmd := pb.Command{
+		Id:    index,
+		Op:    pb.Command_SET,
+		Key:   txnKeyPrefix + strconv.FormatUint(index, 10),
+		Value: string(EncodeTxn(writes)),
+	}
+	return withKind(cmd, Txn)
+}
+
+func withKind(cmd pb.Command, k Kind) pb.Command {
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], kindField<<3)
+	n += binary.PutUvarint(buf[n:], uint64(k))
+	cmd.XXX_unrecognized = append([]byte(nil), buf[:n]...)
+	return cmd
+}
+
+// KindOf returns the Kind of the logged 'cmd', Plain if untagged.
+func KindOf(cmd pb.Command) Kind {
+	for b := cmd.XXX_unrecognized; len(b) > 0; {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return Plain
+		}
+		b = b[n:]
+
+		// skips any other unknown field by its wire type
+		var v uint64
+		switch tag & 7 {
+		case 0:
+			v, n = binary.Uvarint(b)
+		case 1:
+			n = 8
+		case 2:
+			var size uint64
+			size, n = binary.Uvarint(b)
+			if n > 0 {
+				n += int(size)
+			}
+		case 5:
+			n = 4
+		default:
+			return Plain
+		}
+		if n <= 0 || n > len(b) {
+			return Plain
+		}
+		if tag == kindField<<3 {
+			return Kind(v)
+		}
+		b = b[n:]
+	}
+	return Plain
+}
+
+// Writes returns the writes applied by the logged 'cmd', none if it's a read.
+func Writes(cmd pb.Command) ([]Write, error) {
+	switch {
+	case cmd.Op == pb.Command_DELETE:
+		return []Write{{Key: cmd.Key, Deleted: true}}, nil
+
+	case cmd.Op != pb.Command_SET:
+		return nil, nil
+	}
+
+	switch KindOf(cmd) {
+	case Tombstone:
+		return []Write{{Key: cmd.Key, Deleted: true}}, nil
+	case Txn:
+		return DecodeTxn([]byte(cmd.Value))
+	}
+	return []Write{{Key: cmd.Key, Value: []byte(cmd.Value)}}, nil
+}
+
+// Replay calls 'fn' for every write applied by 'log', sorted in place by index.
+func Replay(log []pb.Command, fn func(index uint64, w Write)) error {
+	sort.SliceStable(log, func(i, j int) bool {
+		return log[i].Id < log[j].Id
+	})
+	for _, cmd := range log {
+		writes, err := Writes(cmd)
+		if err != nil {
+			return err
+		}
+		for _, w := range writes {
+			fn(cmd.Id, w)
+		}
+	}
+	return nil
+}
+
+// EncodeTxn encodes 'writes' as a record, each field named by a key and holding 's'
+// followed by its new value, or 'd' if deleted.
+func EncodeTxn(writes []Write) []byte {
+	fields := make(map[string][]byte, len(writes))
+	for _, w := range writes {
+		if w.Deleted {
+			fields[w.Key] = []byte("d")
+			continue
+		}
+		fields[w.Key] = append([]byte("s"), w.Value...)
+	}
+	return record.Encode(fields)
+}
+
+// DecodeTxn returns the writes encoded by EncodeTxn on 'value', sorted by key.
+func DecodeTxn(value []byte) ([]Write, error) {
+	fields, err := record.Decode(value)
+	if err != nil {
+		return nil, ErrMalformedTxn
+	}
+	writes := make([]Write, 0, len(fields))
+	for key, f := range fields {
+		if len(f) == 0 || f[0] != 's' && f[0] != 'd' {
+			return nil, ErrMalformedTxn
+		}
+		w := Write{Key: key, Deleted: f[0] == 'd'}
+		if !w.Deleted {
+			w.Value = f[1:]
+		}
+		writes = append(writes, w)
+	}
+	sort.Slice(writes, func(i, j int) bool {
+		return writes[i].Key < writes[j].Key
+	})
+	return writes, nil
+}
@@ -0,0 +1,92 @@
+package applog
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	bl "github.com/Lz-Gustavo/beelog"
+	"github.com/Lz-Gustavo/beelog/pb"
+)
+
+func TestKindSurvivesLogEncoding(t *testing.T) {
+	log := []pb.Command{
+		{Id: 1, Ip: "127.0.0.1:15000", Op: pb.Command_SET, Key: "a", Value: "1"},
+		NewTombstone(2, "a"),
+		NewTxn(3, []Write{{Key: "b", Value: []byte("2")}, {Key: "c", Deleted: true}}),
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := bl.MarshalLogIntoWriter(buf, &log, 1, 3); err != nil {
+		t.Fatalf("failed to marshal log: %s", err.Error())
+	}
+	got, err := bl.UnmarshalLogFromReader(buf)
+	if err != nil {
+		t.Fatalf("failed to unmarshal log: %s", err.Error())
+	}
+
+	// tags are kept apart from 'Ip', which still informs the client address
+	exp := []Kind{Plain, Tombstone, Txn}
+	for i, cmd := range got {
+		if k := KindOf(cmd); k != exp[i] || cmd.Ip != log[i].Ip {
+			t.Fatalf("expected kind %d on command %d, got %d with ip %q", exp[i], i, k, cmd.Ip)
+		}
+	}
+}
+
+func TestKindOfSkipsUnknownFields(t *testing.T) {
+	cmd := NewTombstone(1, "a")
+	cmd.XXX_unrecognized = append([]byte{
+		0x88, 0x01, 0x05, // field 17, varint
+		0x92, 0x01, 0x02, 'h', 'i', // field 18, bytes
+		0x9D, 0x01, 1, 2, 3, 4, // field 19, fixed32
+	}, cmd.XXX_unrecognized...)
+	if k := KindOf(cmd); k != Tombstone {
+		t.Fatalf("expected a tombstone, got kind %d", k)
+	}
+
+	cmd.XXX_unrecognized = []byte{0x92, 0x01, 0x7F}
+	if k := KindOf(cmd); k != Plain {
+		t.Fatalf("expected a truncated field to be ignored, got kind %d", k)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// reduced logs are unordered, the transaction must still override the previous SET
+	log := []pb.Command{
+		NewTxn(5, []Write{{Key: "a", Value: []byte("x")}, {Key: "b", Deleted: true}}),
+		{Id: 3, Op: pb.Command_SET, Key: "a", Value: "1"},
+		{Id: 2, Op: pb.Command_SET, Key: "b", Value: "2"},
+		{Id: 4, Op: pb.Command_GET, Key: "b"},
+		{Id: 6, Op: pb.Command_DELETE, Key: "a"},
+		NewTombstone(7, "c"),
+	}
+	type applied struct {
+		index uint64
+		w     Write
+	}
+	var got []applied
+	err := Replay(log, func(index uint64, w Write) {
+		got = append(got, applied{index, w})
+	})
+	if err != nil {
+		t.Fatalf("failed to replay log: %s", err.Error())
+	}
+
+	exp := []applied{
+		{2, Write{Key: "b", Value: []byte("2")}},
+		{3, Write{Key: "a", Value: []byte("1")}},
+		{5, Write{Key: "a", Value: []byte("x")}},
+		{5, Write{Key: "b", Deleted: true}},
+		{6, Write{Key: "a", Deleted: true}},
+		{7, Write{Key: "c", Deleted: true}},
+	}
+	if !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected writes %v, got %v", exp, got)
+	}
+
+	malformed := NewTxn(8, nil)
+	malformed.Value = "1:a"
+	if err = Replay([]pb.Command{malformed}, func(uint64, Write) {}); err != ErrMalformedTxn {
+		t.Fatalf("expected ErrMalformedTxn, got: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"strconv"
+
+	"beelog-hraft/applog"
+	"beelog-hraft/kvpb"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+)
+
+// Conditional commands (CAS, INCR, DECR, SETNX and TXN) are evaluated on a stage before
+// being logged, since their effect depends on the current state, and are only applied once
+// every condition holds. Beelog reduction assumes the latest SET on each key wins, so each
+// one is logged as its effect instead:
+//
+//   - a command writing nothing (e.g. a failed CAS or an aborted TXN) is logged as a GET
+//     on its key, discarded by reduction as any other read;
+//   - a command writing a single key is logged as the SET of the resulting value, or as a
+//     DELETE (i.e. an applog.Tombstone SET on beelog structures), reduced as any other
+//     write;
+//   - a TXN writing several keys is logged as the SET (or DELETE) of each key, all of them
+//     sharing its raft index, so reduction discards each write once the key is written
+//     again. The AVL tree rejects entries sharing an index though, and the concurrent
+//     table names reduced logs by their last index, so a later log could replace one
+//     holding part of the writes. On both it's logged as a single applog.Txn SET holding
+//     every write, never reduced.
+//
+// Recovered logs are interpreted by applog.Replay.
+
+// replies of conditional commands, besides the new modification index of applied CAS, SETNX
+// and TXN commands, or the new value of INCR and DECR.
+const (
+	condFailed    = "0"
+	errNotInteger = "ERR not an integer"
+)
+
+// isConditional reports whether 'cmd' is evaluated on a stage, which also includes lease
+// revokes, expiries and SETs expiring on a TTL or lease (see lease.go).
+func isConditional(cmd *kvpb.Command) bool {
+	switch cmd.Op {
+	case kvpb.Command_CAS, kvpb.Command_INCR, kvpb.Command_DECR, kvpb.Command_SETNX, kvpb.Command_TXN,
+		kvpb.Command_LEASEREVOKE, kvpb.Command_EXPIRE:
+		return true
+	case pb.Command_SET:
+		return cmd.TtlMsec != 0 || cmd.Lease != 0
+	}
+	return false
+}
+
+// stagedWrite is a new value, or a delete, staged for a key. New values may expire after
+// 'ttl' or along with 'lease'.
+type stagedWrite struct {
+	value   []byte
+	deleted bool
+	ttl     uint64
+	lease   uint64
+}
+
+// stage holds the writes of a conditional command applied at raft index 'index'. Reads
+// observe previous writes on the same stage.
+type stage struct {
+	f      *fsm
+	index  uint64
+	writes map[string]*stagedWrite
+	keys   []string // in order of first write
+
+	// lease revoked once writes are applied, if any
+	revoked uint64
+}
+
+func newStage(f *fsm, index uint64) *stage {
+	return &stage{f: f, index: index, writes: make(map[string]*stagedWrite)}
+}
+
+func (s *stage) get(key string) ([]byte, uint64, bool) {
+	w, ok := s.writes[key]
+	if !ok {
+		value, rev, found := s.f.load(key)
+		return value, rev.modIndex, found
+	}
+	if w.deleted {
+		return nil, 0, false
+	}
+	return w.value, s.index, true
+}
+
+func (s *stage) put(key string, w *stagedWrite) {
+	if _, ok := s.writes[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.writes[key] = w
+}
+
+// eval stages the writes of 'cmd', returning its reply. Writes are discarded if any
+// condition fails.
+func (s *stage) eval(cmd *kvpb.Command) string {
+	var (
+		res string
+		ok  bool
+	)
+	switch cmd.Op {
+	case kvpb.Command_LEASEREVOKE, kvpb.Command_EXPIRE:
+		res, ok = s.evalExpiry(cmd)
+	default:
+		res, ok = s.evalCommand(cmd)
+	}
+	if !ok {
+		s.writes = make(map[string]*stagedWrite)
+		s.keys = nil
+	}
+	return res
+}
+
+func (s *stage) evalCommand(cmd *kvpb.Command) (string, bool) {
+	modIndex := strconv.FormatUint(s.index, 10)
+	switch cmd.Op {
+	case pb.Command_SET:
+		if res, ok := s.checkExpiring(cmd); !ok {
+			return res, false
+		}
+		s.put(cmd.Key, &stagedWrite{value: []byte(cmd.Value), ttl: cmd.TtlMsec, lease: cmd.Lease})
+		return "", true
+
+	case pb.Command_DELETE:
+		s.put(cmd.Key, &stagedWrite{deleted: true})
+		return "", true
+
+	case kvpb.Command_CAS:
+		value, cur, found := s.get(cmd.Key)
+		matched := string(value) == cmd.Expected
+		if cmd.Version != 0 {
+			matched = cur == cmd.Version
+		}
+		if !found || !matched {
+			return condFailed, false
+		}
+		s.put(cmd.Key, &stagedWrite{value: []byte(cmd.Value)})
+		return modIndex, true
+
+	case kvpb.Command_SETNX:
+		if _, _, found := s.get(cmd.Key); found {
+			return condFailed, false
+		}
+		s.put(cmd.Key, &stagedWrite{value: []byte(cmd.Value)})
+		return modIndex, true
+
+	case kvpb.Command_INCR, kvpb.Command_DECR:
+		var n int64
+		if value, _, found := s.get(cmd.Key); found {
+			var err error
+			if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return errNotInteger, false
+			}
+		}
+		delta := cmd.Delta
+		if delta == 0 {
+			delta = 1
+		}
+		if cmd.Op == kvpb.Command_DECR {
+			delta = -delta
+		}
+		res := strconv.FormatInt(n+delta, 10)
+		s.put(cmd.Key, &stagedWrite{value: []byte(res)})
+		return res, true
+
+	case kvpb.Command_TXN:
+		for _, sub := range cmd.Txn {
+			if sub.Op == kvpb.Command_TXN {
+				return condFailed, false
+			}
+			if _, ok := s.evalCommand(sub); !ok {
+				return condFailed, false
+			}
+		}
+		return modIndex, true
+	}
+
+	// reads, record and lease commands aren't supported inside transactions
+	return condFailed, false
+}
+
+// commit applies every staged write, then revokes the lease being revoked, if any.
+func (s *stage) commit() {
+	for _, key := range s.keys {
+		w := s.writes[key]
+		if w.deleted {
+			s.f.applyDelete(s.index, key)
+			continue
+		}
+		s.f.applySet(s.index, key, string(w.value))
+		s.f.leases.attach(key, s.index, w.ttl, w.lease)
+	}
+	if s.revoked != 0 {
+		s.f.leases.revoke(s.revoked)
+	}
+}
+
+// logged returns the commands logged in place of 'cmd', following its staged writes.
+func (s *stage) logged(cmd *kvpb.Command) []pb.Command {
+	switch {
+	case len(s.keys) == 0:
+		return []pb.Command{{Ip: cmd.Ip, Op: pb.Command_GET, Key: cmd.Key}}
+
+	case len(s.keys) > 1 && (s.f.Logging == BeelogAVL || s.f.Logging == BeelogConcTable):
+		writes := make([]applog.Write, 0, len(s.keys))
+		for _, key := range s.keys {
+			w := s.writes[key]
+			writes = append(writes, applog.Write{Key: key, Value: w.value, Deleted: w.deleted})
+		}
+		return []pb.Command{applog.NewTxn(s.index, writes)}
+	}
+
+	bcmds := make([]pb.Command, 0, len(s.keys))
+	for _, key := range s.keys {
+		bcmd := pb.Command{Ip: cmd.Ip, Op: pb.Command_SET, Key: key}
+		if w := s.writes[key]; w.deleted {
+			bcmd.Op = pb.Command_DELETE
+		} else {
+			bcmd.Value = string(w.value)
+		}
+		bcmds = append(bcmds, bcmd)
+	}
+	return bcmds
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"beelog-hraft/kvpb"
+	"beelog-hraft/wire"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+)
+
+func TestApplyBatchLogsEachCommand(t *testing.T) {
+	strategies := []LogStrategy{InmemTrad, BeelogList, BeelogArray, BeelogAVL}
+	for _, ls := range strategies {
+		s := newLoggedStore(t, ls)
+		cmds := []*pb.Command{
+			{Op: pb.Command_SET, Key: "foo", Value: "bar"},
+			{Op: pb.Command_SET, Key: "baz", Value: "qux"},
+			{Op: pb.Command_DELETE, Key: "foo"},
+		}
+
+		logs := make([]*raft.Log, 0, len(cmds)+1)
+		for i, cmd := range cmds {
+			raw, _ := proto.Marshal(cmd)
+			logs = append(logs, &raft.Log{Index: uint64(i + 1), Type: raft.LogCommand, Data: raw})
+		}
+		logs = append(logs, &raft.Log{Index: uint64(len(cmds) + 1), Type: raft.LogConfiguration})
+
+		res := (*fsm)(s).ApplyBatch(logs)
+		if len(res) != len(logs) {
+			t.Fatalf("strategy %d: expected %d responses, got %d", ls, len(logs), len(res))
+		}
+		if res[len(cmds)] != nil {
+			t.Fatalf("strategy %d: unexpected response to configuration entry: %v", ls, res[len(cmds)])
+		}
+
+		state := recoverStateFromLog(t, s, 1, uint64(len(cmds)))
+		if _, ok := state["foo"]; ok || state["baz"] != "qux" {
+			t.Fatalf("strategy %d: unexpected state after recovery: %v", ls, state)
+		}
+	}
+}
+
+func TestConcurrentSessionsKeepOrder(t *testing.T) {
+	s := startClusterNode(t, "node0", freeAddr(t), "", true)
+	defer stopClusterNode(s)
+	waitLeader(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svr := startTestServer(ctx, s)
+
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		srvConn, cliConn := net.Pipe()
+		svr.joins <- srvConn
+		conns[i] = cliConn
+		defer cliConn.Close()
+	}
+
+	// ReadIndex reads must observe previous writes from the same session
+	cmds := [][]*kvpb.Command{
+		{
+			{Op: pb.Command_SET, Key: "foo", Value: "1"},
+			{Op: pb.Command_SET, Key: "foo", Value: "2"},
+			{Op: pb.Command_GET, Key: "foo", Read: kvpb.Command_INDEX},
+			{Op: pb.Command_SET, Key: "foo", Value: "3"},
+		},
+		{
+			{Op: pb.Command_SET, Key: "bar", Value: "x"},
+			{Op: pb.Command_GET, Key: "bar"},
+		},
+	}
+	exp := [][]string{
+		{"OK: ", "OK: ", "OK: 2", "OK: "},
+		{"OK: ", "OK: x"},
+	}
+
+	first := s.raft.LastIndex()
+	logged := 0
+	for i, conn := range conns {
+		for j, cmd := range cmds[i] {
+			cmd.ReqId = uint64(j + 1)
+			cmd.Reply = kvpb.Command_SESSION
+			if cmd.Read != kvpb.Command_INDEX {
+				logged++
+			}
+
+			raw, _ := proto.Marshal(cmd)
+			if err := wire.WriteFrame(conn, wire.MsgCommand, raw); err != nil {
+				t.Fatalf("client %d failed to send command: %s", i, err.Error())
+			}
+		}
+	}
+
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for j := range cmds[i] {
+			typ, payload, err := wire.ReadFrame(conn)
+			if err != nil || typ != wire.MsgReply {
+				t.Fatalf("client %d failed to read reply frame, type %d, err: %v", i, typ, err)
+			}
+			id, rep, _ := wire.DecodeReply(payload)
+			if id != uint64(j+1) || string(rep) != exp[i][j] {
+				t.Fatalf("client %d expected reply %d %q, got %d %q", i, j+1, exp[i][j], id, rep)
+			}
+		}
+	}
+
+	// every logged command is appended as its own entry
+	if n := s.raft.LastIndex() - first; n != uint64(logged) {
+		t.Fatalf("expected %d new log entries, got %d", logged, n)
+	}
+}
+
+// benchClients is the number of concurrent clients on BenchmarkPropose.
+const benchClients = 64
+
+// BenchmarkPropose compares proposing one request at a time, each replicated on its own raft
+// round, to proposing requests concurrently, grouped by raft on a single append, sync and
+// replication round and applied together by fsm.ApplyBatch, on a cluster of 3 replicas on
+// every raft store.
+func BenchmarkPropose(b *testing.B) {
+	prev := *raftStore
+	defer func() { *raftStore = prev }()
+
+	for _, rs := range []string{"inmem", "file"} {
+		*raftStore = rs
+		nodes := startTestCluster(b, 3)
+		s := nodes[0].store
+
+		b.Run(rs+"/Unbatched", func(b *testing.B) {
+			benchmarkServer(b, s, 1)
+		})
+		b.Run(rs+"/Batched", func(b *testing.B) {
+			benchmarkServer(b, s, *maxInflight)
+		})
+		for _, n := range nodes {
+			n.kill()
+			stopClusterNode(n.store)
+		}
+	}
+}
+
+// benchmarkServer measures the throughput of 'benchClients' concurrent clients, served by a
+// server with up to 'maxInflight' proposals in flight.
+func benchmarkServer(b *testing.B, s *Store, maxInflight int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svr := startLimitedServer(ctx, s, maxInflight)
+
+	conns := make([]net.Conn, benchClients)
+	for i := range conns {
+		srvConn, cliConn := net.Pipe()
+		svr.joins <- srvConn
+		conns[i] = cliConn
+		defer cliConn.Close()
+	}
+
+	var (
+		wg   sync.WaitGroup
+		sent int64
+	)
+	b.ResetTimer()
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			cmd := &kvpb.Command{
+				Op:    pb.Command_SET,
+				Key:   strconv.Itoa(i),
+				Value: "bar",
+				Reply: kvpb.Command_SESSION,
+			}
+			for atomic.AddInt64(&sent, 1) <= int64(b.N) {
+				cmd.ReqId++
+				raw, _ := proto.Marshal(cmd)
+				if err := wire.WriteFrame(conn, wire.MsgCommand, raw); err != nil {
+					b.Errorf("failed to send command: %s", err.Error())
+					return
+				}
+				if _, _, err := wire.ReadFrame(conn); err != nil {
+					b.Errorf("failed to read reply: %s", err.Error())
+					return
+				}
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+}
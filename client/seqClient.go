@@ -2,9 +2,16 @@ package client
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
+	"time"
+
+	"beelog-hraft/kvpb"
+	"beelog-hraft/record"
+	"beelog-hraft/wire"
 
 	"github.com/Lz-Gustavo/beelog/pb"
 
@@ -12,6 +19,12 @@ import (
 	"github.com/golang/protobuf/proto"
 )
 
+// notLeaderRepply prefixes replies from followers, followed by the leader's address.
+const notLeaderRepply = "NOT_LEADER "
+
+// okRepply prefixes replies of applied commands, followed by their result.
+const okRepply = "OK: "
+
 // Info stores the server configuration
 type Info struct {
 	Rep    int
@@ -20,6 +33,28 @@ type Info struct {
 	Svrs   []net.Conn
 	reader []*bufio.Reader
 
+	// ClientID identifies the client on the cluster, randomly generated if zero. Each new
+	// command sent with SendCommand or BroadcastRequest informs the next sequence number,
+	// allowing replicas to apply retries at most once.
+	ClientID uint64
+	seq      uint64
+
+	// Per-request timeout, maximum number of attempts of SendCommand, and the initial
+	// backoff between attempts, doubled on each failure. Defaults are assumed if zero.
+	TimeoutMsec int
+	Retries     int
+	BackoffMsec int
+
+	// replies received on TCP sessions, matched by request ID on ReadReply, and index
+	// on 'Svrs' of the replica believed to be the leader. Each connection is identified
+	// by a generation, distinguishing replies from previous connections with a replica.
+	reqCount uint64
+	replies  chan reply
+	done     chan struct{}
+	gens     []uint64
+	alive    int
+	leader   int
+
 	Localip  string
 	Udpport  int
 	receiver *net.UDPConn
@@ -48,26 +83,38 @@ func New(config string) (*Info, error) {
 	return info, nil
 }
 
-// Connect creates a tcp connection to every replica on the cluster
+// Connect creates a tcp connection to every replica on the cluster. Unreachable replicas
+// are reconnected on demand, an error is returned only if none is reachable.
 func (client *Info) Connect() error {
-	client.Svrs = make([]net.Conn, client.Rep)
-	client.reader = make([]*bufio.Reader, client.Rep)
-	var err error
+	client.Svrs = make([]net.Conn, len(client.SvrIps))
+	client.reader = make([]*bufio.Reader, len(client.SvrIps))
+	client.gens = make([]uint64, len(client.SvrIps))
 
-	for i, v := range client.SvrIps {
-		client.Svrs[i], err = net.Dial("tcp", v)
-		if err != nil {
-			return err
+	var err error
+	connected := 0
+	for i := range client.SvrIps {
+		if e := client.connectReplica(i); e != nil {
+			err = e
+			continue
 		}
-		client.reader[i] = bufio.NewReader(client.Svrs[i])
+		connected++
+	}
+	if connected == 0 {
+		return err
 	}
 	return nil
 }
 
 // Disconnect closes every open socket connection with the fsm cluster
 func (client *Info) Disconnect() {
+	if client.done != nil {
+		close(client.done)
+		client.done = nil
+	}
 	for _, v := range client.Svrs {
-		v.Close()
+		if v != nil {
+			v.Close()
+		}
 	}
 }
 
@@ -86,15 +133,33 @@ func (client *Info) StartUDP() error {
 	return nil
 }
 
-// Broadcast a message to the cluster
+// Broadcast an ad-hoc text message to the cluster
 func (client *Info) Broadcast(message string) error {
-	for _, v := range client.Svrs {
-		_, err := fmt.Fprint(v, strconv.Itoa(client.Udpport)+"-"+message)
-		if err != nil {
-			return err
+	return client.broadcastFrame(wire.MsgCommand, []byte(strconv.Itoa(client.Udpport)+"-"+message))
+}
+
+// broadcastFrame sends a single frame to every replica on the cluster. Replicas that fail
+// to receive it are disconnected, returning an error only if none received it.
+func (client *Info) broadcastFrame(typ wire.MsgType, payload []byte) error {
+	var err error
+	sent := false
+	for i, v := range client.Svrs {
+		if v == nil {
+			continue
 		}
+		if err = wire.WriteFrame(v, typ, payload); err != nil {
+			client.closeReplica(i)
+			continue
+		}
+		sent = true
 	}
-	return nil
+	if sent {
+		return nil
+	}
+	if err == nil {
+		err = errors.New("not connected to any replica")
+	}
+	return err
 }
 
 // BroadcastProtobuf sends a serialized command to the cluster
@@ -104,60 +169,143 @@ func (client *Info) BroadcastProtobuf(message *pb.Command, clientUDPPort string)
 	if err != nil {
 		return err
 	}
-	serializedMessage = append(serializedMessage, []byte("\n")...)
+	return client.broadcastFrame(wire.MsgCommand, serializedMessage)
+}
 
-	for _, v := range client.Svrs {
-		_, err := v.Write(serializedMessage)
+// BroadcastCommand sends a serialized command, informing any beelog-hraft extension
+// (e.g. read mode), to the cluster
+func (client *Info) BroadcastCommand(message *kvpb.Command, clientUDPPort string) error {
+	message.Ip = clientUDPPort
+	serializedMessage, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return client.broadcastFrame(wire.MsgCommand, serializedMessage)
+}
+
+// BroadcastRequest sends a serialized command to the cluster, requesting its reply to be
+// written back on the TCP session. Returns the request ID informed to ReadReply.
+func (client *Info) BroadcastRequest(message *kvpb.Command) (uint64, error) {
+	client.reqCount++
+	message.ReqId = client.reqCount
+	message.Reply = kvpb.Command_SESSION
+	client.identify(message)
+	return message.ReqId, client.BroadcastCommand(message, "")
+}
+
+// readReplyFrame reads frames from 'rd' until a reply is found, returning its request ID
+// and value.
+func readReplyFrame(rd *bufio.Reader) (uint64, string, error) {
+	for {
+		typ, payload, err := wire.ReadFrame(rd)
+		if err != nil {
+			return 0, "", err
+		}
+		if typ != wire.MsgReply {
+			continue
+		}
+
+		id, value, err := wire.DecodeReply(payload)
 		if err != nil {
-			return err
+			return 0, "", err
 		}
+		return id, string(value), nil
 	}
-	return nil
 }
 
-// ReadTCP consumes any data from reader socket and returns it
+// ParseScan returns the pairs replied to a SCAN command, in order. Since scan replies
+// easily exceed the UDP receive buffer, they must be requested as session replies.
+func ParseScan(rep string) ([]wire.Pair, error) {
+	if !strings.HasPrefix(rep, okRepply) {
+		return nil, fmt.Errorf("unexpected scan reply %q", rep)
+	}
+	return wire.DecodePairs([]byte(rep[len(okRepply):]))
+}
+
+// ParseRecord returns the fields replied to a GETFIELDS command, which must be requested as
+// a session reply like scans.
+func ParseRecord(rep string) (map[string][]byte, error) {
+	if !strings.HasPrefix(rep, okRepply) {
+		return nil, fmt.Errorf("unexpected record reply %q", rep)
+	}
+	return record.Decode([]byte(rep[len(okRepply):]))
+}
+
+// ParseRevision returns the value, modification index and version replied to a GETVERSION
+// or GETAT command. Missing keys are replied on version zero, and reads on indexes outside
+// the retention window of replicas fail.
+func ParseRevision(rep string) (string, uint64, uint64, error) {
+	parts := strings.SplitN(strings.TrimPrefix(rep, okRepply), " ", 3)
+	if !strings.HasPrefix(rep, okRepply) || len(parts) != 3 {
+		return "", 0, 0, fmt.Errorf("unexpected revision reply %q", rep)
+	}
+	modIndex, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("unexpected revision reply %q", rep)
+	}
+	version, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("unexpected revision reply %q", rep)
+	}
+	return parts[2], modIndex, version, nil
+}
+
+// ParseChanges returns the changes replied to a CHANGES command, in index order, which must
+// be requested as a session reply like scans. Reads on indexes outside the retention window
+// of replicas fail.
+func ParseChanges(rep string) ([]wire.Change, error) {
+	if !strings.HasPrefix(rep, okRepply) || strings.HasPrefix(rep, okRepply+"ERR ") {
+		return nil, fmt.Errorf("unexpected changes reply %q", rep)
+	}
+	return wire.DecodeChanges([]byte(rep[len(okRepply):]))
+}
+
+// ReadTCP consumes the next reply from reader socket and returns its value. Must not be
+// used along with session replies, which consume every reader socket.
 func (client *Info) ReadTCP(readerID int) string {
-	line, err := client.reader[readerID].ReadString('\n')
-	if (err == nil) && (len(line) > 1) {
-		return line
+	_, value, err := readReplyFrame(client.reader[readerID])
+	if err == nil {
+		return value
 	}
 	return ""
 }
 
-// ReadTCPParallel launches go routines to read from every socket connected to
-// the cluster, and returns the first response.
-//
-// TODO: currently it blocks during ReadString() invocation, not releasing
-// the go routine until it receives the delim from the socket. Thats not a
-// desired behavior, since it may be expecting repplies from a faulty replica
+// ReadTCPParallel returns the first reply received from any replica connected on the
+// cluster, or an empty string if none is received before the request timeout.
 func (client *Info) ReadTCPParallel() string {
-	chn := make(chan string, client.Rep)
-	for i := range client.reader {
+	client.listenReplies()
+	timer := time.NewTimer(client.timeout())
+	defer timer.Stop()
 
-		go func(j int, rp chan<- string) {
-			line, err := client.reader[j].ReadString('\n')
-			if err == nil {
-				rp <- line
+	for {
+		select {
+		case rep := <-client.replies:
+			if rep.err != nil {
+				client.handleClosed(rep)
+				continue
 			}
-			return
-		}(i, chn)
+			return rep.value
+
+		case <-timer.C:
+			return ""
+		}
 	}
-	return <-chn
 }
 
 // ReadUDP returns any received message from UDP listener for servers reppply
 func (client *Info) ReadUDP() (string, error) {
 	data := make([]byte, 128)
-	_, _, err := client.receiver.ReadFromUDP(data)
+	client.receiver.SetReadDeadline(time.Now().Add(client.timeout()))
+	n, _, err := client.receiver.ReadFromUDP(data)
 	if err != nil {
 		return "", err
 	}
-	return string(data), nil
+	return string(data[:n]), nil
 }
 
 // Shutdown realeases every resource and finishes goroutines launched by the
 // client programm
 func (client *Info) Shutdown() {
-	client.Broadcast("CLOSE\n")
+	client.broadcastFrame(wire.MsgClose, nil)
 	client.Disconnect()
 }
@@ -14,6 +14,8 @@ import (
 	"testing"
 	"time"
 
+	"beelog-hraft/kvpb"
+
 	"github.com/Lz-Gustavo/beelog/pb"
 )
 
@@ -38,12 +40,20 @@ var (
 	// Value to be store on the hashmap.
 	storeValue string
 
+	// Number of different operations generated by clients, set to 3 if '-delete' is
+	// informed to also generate DELETE requests.
+	numOps = 2
+
 	// global referenced config
 	Cfg *config
 )
 
 type config struct {
 	mustLog     bool
+	deletes     bool
+	readIndex   bool
+	session     bool
+	redirect    bool
 	numKey      int
 	numClients  int
 	numMessages int
@@ -57,6 +67,10 @@ func init() {
 	flag.IntVar(&Cfg.numKey, "key", 0, "Set the number of differente keys for hash set")
 	flag.Int64Var(&Cfg.execTime, "time", 0, "Set the execution time of the experiment")
 	flag.BoolVar(&Cfg.mustLog, "log", true, "Set if this client execution will generate latency logs (0: false; 1: true)")
+	flag.BoolVar(&Cfg.deletes, "delete", false, "Set if clients will also generate DELETE requests")
+	flag.BoolVar(&Cfg.readIndex, "readindex", false, "Set if GET requests are served by ReadIndex instead of being logged")
+	flag.BoolVar(&Cfg.session, "sessionreply", false, "Set if replies are written back on the TCP session instead of UDP")
+	flag.BoolVar(&Cfg.redirect, "redirect", false, "Set if commands are sent only to the leader, following redirects from followers")
 	flag.IntVar(&dataChoice, "data", -1, "Choose the size of the stored value in the KV storage ('0' = 128B, '1' = 1KB, '2' = 4KB)")
 	configFilename = flag.String("config", "client-config.toml", "Filepath to toml file")
 }
@@ -67,6 +81,9 @@ func TestNumMessagesKvstore(b *testing.T) {
 	if Cfg.numClients == 0 || Cfg.numMessages == 0 || Cfg.numKey == 0 {
 		b.Fatal("Must define a number of clients/messages/diff keys > zero")
 	}
+	if Cfg.deletes {
+		numOps = 3
+	}
 
 	switch dataChoice {
 	case 0:
@@ -135,7 +152,7 @@ func TestNumMessagesKvstore(b *testing.T) {
 
 			for k := 0; k < Cfg.numMessages; k++ {
 
-				op = rand.Intn(2)
+				op = rand.Intn(numOps)
 				if chosenClient && Cfg.mustLog {
 					coinThroughtput = rand.Intn(measureChance)
 					if coinThroughtput == 0 {
@@ -161,20 +178,15 @@ func TestNumMessagesKvstore(b *testing.T) {
 					}
 					break
 
-					// case 2:
-					// 	msg = &pb.Command{
-					// 		Op:  pb.Command_DELETE,
-					// 		Key: strconv.Itoa(rand.Intn(Cfg.numKey)),
-					// 	}
+				case 2:
+					msg = &pb.Command{
+						Op:  pb.Command_DELETE,
+						Key: strconv.Itoa(rand.Intn(Cfg.numKey)),
+					}
 				}
-				err := clients[j].BroadcastProtobuf(msg, strconv.Itoa(clients[j].Udpport))
+				repply, err := request(clients[j], msg)
 				if err != nil {
-					b.Logf("Error: %q, caught while broadcasting message: %v", err.Error(), *msg)
-				}
-
-				repply, err := clients[j].ReadUDP()
-				if err != nil {
-					b.Logf("UDP error: %q, caught repply: %s", err.Error(), repply)
+					b.Logf("Error: %q, caught while requesting message: %v, repply: %s", err.Error(), *msg, repply)
 				}
 
 				if flagStopwatch {
@@ -205,6 +217,9 @@ func TestClientTimeKvstore(b *testing.T) {
 	if Cfg.numClients == 0 || Cfg.execTime == 0 || Cfg.numKey == 0 {
 		b.Fatal("Must define a number of clients/execTime/diff keys > zero")
 	}
+	if Cfg.deletes {
+		numOps = 3
+	}
 
 	switch dataChoice {
 	case 0:
@@ -292,13 +307,9 @@ func TestClientTimeKvstore(b *testing.T) {
 					}
 				}
 
-				err := clients[j].BroadcastProtobuf(msg, strconv.Itoa(clients[j].Udpport))
-				if err != nil {
-					b.Logf("Error: %q, caught while broadcasting message: %v", err.Error(), *msg)
-				}
-				repply, err := clients[j].ReadUDP()
+				repply, err := request(clients[j], msg)
 				if err != nil {
-					b.Logf("UDP error: %q, caught repply: %s", err.Error(), repply)
+					b.Logf("Error: %q, caught while requesting message: %v, repply: %s", err.Error(), *msg, repply)
 				}
 
 				if flagStopwatch {
@@ -323,13 +334,45 @@ func TestClientTimeKvstore(b *testing.T) {
 	}
 }
 
+// request sends 'msg' to the cluster and returns its reply. GETs are served by ReadIndex if
+// '-readindex' is set, replies are written back on the TCP session if '-sessionreply' is set,
+// and '-redirect' sends commands only to the leader, following redirects from followers.
+func request(cl *Info, msg *pb.Command) (string, error) {
+	cmd := &kvpb.Command{
+		Op:    msg.Op,
+		Key:   msg.Key,
+		Value: msg.Value,
+	}
+	if Cfg.readIndex && msg.Op == pb.Command_GET {
+		cmd.Read = kvpb.Command_INDEX
+	}
+
+	switch {
+	case Cfg.redirect:
+		return cl.SendCommand(cmd)
+
+	case Cfg.session:
+		id, err := cl.BroadcastRequest(cmd)
+		if err != nil {
+			return "", err
+		}
+		return cl.ReadReply(id)
+
+	default:
+		if err := cl.BroadcastCommand(cmd, strconv.Itoa(cl.Udpport)); err != nil {
+			return "", err
+		}
+		return cl.ReadUDP()
+	}
+}
+
 func generateRequests(reqs chan<- string, signal <-chan bool, numKey int, storeValue string) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
 	for {
 		var msg string
-		op := rand.Intn(2)
+		op := rand.Intn(numOps)
 
 		switch op {
 		case 0:
@@ -337,8 +380,9 @@ func generateRequests(reqs chan<- string, signal <-chan bool, numKey int, storeV
 			break
 		case 1:
 			msg = fmt.Sprintf("get-%d\n", rand.Intn(numKey))
-			// case 2:
-			// 	msg = fmt.Sprintf("delete-%d\n", rand.Intn(numKey))
+			break
+		case 2:
+			msg = fmt.Sprintf("delete-%d\n", rand.Intn(numKey))
 		}
 
 		select {
@@ -357,7 +401,7 @@ func generateProtobufRequests(reqs chan<- *pb.Command, signal <-chan bool, numKe
 
 	for {
 		var msg *pb.Command
-		op := rand.Intn(2)
+		op := rand.Intn(numOps)
 
 		switch op {
 		case 0:
@@ -372,11 +416,12 @@ func generateProtobufRequests(reqs chan<- *pb.Command, signal <-chan bool, numKe
 				Op:  pb.Command_GET,
 				Key: strconv.Itoa(rand.Intn(numKey)),
 			}
-			// case 2:
-			// 	msg = &pb.Command{
-			// 		Op:  pb.Command_DELETE,
-			// 		Key: strconv.Itoa(rand.Intn(numKey)),
-			// 	}
+			break
+		case 2:
+			msg = &pb.Command{
+				Op:  pb.Command_DELETE,
+				Key: strconv.Itoa(rand.Intn(numKey)),
+			}
 		}
 
 		select {
@@ -0,0 +1,342 @@
+package client
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"beelog-hraft/kvpb"
+	"beelog-hraft/wire"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Defaults assumed for Info fields not informed on the toml config.
+const (
+	defaultTimeout = 2 * time.Second
+	defaultRetries = 20
+	defaultBackoff = 50 * time.Millisecond
+	maxBackoff     = 2 * time.Second
+)
+
+var errTimeout = errors.New("timed out waiting for a reply")
+
+// reply is a response written back on a TCP session, identified by its request ID.
+type reply struct {
+	id    uint64
+	value string
+	from  int
+	gen   uint64
+	err   error // informs a closed connection
+}
+
+func (client *Info) timeout() time.Duration {
+	if client.TimeoutMsec > 0 {
+		return time.Duration(client.TimeoutMsec) * time.Millisecond
+	}
+	return defaultTimeout
+}
+
+func (client *Info) retries() int {
+	if client.Retries > 0 {
+		return client.Retries
+	}
+	return defaultRetries
+}
+
+func (client *Info) backoff() time.Duration {
+	if client.BackoffMsec > 0 {
+		return time.Duration(client.BackoffMsec) * time.Millisecond
+	}
+	return defaultBackoff
+}
+
+// connectReplica dials replica 'i', listening to its replies if session replies are
+// already being consumed.
+func (client *Info) connectReplica(i int) error {
+	conn, err := net.DialTimeout("tcp", client.SvrIps[i], client.timeout())
+	if err != nil {
+		return err
+	}
+	client.Svrs[i] = conn
+	client.reader[i] = bufio.NewReader(conn)
+	client.gens[i]++
+
+	if client.replies != nil {
+		client.listen(i)
+	}
+	return nil
+}
+
+// closeReplica closes the connection with replica 'i', reconnected on its next use.
+func (client *Info) closeReplica(i int) {
+	if client.Svrs[i] == nil {
+		return
+	}
+	client.Svrs[i].Close()
+	client.Svrs[i] = nil
+	client.reader[i] = nil
+	client.gens[i]++
+
+	if client.replies != nil {
+		client.alive--
+	}
+}
+
+// handleClosed closes the replica informed by a closed connection reply, ignoring replies
+// from previous connections.
+func (client *Info) handleClosed(rep reply) bool {
+	if rep.gen != client.gens[rep.from] {
+		return false
+	}
+	client.closeReplica(rep.from)
+	return true
+}
+
+// listenReplies launches a goroutine for each connected replica, forwarding any reply
+// received on its session. Replicas connected later are listened by 'connectReplica'.
+func (client *Info) listenReplies() {
+	if client.replies != nil {
+		return
+	}
+	client.replies = make(chan reply, len(client.Svrs))
+	client.done = make(chan struct{})
+	for i, conn := range client.Svrs {
+		if conn != nil {
+			client.listen(i)
+		}
+	}
+}
+
+// listen forwards every reply received from replica 'i', followed by an error once its
+// connection is closed.
+func (client *Info) listen(i int) {
+	client.alive++
+	rd, gen, done := client.reader[i], client.gens[i], client.done
+
+	go func() {
+		for {
+			id, value, err := readReplyFrame(rd)
+			select {
+			case client.replies <- reply{id, value, i, gen, err}:
+				if err != nil {
+					return
+				}
+
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// ReadReply returns the reply for request 'id', discarding any stale reply received for
+// previous requests.
+func (client *Info) ReadReply(id uint64) (string, error) {
+	return client.readReplyFrom(id, -1)
+}
+
+// readReplyFrom returns the reply for request 'id', or an error if the request timeout
+// expires. If 'from' is a valid replica index, an error is also returned once its connection
+// is closed, otherwise only when every connection with the cluster is closed.
+func (client *Info) readReplyFrom(id uint64, from int) (string, error) {
+	client.listenReplies()
+	timer := time.NewTimer(client.timeout())
+	defer timer.Stop()
+
+	for {
+		select {
+		case rep := <-client.replies:
+			if rep.err != nil {
+				if !client.handleClosed(rep) {
+					continue
+				}
+				if rep.from == from {
+					return "", rep.err
+				}
+				if from < 0 && client.alive == 0 {
+					return "", errors.New("every connection with the cluster was closed")
+				}
+				continue
+			}
+			if rep.id == id {
+				return rep.value, nil
+			}
+
+		case <-timer.C:
+			return "", errTimeout
+		}
+	}
+}
+
+// SendCommand sends a serialized command to the replica believed to be the leader,
+// returning its reply. Redirects informed by followers are followed until the leader is
+// found. Timeouts, closed connections, and an unknown leader (e.g. during an election)
+// are retried on the next replica after an exponential backoff, reconnecting to crashed
+// replicas on demand.
+func (client *Info) SendCommand(message *kvpb.Command) (string, error) {
+	client.reqCount++
+	message.ReqId = client.reqCount
+	message.Reply = kvpb.Command_SESSION
+	message.Redirect = true
+	client.identify(message)
+
+	// retries keep the same request ID and sequence number, so a late reply to any attempt
+	// is accepted, and the command is applied at most once
+	raw, err := proto.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+
+	backoff := client.backoff()
+	for attempt := 0; attempt < client.retries(); attempt++ {
+		from := client.leader
+		rep, err := client.request(from, message.ReqId, raw)
+
+		switch {
+		case err == nil && !strings.HasPrefix(rep, notLeaderRepply):
+			return rep, nil
+
+		case err == nil:
+			if addr := strings.TrimPrefix(rep, notLeaderRepply); addr != "" {
+				if i, err := client.replicaIndex(addr, from); err == nil {
+					client.leader = i
+					continue
+				}
+			}
+
+		default:
+			client.closeReplica(from)
+		}
+
+		client.leader = (from + 1) % len(client.Svrs)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	return "", fmt.Errorf("could not reach the cluster leader after %d attempts", client.retries())
+}
+
+// Watch subscribes the client to the changes on 'key', or on every key prefixed by it if
+// 'prefix' is set, through the replica believed to be the leader. Returns the request ID of
+// the watch, informed to ReadChanges, and the index it starts after. Changes applied after
+// 'from', if informed, are notified first, so a watch can be resumed from the latest index
+// received. If they were retrieved from a reduced log, only the latest change on each key
+// is notified and 'reduced' is reported. Replies to other requests are discarded while
+// reading changes, so watches should be held by a dedicated client.
+func (client *Info) Watch(key string, prefix bool, from uint64) (id, start uint64, reduced bool, err error) {
+	cmd := &kvpb.Command{Op: kvpb.Command_WATCH, Key: key, Prefix: prefix, Index: from}
+	rep, err := client.SendCommand(cmd)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	fields := strings.Fields(strings.TrimPrefix(rep, okRepply))
+	if len(fields) == 2 && fields[1] == "reduced" {
+		reduced, fields = true, fields[:1]
+	}
+	if len(fields) == 1 {
+		start, err = strconv.ParseUint(fields[0], 10, 64)
+	}
+	if len(fields) != 1 || err != nil || !strings.HasPrefix(rep, okRepply) {
+		return 0, 0, false, fmt.Errorf("unexpected watch reply %q", rep)
+	}
+	return cmd.ReqId, start, reduced, nil
+}
+
+// ReadChanges returns the next changes notified to watch 'id', all applied on the same
+// index. Fails if none is received before the request timeout, or once the watch is
+// cancelled by the replica.
+func (client *Info) ReadChanges(id uint64) ([]wire.Change, error) {
+	rep, err := client.ReadReply(id)
+	if err != nil {
+		return nil, err
+	}
+	return ParseChanges(rep)
+}
+
+// GrantLease grants a lease expiring after 'ttl' unless kept alive, returning its ID. Keys
+// written by a SET informing the ID on 'Lease' are deleted once the lease expires or is
+// revoked, through LEASEKEEPALIVE and LEASEREVOKE commands sent by SendCommand.
+func (client *Info) GrantLease(ttl time.Duration) (uint64, error) {
+	cmd := &kvpb.Command{Op: kvpb.Command_LEASEGRANT, TtlMsec: uint64(ttl / time.Millisecond)}
+	rep, err := client.SendCommand(cmd)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(rep, okRepply), 10, 64)
+	if err != nil || !strings.HasPrefix(rep, okRepply) {
+		return 0, fmt.Errorf("unexpected lease reply %q", rep)
+	}
+	return id, nil
+}
+
+// identify informs the client ID and the next sequence number on 'message', generating a
+// random client ID on its first call if none is configured.
+func (client *Info) identify(message *kvpb.Command) {
+	for client.ClientID == 0 {
+		var buf [8]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			panic(err)
+		}
+		client.ClientID = binary.BigEndian.Uint64(buf[:])
+	}
+	client.seq++
+	message.ClientId = client.ClientID
+	message.Seq = client.seq
+}
+
+// request sends the serialized command 'raw' to replica 'i', connecting to it if needed,
+// and returns its reply.
+func (client *Info) request(i int, id uint64, raw []byte) (string, error) {
+	if client.Svrs[i] == nil {
+		if err := client.connectReplica(i); err != nil {
+			return "", err
+		}
+	}
+
+	client.Svrs[i].SetWriteDeadline(time.Now().Add(client.timeout()))
+	if err := wire.WriteFrame(client.Svrs[i], wire.MsgCommand, raw); err != nil {
+		return "", err
+	}
+	return client.readReplyFrom(id, i)
+}
+
+// replicaIndex returns the index of the replica reachable at 'addr', informed by replica
+// 'from', connecting to it if it's not yet known. Addresses informing only a port are
+// assumed to be on the same host as 'from'.
+func (client *Info) replicaIndex(addr string, from int) (int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	if host == "" {
+		if host, _, err = net.SplitHostPort(client.SvrIps[from]); err != nil {
+			return 0, err
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+
+	for i, ip := range client.SvrIps {
+		if ip == addr {
+			return i, nil
+		}
+	}
+
+	client.SvrIps = append(client.SvrIps, addr)
+	client.Svrs = append(client.Svrs, nil)
+	client.reader = append(client.reader, nil)
+	client.gens = append(client.gens, 0)
+
+	i := len(client.SvrIps) - 1
+	if err = client.connectReplica(i); err != nil {
+		return 0, err
+	}
+	return i, nil
+}
@@ -2,21 +2,53 @@ package client
 
 import (
 	"context"
+	"sort"
 	"strconv"
 
+	"beelog-hraft/kvpb"
+	"beelog-hraft/record"
+
 	"github.com/Lz-Gustavo/beelog/pb"
 	"github.com/magiconair/properties"
 	"github.com/pingcap/go-ycsb/pkg/ycsb"
 )
 
 const (
-	defaultConfigFn  = "../client-config.toml"
-	kvbeelogConfigFn = "kvbeelog.config"
+	defaultConfigFn     = "../client-config.toml"
+	kvbeelogConfigFn    = "kvbeelog.config"
+	kvbeelogReadIndexFn = "kvbeelog.readindex"
+	kvbeelogSessionFn   = "kvbeelog.sessionreply"
+	kvbeelogRedirectFn  = "kvbeelog.redirect"
 )
 
 // beelogKV
 type beelogKV struct {
-	client Info
+	client    Info
+	readMode  kvpb.Command_ReadMode
+	replyMode kvpb.Command_ReplyMode
+	redirect  bool
+}
+
+// request sends 'cmd' to the cluster, returning its reply from the configured reply mode.
+// Scans and record reads are always replied on the session, since their replies exceed UDP
+// datagrams.
+func (bk *beelogKV) request(cmd *kvpb.Command) (string, error) {
+	if bk.redirect {
+		return bk.client.SendCommand(cmd)
+	}
+	if bk.replyMode == kvpb.Command_SESSION || cmd.Op == kvpb.Command_SCAN || cmd.Op == kvpb.Command_GETFIELDS {
+		id, err := bk.client.BroadcastRequest(cmd)
+		if err != nil {
+			return "", err
+		}
+		return bk.client.ReadReply(id)
+	}
+
+	err := bk.client.BroadcastCommand(cmd, strconv.Itoa(bk.client.Udpport))
+	if err != nil {
+		return "", err
+	}
+	return bk.client.ReadUDP()
 }
 
 // Close closes the database layer.
@@ -25,76 +57,69 @@ func (bk *beelogKV) Close() error {
 	return nil
 }
 
-// Read reads a record from the database and returns a map of each field/value pair.
+// Read reads a record from the database and returns a map of each field/value pair. Every
+// field is returned if 'fields' is empty.
 func (bk *beelogKV) Read(ctx context.Context, table string, key string, fields []string) (map[string][]byte, error) {
-	cmd := &pb.Command{
-		Op:  pb.Command_GET,
-		Key: key,
+	cmd := &kvpb.Command{
+		Op:     kvpb.Command_GETFIELDS,
+		Key:    key,
+		Read:   bk.readMode,
+		Fields: fieldNames(fields),
 	}
-	err := bk.client.BroadcastProtobuf(cmd, strconv.Itoa(bk.client.Udpport))
+	rep, err := bk.request(cmd)
 	if err != nil {
 		return nil, err
 	}
-
-	rep, err := bk.client.ReadUDP()
-	if err != nil {
-		return nil, err
-	}
-	return map[string][]byte{
-		key: []byte(rep),
-	}, nil
+	return ParseRecord(rep)
 }
 
-// Insert inserts a record in the database. Any field/value pairs will be written into the
-// database.
+// Insert inserts a record in the database, replacing any previous one. Any field/value pairs
+// will be written into the database.
 func (bk *beelogKV) Insert(ctx context.Context, table string, key string, values map[string][]byte) error {
-	// get a single value from values map
-	var val []byte
-	for k := range values {
-		val = values[k]
-		break
-	}
-
-	cmd := &pb.Command{
-		Op:    pb.Command_SET,
-		Key:   key,
-		Value: string(val),
+	cmd := &kvpb.Command{
+		Op:     kvpb.Command_PUTRECORD,
+		Key:    key,
+		Fields: fieldValues(values),
 	}
-	err := bk.client.BroadcastProtobuf(cmd, strconv.Itoa(bk.client.Udpport))
-	if err != nil {
-		return err
-	}
-
-	if _, err = bk.client.ReadUDP(); err != nil {
-		return err
-	}
-	return nil
+	_, err := bk.request(cmd)
+	return err
 }
 
 // Update updates a record in the database. Any field/value pairs will be written into the
 // database or overwritten the existing values with the same field name.
 func (bk *beelogKV) Update(ctx context.Context, table string, key string, values map[string][]byte) error {
-	// get a single value from values map
-	var val []byte
-	for k := range values {
-		val = values[k]
-		break
+	cmd := &kvpb.Command{
+		Op:     kvpb.Command_SETFIELDS,
+		Key:    key,
+		Fields: fieldValues(values),
 	}
+	_, err := bk.request(cmd)
+	return err
+}
 
-	cmd := &pb.Command{
-		Op:    pb.Command_SET,
-		Key:   key,
-		Value: string(val),
+// fieldValues returns the record fields of 'values', sorted by name so commands are
+// deterministic.
+func fieldValues(values map[string][]byte) []*kvpb.Command_Field {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
 	}
-	err := bk.client.BroadcastProtobuf(cmd, strconv.Itoa(bk.client.Udpport))
-	if err != nil {
-		return err
+	sort.Strings(names)
+
+	fields := make([]*kvpb.Command_Field, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, &kvpb.Command_Field{Name: name, Value: string(values[name])})
 	}
+	return fields
+}
 
-	if _, err = bk.client.ReadUDP(); err != nil {
-		return err
+// fieldNames returns record fields informing only the names on 'names'.
+func fieldNames(names []string) []*kvpb.Command_Field {
+	fields := make([]*kvpb.Command_Field, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, &kvpb.Command_Field{Name: name})
 	}
-	return nil
+	return fields
 }
 
 // InitThread initializes the state associated to the goroutine worker.
@@ -106,14 +131,43 @@ func (bk *beelogKV) InitThread(ctx context.Context, threadID int, threadCount in
 // CleanupThread cleans up the state when the worker finished.
 func (bk *beelogKV) CleanupThread(ctx context.Context) {}
 
-// Scan scans records from the database.
+// Scan scans 'count' records from the database in key order, starting at 'startKey', and
+// returns the fields named on 'fields' of each one, or every field if empty.
 func (bk *beelogKV) Scan(ctx context.Context, table string, startKey string, count int, fields []string) ([]map[string][]byte, error) {
-	return nil, nil
+	cmd := &kvpb.Command{
+		Op:    kvpb.Command_SCAN,
+		Key:   startKey,
+		Count: uint32(count),
+		Read:  bk.readMode,
+	}
+	rep, err := bk.request(cmd)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := ParseScan(rep)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]map[string][]byte, 0, len(pairs))
+	for _, p := range pairs {
+		values, err := record.Decode(p.Value)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, record.Select(values, fields))
+	}
+	return res, nil
 }
 
 // Delete deletes a record from the database.
 func (bk *beelogKV) Delete(ctx context.Context, table string, key string) error {
-	return nil
+	cmd := &kvpb.Command{
+		Op:  pb.Command_DELETE,
+		Key: key,
+	}
+	_, err := bk.request(cmd)
+	return err
 }
 
 // BeelogKVCreator ...
@@ -135,11 +189,23 @@ func (bc BeelogKVCreator) Create(p *properties.Properties) (ycsb.DB, error) {
 	if err = cl.Connect(); err != nil {
 		return nil, err
 	}
-	if err = cl.StartUDP(); err != nil {
-		return nil, err
+	kv := &beelogKV{
+		client: *cl,
+	}
+	if p.GetBool(kvbeelogReadIndexFn, false) {
+		kv.readMode = kvpb.Command_INDEX
+	}
+	if p.GetBool(kvbeelogSessionFn, false) {
+		kv.replyMode = kvpb.Command_SESSION
+		return kv, nil
+	}
+	if p.GetBool(kvbeelogRedirectFn, false) {
+		kv.redirect = true
+		return kv, nil
 	}
 
-	return &beelogKV{
-		client: *cl,
-	}, nil
+	if err = kv.client.StartUDP(); err != nil {
+		return nil, err
+	}
+	return kv, nil
 }
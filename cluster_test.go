@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"beelog-hraft/client"
+	"beelog-hraft/kvpb"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+	"github.com/hashicorp/raft"
+)
+
+// testNode is an in-process replica, serving clients on its own listener.
+type testNode struct {
+	store    *Store
+	server   *Server
+	raftAddr string
+	listener net.Listener
+	cancel   context.CancelFunc
+}
+
+// startTestCluster launches an in-process cluster of 'n' replicas on free raft and client
+// ports, returned once the first one is elected the leader.
+func startTestCluster(t testing.TB, n int) []*testNode {
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen for clients: %s", err.Error())
+		}
+		raftAddr, clientAddr := "127.0.0.1"+freeAddr(t), listener.Addr().String()
+		s := startClusterNode(t, fmt.Sprintf("node%d", i), raftAddr, clientAddr, i == 0)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		svr := startTestServer(ctx, s)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				svr.joins <- conn
+			}
+		}()
+		nodes[i] = &testNode{s, svr, raftAddr, listener, cancel}
+
+		if i == 0 {
+			waitLeader(t, s)
+			continue
+		}
+		if err = nodes[0].store.JoinRaft(fmt.Sprintf("node%d", i), raftAddr, true); err != nil {
+			t.Fatalf("failed to join node%d: %s", i, err.Error())
+		}
+		if err = nodes[0].store.registerPeer(raftAddr, clientAddr); err != nil {
+			t.Fatalf("failed to register node%d: %s", i, err.Error())
+		}
+	}
+	return nodes
+}
+
+// startTestServer launches a server for 's', independently of command line flags.
+func startTestServer(ctx context.Context, s *Store) *Server {
+	return startLimitedServer(ctx, s, 4096)
+}
+
+// startLimitedServer launches a server for 's' with up to 'maxInflight' proposals in flight.
+func startLimitedServer(ctx context.Context, s *Store, maxInflight int) *Server {
+	svr := &Server{
+		clients:  make(map[*Session]struct{}),
+		joins:    make(chan net.Conn),
+		quit:     make(chan struct{}),
+		inflight: make(chan struct{}, maxInflight),
+		kvstore:  s,
+	}
+	go svr.Listen(ctx)
+	return svr
+}
+
+// clientAddrs returns the addresses 'nodes' serve clients on.
+func clientAddrs(nodes []*testNode) []string {
+	addrs := make([]string, len(nodes))
+	for i, n := range nodes {
+		addrs[i] = n.listener.Addr().String()
+	}
+	return addrs
+}
+
+// kill abruptly stops the node, closing every client session.
+func (n *testNode) kill() {
+	if n.cancel == nil {
+		return
+	}
+	n.listener.Close()
+	n.server.Exit()
+	n.cancel()
+	n.cancel = nil
+	os.RemoveAll(n.store.RaftDir)
+}
+
+func TestClientSurvivesLeaderCrash(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	defer func() {
+		for _, n := range nodes {
+			n.kill()
+		}
+	}()
+
+	cl := &client.Info{
+		Rep:         3,
+		SvrIps:      clientAddrs(nodes),
+		TimeoutMsec: 500,
+	}
+	if err := cl.Connect(); err != nil {
+		t.Fatalf("failed to connect to cluster: %s", err.Error())
+	}
+	defer cl.Disconnect()
+
+	const numOps = 200
+	for i := 0; i < numOps; i++ {
+		if i == numOps/2 {
+			for _, n := range nodes {
+				if n.store.raft.State() == raft.Leader {
+					n.kill()
+				}
+			}
+		}
+
+		cmd := &kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: fmt.Sprint(i)}
+		rep, err := cl.SendCommand(cmd)
+		if err != nil {
+			t.Fatalf("failed to send command %d: %s", i, err.Error())
+		}
+		if rep != "OK: " {
+			t.Fatalf("unexpected reply to command %d: %q", i, rep)
+		}
+	}
+
+	rep, err := cl.SendCommand(&kvpb.Command{Op: pb.Command_GET, Key: "foo"})
+	if err != nil {
+		t.Fatalf("failed to read key: %s", err.Error())
+	}
+	if exp := fmt.Sprintf("OK: %d", numOps-1); rep != exp {
+		t.Fatalf("expected reply %q, got %q", exp, rep)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	nodes := startTestCluster(t, 1)
+	defer nodes[0].kill()
+
+	cl := &client.Info{
+		Rep:         1,
+		SvrIps:      clientAddrs(nodes),
+		TimeoutMsec: 500,
+	}
+	if err := cl.Connect(); err != nil {
+		t.Fatalf("failed to connect to cluster: %s", err.Error())
+	}
+	defer cl.Disconnect()
+
+	for _, k := range []string{"scan/c", "scan/a", "scan/b"} {
+		if _, err := cl.SendCommand(&kvpb.Command{Op: pb.Command_SET, Key: k, Value: k}); err != nil {
+			t.Fatalf("failed to set key: %s", err.Error())
+		}
+	}
+
+	for _, read := range []kvpb.Command_ReadMode{kvpb.Command_LOG, kvpb.Command_INDEX} {
+		cmd := &kvpb.Command{Op: kvpb.Command_SCAN, Key: "scan/", Count: 2, Read: read}
+		rep, err := cl.SendCommand(cmd)
+		if err != nil {
+			t.Fatalf("failed to scan keys: %s", err.Error())
+		}
+		pairs, err := client.ParseScan(rep)
+		if err != nil {
+			t.Fatalf("failed to parse scan reply: %s", err.Error())
+		}
+		if len(pairs) != 2 || pairs[0].Key != "scan/a" || string(pairs[1].Value) != "scan/b" {
+			t.Fatalf("unexpected scan result on read mode %d: %v", read, pairs)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	bl "github.com/Lz-Gustavo/beelog"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashicorp/go-hclog"
+)
+
+var beelogTickNames = map[string]bl.ReduceInterval{
+	"Immediately": bl.Immediately,
+	"Delayed":     bl.Delayed,
+	"Interval":    bl.Interval,
+}
+
+// Config holds the settings that vary across experiments, loaded at startup from the toml
+// file informed by '-config'. Each setting has a matching flag, which takes precedence over
+// the file when explicitly set on the command line.
+type Config struct {
+	// LogStrategy is the name of a LogStrategy (e.g. "BeelogConcTable"). If empty,
+	// "DiskTrad" is assumed when '-logfolder' is provided, "BeelogConcTable" otherwise.
+	LogStrategy string
+
+	// beelog configuration, ignored if LogStrategy isnt 'Beelog*'. BeelogTick is one of
+	// "Immediately", "Delayed" or "Interval", and BeelogPeriod is ignored if not Interval.
+	BeelogTick   string
+	BeelogInmem  bool
+	BeelogPeriod int
+
+	// Engine stores the key-value state, either "memory" or "disk". EngineDir is where the
+	// "disk" engine keeps its data files, "checkpoints/<id>/state" if empty.
+	Engine    string
+	EngineDir string
+
+	// CompressValues gzip compresses values on the key-value store, and PreInitialize sets
+	// 'NumInitKeys' keys with values of 'InitValueSize' bytes before serving any command.
+	CompressValues bool
+	PreInitialize  bool
+	NumInitKeys    int
+	InitValueSize  int
+
+	// HistoryWindow is the number of latest raft indexes whose changes are retained, so keys
+	// can be read as of any of them, changes listed from them and watches resumed from them.
+	// Zero retains nothing.
+	HistoryWindow uint64
+
+	// Used in catastrophic fault models, where crash faults must be recoverable even if
+	// all nodes presented in the consensus cluster are down. Always set to false in any
+	// other cases, because this strong assumption greatly degradates performance.
+	CatastrophicFaults bool
+
+	// LogLevel of raft and the store, as accepted by hclog (e.g. "INFO").
+	LogLevel string
+
+	// resolved by validate
+	logStrategy LogStrategy
+	beelogTick  bl.ReduceInterval
+}
+
+// cfg is the configuration of the replica, defaults unless loaded by main.
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		BeelogTick:    "Interval",
+		Engine:        "memory",
+		BeelogPeriod:  4000,
+		PreInitialize: true,
+		NumInitKeys:   1000000,
+		InitValueSize: 1024,
+		HistoryWindow: 10000,
+		LogLevel:      "INFO",
+		logStrategy:   BeelogConcTable,
+		beelogTick:    bl.Interval,
+	}
+}
+
+// registerFlags binds the settings of 'c' to flags on 'fs'.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.LogStrategy, "logstrategy", c.LogStrategy, "set the command log strategy (e.g. 'BeelogConcTable', 'DiskTrad' or 'NotLog')")
+	fs.StringVar(&c.BeelogTick, "beelogtick", c.BeelogTick, "set when beelog structures reduce the log, 'Immediately', 'Delayed' or 'Interval'")
+	fs.BoolVar(&c.BeelogInmem, "beeloginmem", c.BeelogInmem, "keep reduced beelog logs in memory instead of persisting them")
+	fs.IntVar(&c.BeelogPeriod, "beelogperiod", c.BeelogPeriod, "set the number of commands between beelog reduces on 'Interval'")
+	fs.StringVar(&c.Engine, "engine", c.Engine, "set the storage engine of the key-value state, 'memory' or 'disk'")
+	fs.StringVar(&c.EngineDir, "enginedir", c.EngineDir, "set the directory of the 'disk' storage engine, defaults to 'checkpoints/<id>/state'")
+	fs.BoolVar(&c.CompressValues, "compress", c.CompressValues, "gzip compress values on the key-value store")
+	fs.BoolVar(&c.PreInitialize, "preinit", c.PreInitialize, "pre-initialize the key-value store with '-initkeys' keys")
+	fs.IntVar(&c.NumInitKeys, "initkeys", c.NumInitKeys, "set the number of keys pre-initialized on the key-value store")
+	fs.IntVar(&c.InitValueSize, "initvaluesize", c.InitValueSize, "set the size in bytes of pre-initialized values")
+	fs.Uint64Var(&c.HistoryWindow, "historywindow", c.HistoryWindow, "set the number of latest raft indexes whose changes are retained for reads on past indexes")
+	fs.BoolVar(&c.CatastrophicFaults, "catastrophic", c.CatastrophicFaults, "synchronously persist every log write, tolerating crashes of the entire cluster")
+	fs.StringVar(&c.LogLevel, "loglevel", c.LogLevel, "set the log level of raft and the store")
+}
+
+// load decodes the toml file 'fn', if informed, then restores the flags explicitly set on
+// 'fs' and validates the result. Must be called after 'fs' is parsed.
+func (c *Config) load(fs *flag.FlagSet, fn, logFolder string) error {
+	if fn != "" {
+		set := make(map[*flag.Flag]string)
+		fs.Visit(func(f *flag.Flag) {
+			set[f] = f.Value.String()
+		})
+
+		md, err := toml.DecodeFile(fn, c)
+		if err != nil {
+			return fmt.Errorf("failed to decode config file '%s': %s", fn, err.Error())
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			return fmt.Errorf("unknown key '%s' on config file '%s'", keys[0], fn)
+		}
+
+		for f, v := range set {
+			f.Value.Set(v)
+		}
+	}
+	return c.validate(logFolder)
+}
+
+// validate checks every setting of 'c', resolving LogStrategy and BeelogTick.
+func (c *Config) validate(logFolder string) error {
+	switch c.LogStrategy {
+	case "":
+		c.logStrategy = BeelogConcTable
+		if logFolder != "" {
+			c.logStrategy = DiskTrad
+		}
+
+	default:
+		ls, err := parseLogStrategy(c.LogStrategy)
+		if err != nil {
+			return err
+		}
+		c.logStrategy = ls
+	}
+
+	tick, ok := beelogTickNames[c.BeelogTick]
+	if !ok {
+		return fmt.Errorf("unknown beelog tick '%s', expected 'Immediately', 'Delayed' or 'Interval'", c.BeelogTick)
+	}
+	c.beelogTick = tick
+	if tick == bl.Interval && c.BeelogPeriod <= 0 {
+		return fmt.Errorf("beelog period must be positive on 'Interval' tick, got %d", c.BeelogPeriod)
+	}
+
+	if c.Engine != "memory" && c.Engine != "disk" {
+		return fmt.Errorf("unknown storage engine '%s', expected 'memory' or 'disk'", c.Engine)
+	}
+	if c.NumInitKeys < 0 || c.InitValueSize < 0 {
+		return fmt.Errorf("number of initial keys and their value size cannot be negative")
+	}
+	if hclog.LevelFromString(c.LogLevel) == hclog.NoLevel {
+		return fmt.Errorf("unknown log level '%s'", c.LogLevel)
+	}
+	return nil
+}
+
+// engineDir returns the directory of the "disk" storage engine.
+func (c *Config) engineDir() string {
+	if c.EngineDir != "" {
+		return c.EngineDir
+	}
+	return "checkpoints/" + svrID + "/state"
+}
+
+// parseLogStrategy returns the LogStrategy named 'name'.
+func parseLogStrategy(name string) (LogStrategy, error) {
+	for i, n := range logStrategyNames {
+		if n == name {
+			return LogStrategy(i), nil
+		}
+	}
+	return NotLog, fmt.Errorf("unknown log strategy '%s', expected one of %v", name, logStrategyNames)
+}
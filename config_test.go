@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"beelog-hraft/engine"
+
+	bl "github.com/Lz-Gustavo/beelog"
+	"github.com/Lz-Gustavo/beelog/pb"
+)
+
+func TestConfigFileAndFlags(t *testing.T) {
+	fd, err := ioutil.TempFile("", "beelog-config")
+	if err != nil {
+		t.Fatalf("failed to create config file: %s", err.Error())
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString(`
+LogStrategy = "BeelogAVL"
+BeelogTick = "Delayed"
+NumInitKeys = 10
+CatastrophicFaults = true
+`)
+	fd.Close()
+
+	c := defaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.registerFlags(fs)
+	if err = fs.Parse([]string{"-initkeys", "20", "-compress"}); err != nil {
+		t.Fatalf("failed to parse flags: %s", err.Error())
+	}
+	if err = c.load(fs, fd.Name(), ""); err != nil {
+		t.Fatalf("failed to load config: %s", err.Error())
+	}
+
+	if c.logStrategy != BeelogAVL || c.beelogTick != bl.Delayed || !c.CatastrophicFaults {
+		t.Fatalf("expected settings from the config file, got %+v", c)
+	}
+	if c.NumInitKeys != 20 || !c.CompressValues {
+		t.Fatalf("expected flags to override the config file, got %+v", c)
+	}
+	if c.InitValueSize != 1024 || c.BeelogPeriod != 4000 {
+		t.Fatalf("expected defaults for unset settings, got %+v", c)
+	}
+}
+
+func TestConfigDefaultLogStrategy(t *testing.T) {
+	c := defaultConfig()
+	if err := c.validate(""); err != nil || c.logStrategy != BeelogConcTable {
+		t.Fatalf("expected BeelogConcTable by default, got %v (err: %v)", c.logStrategy, err)
+	}
+	if err := c.validate("/tmp/"); err != nil || c.logStrategy != DiskTrad {
+		t.Fatalf("expected DiskTrad when a log folder is informed, got %v (err: %v)", c.logStrategy, err)
+	}
+	c.LogStrategy = "InmemTrad"
+	if err := c.validate("/tmp/"); err != nil || c.logStrategy != InmemTrad {
+		t.Fatalf("expected the configured strategy, got %v (err: %v)", c.logStrategy, err)
+	}
+}
+
+func TestConfigRejectsInvalid(t *testing.T) {
+	invalid := map[string]func(c *Config){
+		"strategy":  func(c *Config) { c.LogStrategy = "BeelogTree" },
+		"tick":      func(c *Config) { c.BeelogTick = "Sometimes" },
+		"period":    func(c *Config) { c.BeelogPeriod = 0 },
+		"keys":      func(c *Config) { c.NumInitKeys = -1 },
+		"log level": func(c *Config) { c.LogLevel = "LOUD" },
+	}
+	for name, set := range invalid {
+		c := defaultConfig()
+		set(c)
+		if err := c.validate(""); err == nil {
+			t.Fatalf("expected invalid %s to be rejected", name)
+		}
+	}
+
+	fd, _ := ioutil.TempFile("", "beelog-config")
+	defer os.Remove(fd.Name())
+	fd.WriteString("LogStrategi = \"NotLog\"\n")
+	fd.Close()
+	if err := defaultConfig().load(flag.NewFlagSet("test", flag.ContinueOnError), fd.Name(), ""); err == nil {
+		t.Fatalf("expected unknown config keys to be rejected")
+	}
+}
+
+func TestInitLogConfigForEveryStrategy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beelog-hraft")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	folder := dir + "/"
+	defer func(c *Config, f *string) { cfg, logfolder = c, f }(cfg, logfolder)
+	logfolder = &folder
+
+	for _, name := range logStrategyNames {
+		cfg = defaultConfig()
+		cfg.LogStrategy, cfg.BeelogInmem, cfg.BeelogTick = name, true, "Delayed"
+		if err := cfg.validate(folder); err != nil {
+			t.Fatalf("failed to validate %s: %s", name, err.Error())
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s := &Store{m: engine.NewMemory()}
+		if err := s.initLogConfig(ctx); err != nil {
+			t.Fatalf("failed to init %s: %s", name, err.Error())
+		}
+		if s.Logging.String() != name {
+			t.Fatalf("expected %s strategy, got %s", name, s.Logging)
+		}
+		applyCommand(t, s, 1, &pb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar"})
+		applyCommand(t, s, 2, &pb.Command{Op: pb.Command_SET, Key: "baz", Value: "qux"})
+
+		logged := uint64(atomic.LoadUint32(&s.logCount)) + atomic.LoadUint64(&s.logLen)
+		if (s.Logging == NotLog) != (logged == 0) {
+			t.Fatalf("%s: unexpected logged commands count %d", name, logged)
+		}
+		if s.Logging != NotLog && s.Logging != BeelogConcTable {
+			if state := recoverStateFromLog(t, s, 1, 2); state["foo"] != "bar" {
+				t.Fatalf("%s: expected 'bar' on recovered key, got state: %v", name, state)
+			}
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const (
+	// maxDedupClients bounds the number of clients tracked by the deduplication table. The
+	// least recently active client is evicted once exceeded.
+	maxDedupClients = 1 << 16
+)
+
+// clientSession records the latest command applied for a client, identified by its sequence
+// number, and its cached result.
+type clientSession struct {
+	seq    uint64
+	index  uint64 // raft index of the latest command, deterministically orders evictions
+	result string
+}
+
+// dedupTable maps client IDs to their sessions, ensuring retried commands are applied at
+// most once. Since it's only modified by applied commands, every replica holds the same
+// table. Must only be accessed by the fsm.
+type dedupTable map[uint64]*clientSession
+
+// lookup checks if command 'seq' from 'client' was already applied, returning its cached
+// result. Commands older than the latest one are also reported as applied, but with no
+// result, since clients no longer wait for them.
+func (d dedupTable) lookup(client, seq uint64) (string, bool) {
+	cs, ok := d[client]
+	if !ok || seq > cs.seq {
+		return "", false
+	}
+	if seq == cs.seq {
+		return cs.result, true
+	}
+	return "", true
+}
+
+// record registers 'result' as the result of command 'seq' from 'client', applied at raft
+// index 'index'.
+func (d dedupTable) record(client, seq, index uint64, result string) {
+	if cs, ok := d[client]; ok {
+		cs.seq, cs.index, cs.result = seq, index, result
+		return
+	}
+
+	if len(d) >= maxDedupClients {
+		d.evict()
+	}
+	d[client] = &clientSession{seq, index, result}
+}
+
+// evict removes the client whose latest command has the lowest raft index.
+func (d dedupTable) evict() {
+	var (
+		victim uint64
+		oldest uint64
+		first  = true
+	)
+	for id, cs := range d {
+		if first || cs.index < oldest {
+			victim, oldest, first = id, cs.index, false
+		}
+	}
+	delete(d, victim)
+}
+
+// clone returns a copy of the table, safe to be read concurrently with further commands.
+func (d dedupTable) clone() dedupTable {
+	o := make(dedupTable, len(d))
+	for id, cs := range d {
+		c := *cs
+		o[id] = &c
+	}
+	return o
+}
+
+// encodeSession returns the snapshot entry of client 'id' on 'dedupSection', keyed by its ID.
+func encodeSession(id uint64, cs *clientSession) (string, []byte) {
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(cs.result))
+	n := binary.PutUvarint(buf, cs.seq)
+	n += binary.PutUvarint(buf[n:], cs.index)
+	n += copy(buf[n:], cs.result)
+	return strconv.FormatUint(id, 10), buf[:n]
+}
+
+// decodeSession parses a snapshot entry encoded by 'encodeSession'.
+func decodeSession(key string, value []byte) (uint64, *clientSession, error) {
+	id, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	seq, n := binary.Uvarint(value)
+	if n <= 0 {
+		return 0, nil, errors.New("malformed deduplication entry")
+	}
+	index, m := binary.Uvarint(value[n:])
+	if m <= 0 {
+		return 0, nil, errors.New("malformed deduplication entry")
+	}
+	return id, &clientSession{seq, index, string(value[n+m:])}, nil
+}
@@ -0,0 +1,279 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	diskExt = ".db"
+
+	// location of a value on a data file: offset and length, 64b and 32b BigEndian.
+	locSize = 12
+
+	// default threshold of dead bytes on a data file before compacting it
+	compactThreshold int64 = 64 << 20
+)
+
+// dataFile is an append-only file storing values, one after another. Replaced files are
+// removed once no snapshot references them.
+type dataFile struct {
+	fd       *os.File
+	refs     int
+	obsolete bool
+}
+
+// generation is a data file and the index locating the latest value of each key on it.
+type generation struct {
+	file  *dataFile
+	index *Memory
+	size  int64
+	dead  int64
+}
+
+// Disk stores values on append-only data files, keeping only their keys and locations in
+// memory. The index is never paged out, holding each key, its 12 byte location and a node of
+// the ordered index used by scans, so memory grows with the number and size of keys.
+// Overwritten and deleted values are reclaimed by compacting the live ones into a new file. Since raft rebuilds the state on restart from snapshots and the log, data
+// files are not replayed and any previous one is discarded on OpenDisk.
+type Disk struct {
+	dir string
+	seq int
+
+	// data files are compacted once their dead bytes exceed both the live ones and
+	// 'compactAt'
+	compactAt int64
+
+	// mu excludes reads from writes and compactions, which may replace 'cur'
+	mu  sync.RWMutex
+	cur *generation
+}
+
+// OpenDisk creates a Disk engine at 'dir', removing any previous data file.
+func OpenDisk(dir string) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*"+diskExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range old {
+		if err = os.Remove(fn); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &Disk{dir: dir, compactAt: compactThreshold}
+	if d.cur, err = d.newGeneration(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Disk) newGeneration() (*generation, error) {
+	d.seq++
+	fn := filepath.Join(d.dir, fmt.Sprintf("state-%08d%s", d.seq, diskExt))
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &generation{file: &dataFile{fd: fd}, index: NewMemory()}, nil
+}
+
+// set appends 'value' on the generation file, locating it on the index.
+func (g *generation) set(key string, value []byte) error {
+	if _, err := g.file.fd.WriteAt(value, g.size); err != nil {
+		return err
+	}
+	loc := make([]byte, locSize)
+	binary.BigEndian.PutUint64(loc, uint64(g.size))
+	binary.BigEndian.PutUint32(loc[8:], uint32(len(value)))
+	g.size += int64(len(value))
+
+	g.discard(key)
+	return g.index.Set(key, loc)
+}
+
+// discard accounts the current value of 'key', if any, as dead.
+func (g *generation) discard(key string) {
+	if loc, ok, _ := g.index.Get(key); ok {
+		g.dead += int64(binary.BigEndian.Uint32(loc[8:]))
+	}
+}
+
+// Get reads the value of 'key' from disk.
+func (d *Disk) Get(key string) ([]byte, bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	loc, ok, _ := d.cur.index.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	value, err := readValue(d.cur.file, loc)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func readValue(f *dataFile, loc []byte) ([]byte, error) {
+	value := make([]byte, binary.BigEndian.Uint32(loc[8:]))
+	if _, err := f.fd.ReadAt(value, int64(binary.BigEndian.Uint64(loc))); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Set appends 'value' on the current data file, compacting it if needed.
+func (d *Disk) Set(key string, value []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.cur.set(key, value); err != nil {
+		return err
+	}
+	return d.maybeCompact()
+}
+
+// Delete removes 'key' from the index, its value is reclaimed on the next compaction.
+func (d *Disk) Delete(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cur.discard(key)
+	d.cur.index.Delete(key)
+	return d.maybeCompact()
+}
+
+// Scan reads from disk the values of up to 'count' keys greater or equal to 'start', in
+// order. Writes are blocked during the scan.
+func (d *Disk) Scan(start string, count int, fn func(key string, value []byte) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.cur.index.Scan(start, count, func(key string, loc []byte) error {
+		value, err := readValue(d.cur.file, loc)
+		if err != nil {
+			return err
+		}
+		return fn(key, value)
+	})
+}
+
+// Len returns the number of keys stored.
+func (d *Disk) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.cur.index.Len()
+}
+
+// maybeCompact copies the live values into a new data file once the dead ones dominate
+// the current file. Reads and writes are blocked during compaction. Must be called with
+// 'mu' held.
+func (d *Disk) maybeCompact() error {
+	g := d.cur
+	if g.dead < d.compactAt || g.dead < g.size-g.dead {
+		return nil
+	}
+
+	next, err := d.newGeneration()
+	if err != nil {
+		return err
+	}
+	err = g.index.shardsView().ForEach(func(key string, loc []byte) error {
+		value, err := readValue(g.file, loc)
+		if err != nil {
+			return err
+		}
+		return next.set(key, value)
+	})
+	if err != nil {
+		next.file.remove()
+		return err
+	}
+	d.replace(next)
+	return nil
+}
+
+// replace swaps the current generation by 'next'. Must be called with 'mu' held.
+func (d *Disk) replace(next *generation) {
+	old := d.cur.file
+	d.cur = next
+	old.obsolete = true
+	if old.refs == 0 {
+		old.remove()
+	}
+}
+
+func (f *dataFile) remove() {
+	f.fd.Close()
+	os.Remove(f.fd.Name())
+}
+
+// Snapshot captures the index in constant time, retaining the current data file until
+// the snapshot is released. Values are read from disk while iterating.
+func (d *Disk) Snapshot() (Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cur.file.refs++
+	return &diskSnapshot{d: d, file: d.cur.file, index: d.cur.index.shardsView()}, nil
+}
+
+// Restore writes the pairs informed by 'load' on a new data file, replacing the current
+// one once loaded.
+func (d *Disk) Restore(load func(set func(key string, value []byte) error) error) error {
+	d.mu.Lock()
+	next, err := d.newGeneration()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// only the fsm writes, so 'next' is filled without holding 'mu'
+	if err = load(next.set); err != nil {
+		next.file.remove()
+		return err
+	}
+
+	d.mu.Lock()
+	d.replace(next)
+	d.mu.Unlock()
+	return nil
+}
+
+// Close closes the current data file, keeping it on disk.
+func (d *Disk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cur.file.fd.Close()
+}
+
+type diskSnapshot struct {
+	d     *Disk
+	file  *dataFile
+	index memorySnapshot
+	once  sync.Once
+}
+
+func (ds *diskSnapshot) ForEach(fn func(key string, value []byte) error) error {
+	return ds.index.ForEach(func(key string, loc []byte) error {
+		value, err := readValue(ds.file, loc)
+		if err != nil {
+			return err
+		}
+		return fn(key, value)
+	})
+}
+
+func (ds *diskSnapshot) Release() {
+	ds.once.Do(func() {
+		ds.d.mu.Lock()
+		defer ds.d.mu.Unlock()
+		ds.file.refs--
+		if ds.file.obsolete && ds.file.refs == 0 {
+			ds.file.remove()
+		}
+	})
+}
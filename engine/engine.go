@@ -0,0 +1,58 @@
+// Package engine implements the storage engines of the key-value state machine. Memory
+// keeps the entire state in RAM, while Disk keeps only keys and the location of their values
+// in RAM, storing values on an append-only file. Disk therefore only reduces memory usage
+// when values are large compared to keys, and every key must still fit in RAM.
+package engine
+
+import "fmt"
+
+// Engine stores the state of the key-value state machine. Writes are issued by a single
+// goroutine (i.e. the fsm), but reads and snapshots may be served concurrently to them.
+type Engine interface {
+	Get(key string) ([]byte, bool, error)
+
+	// Set stores 'value' on 'key'. Engines may retain 'value', which must not be modified
+	// afterwards.
+	Set(key string, value []byte) error
+	Delete(key string) error
+
+	// Scan calls 'fn' for up to 'count' keys greater or equal to 'start', in increasing
+	// order, until any call fails. Scans observe a consistent state, never a partially
+	// applied write.
+	Scan(start string, count int, fn func(key string, value []byte) error) error
+
+	// Len returns the number of keys stored.
+	Len() int
+
+	// Snapshot captures the current state, iterated concurrently with later writes.
+	Snapshot() (Snapshot, error)
+
+	// Restore replaces the entire state by the pairs informed by 'load' to its setter.
+	// The previous state is kept if 'load' fails.
+	Restore(load func(set func(key string, value []byte) error) error) error
+
+	Close() error
+}
+
+// Snapshot is an immutable view of an Engine state.
+type Snapshot interface {
+	// ForEach calls 'fn' for every pair on the snapshot, in no particular order, until
+	// any call fails.
+	ForEach(fn func(key string, value []byte) error) error
+
+	// Release frees the resources held by the snapshot, which must not be used afterwards.
+	Release()
+}
+
+// New returns the engine named 'name', either "memory" or "disk", with the latter storing
+// its files at 'dir'.
+func New(name, dir string) (Engine, error) {
+	switch name {
+	case "memory":
+		return NewMemory(), nil
+	case "disk":
+		return OpenDisk(dir)
+	default:
+		return nil, fmt.Errorf("unknown storage engine '%s', expected 'memory' or 'disk'", name)
+	}
+}
@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// forEachEngine runs 'fn' against a new instance of every engine.
+func forEachEngine(t *testing.T, fn func(t *testing.T, e Engine)) {
+	dir, err := ioutil.TempDir("", "beelog-engine")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"memory", "disk"} {
+		t.Run(name, func(t *testing.T) {
+			e, err := New(name, filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("failed to create engine: %s", err.Error())
+			}
+			defer e.Close()
+			fn(t, e)
+		})
+	}
+}
+
+// contents returns every pair stored on 's'.
+func contents(t *testing.T, s Snapshot) map[string]string {
+	m := make(map[string]string)
+	err := s.ForEach(func(key string, value []byte) error {
+		m[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate snapshot: %s", err.Error())
+	}
+	return m
+}
+
+func mustGet(t *testing.T, e Engine, key string) (string, bool) {
+	value, ok, err := e.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get '%s': %s", key, err.Error())
+	}
+	return string(value), ok
+}
+
+func TestOperations(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		e.Set("foo", []byte("bar"))
+		e.Set("baz", []byte("qux"))
+		e.Set("foo", []byte("bar2"))
+		e.Set("empty", []byte{})
+		e.Delete("baz")
+		e.Delete("missing")
+
+		if v, ok := mustGet(t, e, "foo"); !ok || v != "bar2" {
+			t.Fatalf("expected 'bar2' on foo, got '%s' (found: %v)", v, ok)
+		}
+		if v, ok := mustGet(t, e, "empty"); !ok || v != "" {
+			t.Fatalf("expected empty value, got '%s' (found: %v)", v, ok)
+		}
+		if _, ok := mustGet(t, e, "baz"); ok {
+			t.Fatalf("deleted key still found")
+		}
+		if e.Len() != 2 {
+			t.Fatalf("expected 2 keys, got %d", e.Len())
+		}
+	})
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		e.Set("foo", []byte("bar"))
+		e.Set("baz", []byte("qux"))
+
+		snap, err := e.Snapshot()
+		if err != nil {
+			t.Fatalf("failed to snapshot: %s", err.Error())
+		}
+		defer snap.Release()
+
+		e.Set("foo", []byte("changed"))
+		e.Delete("baz")
+		e.Set("new", []byte("key"))
+
+		exp := map[string]string{"foo": "bar", "baz": "qux"}
+		if got := contents(t, snap); !reflect.DeepEqual(exp, got) {
+			t.Fatalf("expected snapshot %v, got %v", exp, got)
+		}
+	})
+}
+
+func TestRestore(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		e.Set("foo", []byte("bar"))
+
+		err := e.Restore(func(set func(string, []byte) error) error {
+			set("baz", []byte("qux"))
+			return errors.New("corrupted snapshot")
+		})
+		if err == nil {
+			t.Fatalf("expected restore to fail")
+		}
+		if v, _ := mustGet(t, e, "foo"); v != "bar" || e.Len() != 1 {
+			t.Fatalf("expected the previous state to be kept after a failed restore")
+		}
+
+		err = e.Restore(func(set func(string, []byte) error) error {
+			return set("baz", []byte("qux"))
+		})
+		if err != nil {
+			t.Fatalf("failed to restore: %s", err.Error())
+		}
+		if _, ok := mustGet(t, e, "foo"); ok || e.Len() != 1 {
+			t.Fatalf("expected the previous state to be replaced")
+		}
+		if v, _ := mustGet(t, e, "baz"); v != "qux" {
+			t.Fatalf("expected 'qux' on baz, got '%s'", v)
+		}
+	})
+}
+
+func TestRestoreIsAtomic(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		// restores alternate between states of 'small' and 'large' keys, spread over every
+		// shard, while readers must observe either one entirely
+		const small, large = 100, 300
+		restore := func(n int) {
+			err := e.Restore(func(set func(string, []byte) error) error {
+				for i := 0; i < n; i++ {
+					if err := set(strconv.Itoa(i), []byte(strconv.Itoa(n))); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Errorf("failed to restore: %s", err.Error())
+			}
+		}
+		restore(small)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 50; i++ {
+				restore(large)
+				restore(small)
+			}
+		}()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := e.Len(); n != small && n != large {
+				t.Fatalf("observed a partially restored state of %d keys", n)
+			}
+			snap, err := e.Snapshot()
+			if err != nil {
+				t.Fatalf("failed to snapshot: %s", err.Error())
+			}
+			got := contents(t, snap)
+			snap.Release()
+			if len(got) != small && len(got) != large || got["0"] != strconv.Itoa(len(got)) {
+				t.Fatalf("snapshot observed a partially restored state of %d keys", len(got))
+			}
+		}
+	})
+}
+
+// scan returns the keys and values of up to 'count' keys from 'start' on 'e'.
+func scan(t *testing.T, e Engine, start string, count int) []string {
+	var got []string
+	err := e.Scan(start, count, func(key string, value []byte) error {
+		got = append(got, key+"="+string(value))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to scan: %s", err.Error())
+	}
+	return got
+}
+
+func TestScan(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, e Engine) {
+		for _, k := range []string{"d", "b", "e", "a", "c"} {
+			e.Set(k, []byte(k))
+		}
+		e.Set("c", []byte("c2"))
+		e.Delete("d")
+
+		if got, exp := scan(t, e, "", 10), []string{"a=a", "b=b", "c=c2", "e=e"}; !reflect.DeepEqual(exp, got) {
+			t.Fatalf("expected %v, got %v", exp, got)
+		}
+		if got, exp := scan(t, e, "bb", 2), []string{"c=c2", "e=e"}; !reflect.DeepEqual(exp, got) {
+			t.Fatalf("expected %v, got %v", exp, got)
+		}
+		if got := scan(t, e, "f", 10); len(got) != 0 {
+			t.Fatalf("expected no keys after 'e', got %v", got)
+		}
+
+		e.Restore(func(set func(string, []byte) error) error {
+			return set("z", []byte("z"))
+		})
+		if got, exp := scan(t, e, "", 10), []string{"z=z"}; !reflect.DeepEqual(exp, got) {
+			t.Fatalf("expected %v after restore, got %v", exp, got)
+		}
+	})
+}
+
+func TestSkipListOrder(t *testing.T) {
+	l := newSkipList()
+	for _, i := range rand.Perm(1000) {
+		l.insert(fmt.Sprintf("%04d", i))
+	}
+	for i := 0; i < 1000; i += 2 {
+		l.remove(fmt.Sprintf("%04d", i))
+	}
+
+	exp := 1
+	l.ascend("", func(key string) bool {
+		if key != fmt.Sprintf("%04d", exp) {
+			t.Fatalf("expected key %04d, got %s", exp, key)
+		}
+		exp += 2
+		return true
+	})
+	if exp != 1001 {
+		t.Fatalf("expected 500 keys, stopped before %d", exp)
+	}
+}
+
+func TestDiskCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beelog-engine")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := OpenDisk(dir)
+	if err != nil {
+		t.Fatalf("failed to open engine: %s", err.Error())
+	}
+	defer d.Close()
+	d.compactAt = 1 << 10
+
+	value := make([]byte, 100)
+	for i := 0; i < 10; i++ {
+		d.Set(strconv.Itoa(i), value)
+	}
+	snap, _ := d.Snapshot()
+
+	// overwrites every key a few times, compacting the file
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 10; i++ {
+			d.Set(strconv.Itoa(i), []byte(strconv.Itoa(round)))
+		}
+	}
+	if d.cur.size-d.cur.dead != 10 {
+		t.Fatalf("expected only live values on the data file, got %d live of %d bytes", d.cur.size-d.cur.dead, d.cur.size)
+	}
+	if v, _ := mustGet(t, d, "7"); v != "4" {
+		t.Fatalf("expected '4' on key 7, got '%s'", v)
+	}
+
+	// replaced data files are retained by open snapshots
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+diskExt))
+	if len(files) != 2 {
+		t.Fatalf("expected the snapshot data file to be retained, got files: %v", files)
+	}
+	if got := contents(t, snap); len(got) != 10 || got["7"] != string(value) {
+		t.Fatalf("unexpected snapshot after compaction: %v", got)
+	}
+
+	snap.Release()
+	files, _ = filepath.Glob(filepath.Join(dir, "*"+diskExt))
+	if len(files) != 1 {
+		t.Fatalf("expected the replaced data file to be removed on release, got files: %v", files)
+	}
+}
+
+func TestOpenDiskDiscardsPreviousFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beelog-engine")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	d, _ := OpenDisk(dir)
+	d.Set("foo", []byte("bar"))
+	d.Close()
+
+	d, err = OpenDisk(dir)
+	if err != nil {
+		t.Fatalf("failed to reopen engine: %s", err.Error())
+	}
+	defer d.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+diskExt))
+	if d.Len() != 0 || len(files) != 1 {
+		t.Fatalf("expected an empty engine, got %d keys and files %v", d.Len(), files)
+	}
+}
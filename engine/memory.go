@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// numShards is the number of independent partitions of the key-value map, each one
+// guarded by its own lock and copied on write separately.
+const numShards = 64
+
+// shard is a partition of Memory. Once captured by a snapshot, 'm' is marked as 'shared'
+// and never mutated again, with the next write copying it into a new map.
+type shard struct {
+	mu     sync.RWMutex
+	m      map[string][]byte
+	shared bool
+}
+
+// Memory is a sharded map with per-shard copy-on-write, allowing snapshots to be captured
+// in constant time without blocking concurrent writes. The cost of copying the state is
+// amortized over the first write to each shard after a snapshot. Stored values must not
+// be modified in place, since they are shared with captured snapshots. Keys are also kept
+// on an ordered index, serving range scans.
+type Memory struct {
+	// state holds a *memoryState, replaced as a whole by Restore so readers never observe
+	// a partially restored state
+	state atomic.Value
+
+	// order guards the ordered index, and is held by writes while updating both shards and
+	// the index, so scans observe every write either entirely or not at all
+	order sync.RWMutex
+}
+
+// memoryState is the content of a Memory engine: its shards and the ordered index of keys.
+type memoryState struct {
+	shards [numShards]*shard
+	keys   *skipList
+}
+
+// NewMemory returns an empty Memory engine.
+func NewMemory() *Memory {
+	km := &Memory{}
+	km.state.Store(newMemoryState())
+	return km
+}
+
+func newMemoryState() *memoryState {
+	st := &memoryState{keys: newSkipList()}
+	for i := range st.shards {
+		st.shards[i] = &shard{m: make(map[string][]byte)}
+	}
+	return st
+}
+
+func (km *Memory) load() *memoryState {
+	return km.state.Load().(*memoryState)
+}
+
+// shardFor returns the shard of 'key', following a 32b FNV-1a hash.
+func (st *memoryState) shardFor(key string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return st.shards[h%numShards]
+}
+
+// Get returns the value of 'key', never failing.
+func (km *Memory) Get(key string) ([]byte, bool, error) {
+	sh := km.load().shardFor(key)
+	sh.mu.RLock()
+	value, ok := sh.m[key]
+	sh.mu.RUnlock()
+	return value, ok, nil
+}
+
+// Set stores 'value' on 'key', never failing.
+func (km *Memory) Set(key string, value []byte) error {
+	km.order.Lock()
+	defer km.order.Unlock()
+	return km.load().set(key, value)
+}
+
+// set stores 'value' on 'key'. Must hold the 'order' lock of its engine, if any.
+func (st *memoryState) set(key string, value []byte) error {
+	sh := st.shardFor(key)
+	sh.mu.Lock()
+	sh.own()
+	_, found := sh.m[key]
+	sh.m[key] = value
+	sh.mu.Unlock()
+
+	if !found {
+		st.keys.insert(key)
+	}
+	return nil
+}
+
+// Delete removes 'key', never failing.
+func (km *Memory) Delete(key string) error {
+	km.order.Lock()
+	defer km.order.Unlock()
+
+	st := km.load()
+	sh := st.shardFor(key)
+	sh.mu.Lock()
+	_, found := sh.m[key]
+	if found {
+		sh.own()
+		delete(sh.m, key)
+	}
+	sh.mu.Unlock()
+
+	if found {
+		st.keys.remove(key)
+	}
+	return nil
+}
+
+// Scan calls 'fn' for up to 'count' keys greater or equal to 'start', in order, until any
+// call fails. Writes are blocked during the scan.
+func (km *Memory) Scan(start string, count int, fn func(key string, value []byte) error) error {
+	km.order.RLock()
+	defer km.order.RUnlock()
+
+	var err error
+	st := km.load()
+	st.keys.ascend(start, func(key string) bool {
+		if count <= 0 {
+			return false
+		}
+		count--
+
+		sh := st.shardFor(key)
+		sh.mu.RLock()
+		value := sh.m[key]
+		sh.mu.RUnlock()
+		err = fn(key, value)
+		return err == nil
+	})
+	return err
+}
+
+// own copies the shard map if it's shared with a snapshot. Must be called with 'mu' held.
+func (sh *shard) own() {
+	if !sh.shared {
+		return
+	}
+	o := make(map[string][]byte, len(sh.m))
+	for k, v := range sh.m {
+		o[k] = v
+	}
+	sh.m = o
+	sh.shared = false
+}
+
+// Snapshot returns an immutable view of every shard, captured in constant time.
+func (km *Memory) Snapshot() (Snapshot, error) {
+	return km.shardsView(), nil
+}
+
+func (km *Memory) shardsView() memorySnapshot {
+	view := make(memorySnapshot, 0, numShards)
+	for _, sh := range km.load().shards {
+		sh.mu.Lock()
+		sh.shared = true
+		view = append(view, sh.m)
+		sh.mu.Unlock()
+	}
+	return view
+}
+
+// Restore builds a new state from 'load', off to the side, then swaps the content of 'km'
+// by it at once. Concurrent readers observe either the previous state or the restored one.
+func (km *Memory) Restore(load func(set func(key string, value []byte) error) error) error {
+	st := newMemoryState()
+	if err := load(st.set); err != nil {
+		return err
+	}
+
+	km.order.Lock()
+	defer km.order.Unlock()
+	km.state.Store(st)
+	return nil
+}
+
+// Len returns the number of keys stored.
+func (km *Memory) Len() int {
+	var n int
+	for _, sh := range km.load().shards {
+		sh.mu.RLock()
+		n += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// Close is a no-op, Memory holds no resources.
+func (km *Memory) Close() error {
+	return nil
+}
+
+// memorySnapshot holds immutable shards of a Memory engine.
+type memorySnapshot []map[string][]byte
+
+func (ms memorySnapshot) ForEach(fn func(key string, value []byte) error) error {
+	for _, sh := range ms {
+		for k, v := range sh {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ms memorySnapshot) Release() {}
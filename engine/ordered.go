@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"math/rand"
+)
+
+const (
+	// maximum number of levels of the skip list, enough for 4^maxLevel keys.
+	maxLevel = 16
+
+	// inverse probability of a node being promoted to the next level.
+	levelFactor = 4
+)
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// skipList is an ordered set of keys, not safe for concurrent use.
+type skipList struct {
+	head  *skipNode
+	level int
+	rnd   *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+// path returns the last node before 'key' on each level.
+func (l *skipList) path(key string) [maxLevel]*skipNode {
+	var prev [maxLevel]*skipNode
+	n := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		prev[i] = n
+	}
+	return prev
+}
+
+// insert adds 'key' to the set, which must not contain it yet.
+func (l *skipList) insert(key string) {
+	prev := l.path(key)
+	lvl := 1
+	for lvl < maxLevel && l.rnd.Intn(levelFactor) == 0 {
+		lvl++
+	}
+	for ; l.level < lvl; l.level++ {
+		prev[l.level] = l.head
+	}
+
+	n := &skipNode{key: key, next: make([]*skipNode, lvl)}
+	for i := 0; i < lvl; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].next[i] = n
+	}
+}
+
+// remove removes 'key' from the set, if present.
+func (l *skipList) remove(key string) {
+	prev := l.path(key)
+	n := prev[0].next[0]
+	if n == nil || n.key != key {
+		return
+	}
+	for i := range n.next {
+		prev[i].next[i] = n.next[i]
+	}
+}
+
+// ascend calls 'fn' for each key greater or equal to 'start', in order, until it returns
+// false.
+func (l *skipList) ascend(start string, fn func(key string) bool) {
+	prev := l.path(start)
+	for n := prev[0].next[0]; n != nil; n = n.next[0] {
+		if !fn(n.key) {
+			return
+		}
+	}
+}
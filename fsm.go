@@ -4,13 +4,22 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 	"sync/atomic"
+	"time"
 
+	"beelog-hraft/applog"
+	"beelog-hraft/engine"
+	"beelog-hraft/kvpb"
+	"beelog-hraft/record"
+	"beelog-hraft/snapshot"
+	"beelog-hraft/wire"
+
+	bl "github.com/Lz-Gustavo/beelog"
 	"github.com/Lz-Gustavo/beelog/pb"
 
 	"github.com/golang/protobuf/proto"
@@ -19,67 +28,273 @@ import (
 
 type fsm Store
 
-// Apply applies a Raft log entry to the key-value store.
+// Apply applies a Raft log entry to the key-value store. Commands identifying their client
+// are applied at most once, with retries returning the cached result of the first one.
 func (f *fsm) Apply(l *raft.Log) interface{} {
-	cmd := &pb.Command{}
+	cmd := &kvpb.Command{}
 	err := proto.Unmarshal(l.Data, cmd)
 	if err != nil {
 		return err
 	}
 
-	if f.Logging != NotLog {
-		err = f.LogCommand(l.Index, cmd, f.Logging)
-		if err != nil {
-			panic(fmt.Sprintf("couldnt log command: %v", *cmd))
+	// informs reads served outside the fsm that the command was applied, then publishes its
+	// changes to watches
+	defer atomic.StoreUint64(&f.applied, l.Index)
+	f.watches.begin()
+	defer f.watches.commit(l.Index)
+	defer applyDuration.Since(time.Now())
+
+	if cmd.ClientId != 0 {
+		if res, dup := f.dedup.lookup(cmd.ClientId, cmd.Seq); dup {
+			return strings.Join([]string{cmd.Ip, res}, "-")
 		}
 	}
 
+	// record writes depend on the current state, so they are logged and applied as the SET
+	// of the resulting record, reduced and recovered by beelog as any other SET
+	if cmd.Op == kvpb.Command_SETFIELDS || cmd.Op == kvpb.Command_PUTRECORD {
+		f.asRecordSet(cmd)
+	}
+
+	// conditional commands are evaluated before being logged, see atomic.go
+	var (
+		res string
+		st  *stage
+	)
+	if isConditional(cmd) {
+		st = newStage(f, l.Index)
+		res = st.eval(cmd)
+	}
+
+	// addresses advertised by replicas are kept apart from the key-value state, never logged
+	if f.Logging != NotLog && cmd.Op != kvpb.Command_ADVERTISE {
+		bcmds := []pb.Command{cmd.Beelog()}
+		if st != nil {
+			bcmds = st.logged(cmd)
+		}
+		start := time.Now()
+		for i := range bcmds {
+			if err = f.LogCommand(l.Index, &bcmds[i], f.Logging); err != nil {
+				panic(fmt.Sprintf("couldnt log command: %v", bcmds[i]))
+			}
+		}
+		logCommandDuration.With(f.Logging.String()).Since(start)
+	}
+
 	switch cmd.Op {
 	case pb.Command_SET:
-		return strings.Join([]string{cmd.Ip, f.applySet(cmd.Key, cmd.Value)}, "-")
+		// SETs expiring on a TTL or lease are staged
+		if st != nil {
+			st.commit()
+			break
+		}
+		res = f.applySet(l.Index, cmd.Key, cmd.Value)
 	case pb.Command_GET:
-		return strings.Join([]string{cmd.Ip, f.applyGet(cmd.Key)}, "-")
-	// case pb.Command_DELETE:
-	// 	return strings.Join([]string{cmd.Ip, f.applyDelete(cmd.Key)}, "-")
+		res = f.applyGet(cmd.Key)
+	case pb.Command_DELETE:
+		res = f.applyDelete(l.Index, cmd.Key)
+	case kvpb.Command_SCAN:
+		res = f.applyScan(cmd.Key, cmd.Count)
+	case kvpb.Command_GETFIELDS:
+		res = f.applyGetFields(cmd.Key, cmd.Fields)
+	case kvpb.Command_GETVERSION:
+		res = f.applyGetVersion(cmd.Key)
+	case kvpb.Command_GETAT:
+		res = f.applyGetAt(cmd.Key, cmd.Index, l.Index)
+	case kvpb.Command_CHANGES:
+		res = f.applyChanges(cmd.Key, cmd.Index, cmd.Count, l.Index)
+	case kvpb.Command_CAS, kvpb.Command_INCR, kvpb.Command_DECR, kvpb.Command_SETNX, kvpb.Command_TXN,
+		kvpb.Command_LEASEREVOKE, kvpb.Command_EXPIRE:
+		st.commit()
+	case kvpb.Command_LEASEGRANT:
+		res = f.applyLeaseGrant(l.Index, cmd.TtlMsec)
+	case kvpb.Command_LEASEKEEPALIVE:
+		res = f.applyLeaseKeepAlive(l.Index, cmd.Lease)
+	case kvpb.Command_ADVERTISE:
+		f.peers.set(cmd.Key, cmd.Value)
 	default:
 		panic(fmt.Sprintf("unrecognized command op: %v", cmd))
 	}
+
+	if cmd.ClientId != 0 {
+		if f.dedup == nil {
+			f.dedup = make(dedupTable)
+		}
+		f.dedup.record(cmd.ClientId, cmd.Seq, l.Index, res)
+	}
+	return strings.Join([]string{cmd.Ip, res}, "-")
+}
+
+// ApplyBatch applies raft entries committed together, as raft groups concurrent proposals
+// from every session. Commands are applied one by one, each logged under its own raft index.
+func (f *fsm) ApplyBatch(logs []*raft.Log) []interface{} {
+	res := make([]interface{}, len(logs))
+	for i, l := range logs {
+		// configuration changes are also delivered, but never carry commands
+		if l.Type != raft.LogCommand {
+			continue
+		}
+		res[i] = f.Apply(l)
+	}
+	return res
 }
 
-// Snapshot returns a snapshot of the key-value store.
+// Snapshot returns a snapshot of the key-value store. The state is captured in constant time
+// by the storage engine, iterated on Persist concurrently to later commands.
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	// Clone the map.
-	o := make(map[string][]byte)
-	for k, v := range f.m {
-		o[k] = v
+	snap, err := f.m.Snapshot()
+	if err != nil {
+		return nil, err
 	}
-	return &fsmSnapshot{store: o}, nil
+	changes, floor := f.hist.snapshot()
+	return &fsmSnapshot{
+		store:      snap,
+		dedup:      f.dedup.clone(),
+		changes:    changes,
+		floor:      floor,
+		leases:     f.leases.clone(),
+		peers:      f.peers.clone(),
+		decompress: f.decompress,
+		compress:   *snapCompress,
+		index:      atomic.LoadUint64(&f.applied),
+		onPersist:  (*Store)(f).compactLog,
+	}, nil
 }
 
 // Restore stores the key-value store to a previous state.
 func (f *fsm) Restore(rc io.ReadCloser) error {
-	o := make(map[string][]byte)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
+	var (
+		dedup    = make(dedupTable)
+		changes  []*change
+		floor    uint64
+		leases   = make(map[uint64]*lease)
+		expiring = make(map[string]*keyExpiry)
+		peers    = make(map[string]string)
+	)
+
+	// Set the state from the snapshot, no lock required according to
+	// Hashicorp docs, except for reads served outside the fsm.
+	err := f.m.Restore(func(set func(string, []byte) error) error {
+		// values are followed by their revision, while values not followed by one were
+		// written by older versions as stored, or raw if pre-initialized
+		var (
+			pending      bool
+			pendingKey   string
+			pendingValue []byte
+		)
+		flush := func(rev *revision) error {
+			if !pending {
+				return nil
+			}
+			pending = false
+			if rev != nil {
+				return set(pendingKey, f.storedEntry(*rev, pendingValue))
+			}
+			if len(pendingValue) > 0 && pendingValue[0] == entryMarker {
+				return set(pendingKey, pendingValue)
+			}
+			return set(pendingKey, encodeEntry(revision{version: 1}, pendingValue))
+		}
+
+		err := snapshot.ReadSections(rc, func(sec snapshot.Section, key string, value []byte) error {
+			switch sec {
+			case snapshot.State:
+				if err := flush(nil); err != nil {
+					return err
+				}
+				pending, pendingKey, pendingValue = true, key, value
+
+			case revisionSection:
+				rev, n := decodeRevision(value)
+				if n <= 0 || !pending || key != pendingKey {
+					return fmt.Errorf("malformed revision of key '%s'", key)
+				}
+				return flush(&rev)
+
+			case dedupSection:
+				id, cs, err := decodeSession(key, value)
+				if err != nil {
+					return err
+				}
+				dedup[id] = cs
+
+			case historySection:
+				if key == historyFloorKey {
+					var n int
+					if floor, n = binary.Uvarint(value); n <= 0 {
+						return fmt.Errorf("malformed history floor")
+					}
+					break
+				}
+				c, err := decodeChange(key, value)
+				if err != nil {
+					return err
+				}
+				changes = append(changes, c)
+
+			case leaseSection:
+				id, l, err := decodeLease(key, value)
+				if err != nil {
+					return err
+				}
+				leases[id] = l
+
+			case expirySection:
+				k, ke, err := decodeKeyExpiry(key, value)
+				if err != nil {
+					return err
+				}
+				expiring[k] = ke
+
+			case peerSection:
+				peers[key] = string(value)
+
+			default:
+				return fmt.Errorf("unknown snapshot section %d", sec)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return flush(nil)
+	})
+	if err != nil {
 		return err
 	}
+	f.dedup = dedup
+	f.hist.reset(changes, floor)
+	f.peers.reset(peers)
+	return f.leases.reset(leases, expiring)
+}
 
-	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
-	f.m = o
-	return nil
+// NOTE: There s no need for mutex acquisition between commands since every new command is
+// garantee to be executed in a sequential manner, preserving the replicas coordination. Locks
+// on storage engines only exclude reads served outside the fsm (i.e. Store.ReadIndex) and
+// concurrent snapshots. Storage failures halt the replica, as logging failures do.
+func (f *fsm) applySet(index uint64, key, value string) string {
+	prev, found := f.loadEntry(key)
+	var rev revision
+	if found {
+		rev, _ = f.decode(key, prev)
+	}
+	f.hist.record(&change{index: index, key: key, prev: prev})
+	f.watches.record(wire.Change{Index: index, Version: rev.next(index).version, Key: key, Value: []byte(value)})
+	f.leases.detach(key)
+	f.store(key, f.storedEntry(rev.next(index), []byte(value)))
+	return ""
 }
 
-// NOTE: There s no need for mutex acquisition since every new command is garantee to be
-// executed in a sequential manner, preserving the replicas coordination.
-func (f *fsm) applySet(key, value string) string {
+// storedEntry returns the entry storing 'value' on revision 'rev', compressing it if
+// configured.
+func (f *fsm) storedEntry(rev revision, value []byte) []byte {
 	if !f.compress {
-		f.m[key] = []byte(value)
-		return ""
+		return encodeEntry(rev, value)
 	}
 
 	f.gzipBuffer.Reset()
 	wtr := gzip.NewWriter(&f.gzipBuffer)
-	wtr.Write([]byte(value))
+	wtr.Write(value)
 
 	if err := wtr.Flush(); err != nil {
 		panic(err)
@@ -88,12 +303,29 @@ func (f *fsm) applySet(key, value string) string {
 		panic(err)
 	}
 
-	f.m[key] = f.gzipBuffer.Bytes()
-	return ""
+	// compressed bytes are copied by encodeEntry, since 'gzipBuffer' is reused on the next
+	// command
+	return encodeEntry(rev, f.gzipBuffer.Bytes())
 }
 
-func (f *fsm) applyDelete(key string) string {
-	delete(f.m, key)
+func (f *fsm) store(key string, value []byte) {
+	if err := f.m.Set(key, value); err != nil {
+		panic(fmt.Sprintf("couldnt store key '%s': %s", key, err.Error()))
+	}
+}
+
+func (f *fsm) applyDelete(index uint64, key string) string {
+	prev, found := f.loadEntry(key)
+	if !found {
+		return ""
+	}
+	f.hist.record(&change{index: index, key: key, deleted: true, prev: prev})
+	f.watches.record(wire.Change{Index: index, Key: key, Deleted: true})
+	f.leases.detach(key)
+
+	if err := f.m.Delete(key); err != nil {
+		panic(fmt.Sprintf("couldnt delete key '%s': %s", key, err.Error()))
+	}
 	return ""
 }
 
@@ -101,47 +333,210 @@ func (f *fsm) applyDelete(key string) string {
 // Close() calls from write method will imediately dealloc the f.Reader attribute. This closure
 // is necessary to prevent io.ErrUnexpectedEOF
 func (f *fsm) applyGet(key string) string {
-	value, ok := f.m[key]
+	value, _, _ := f.load(key)
+	return string(value)
+}
+
+// load returns the value of 'key' and its revision.
+func (f *fsm) load(key string) ([]byte, revision, bool) {
+	entry, ok := f.loadEntry(key)
 	if !ok {
+		return nil, revision{}, false
+	}
+	rev, value := f.decode(key, entry)
+	return f.decompress(value), rev, true
+}
+
+// loadEntry returns the entry of 'key' as stored, decoded by decodeEntry.
+func (f *fsm) loadEntry(key string) ([]byte, bool) {
+	entry, ok, err := f.m.Get(key)
+	if err != nil {
+		panic(fmt.Sprintf("couldnt read key '%s': %s", key, err.Error()))
+	}
+	return entry, ok
+}
+
+// decode returns the revision and value of the stored 'entry' of 'key'. Malformed entries
+// can only result from a corrupted storage, halting the replica as failed reads do.
+func (f *fsm) decode(key string, entry []byte) (revision, []byte) {
+	rev, value, err := decodeEntry(entry)
+	if err != nil {
+		panic(fmt.Sprintf("couldnt decode key '%s': %s", key, err.Error()))
+	}
+	return rev, value
+}
+
+// applyScan returns up to 'count' pairs from 'start' in order, encoded by wire.EncodePairs.
+// Counts are bounded by maxScanCount.
+func (f *fsm) applyScan(start string, count uint32) string {
+	if count > maxScanCount {
+		count = maxScanCount
+	}
+	pairs := make([]wire.Pair, 0, count)
+	err := f.m.Scan(start, int(count), func(key string, entry []byte) error {
+		_, value := f.decode(key, entry)
+		pairs = append(pairs, wire.Pair{Key: key, Value: f.decompress(value)})
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("couldnt scan from key '%s': %s", start, err.Error()))
+	}
+	return string(wire.EncodePairs(pairs))
+}
+
+// asRecordSet translates the record write 'cmd' into the SET of the resulting record. Fields
+// set by SETFIELDS are merged into the current record, while PUTRECORD discards it. Values
+// that aren't encoded records are replaced as well.
+func (f *fsm) asRecordSet(cmd *kvpb.Command) {
+	fields := make(map[string][]byte)
+	if cmd.Op == kvpb.Command_SETFIELDS {
+		if cur, err := record.Decode([]byte(f.applyGet(cmd.Key))); err == nil {
+			fields = cur
+		}
+	}
+	for _, fd := range cmd.Fields {
+		fields[fd.Name] = []byte(fd.Value)
+	}
+	cmd.Op = pb.Command_SET
+	cmd.Value = string(record.Encode(fields))
+	cmd.Fields = nil
+}
+
+// applyGetFields returns the fields of the record 'key' named on 'names', or every field if
+// none is named, encoded by record.Encode. Missing records and fields are omitted, as are
+// values that aren't encoded records.
+func (f *fsm) applyGetFields(key string, names []*kvpb.Command_Field) string {
+	fields, err := record.Decode([]byte(f.applyGet(key)))
+	if err != nil {
 		return ""
 	}
-	if !f.compress {
-		return string(f.m[key])
+	sel := make([]string, 0, len(names))
+	for _, fd := range names {
+		sel = append(sel, fd.Name)
 	}
+	return string(record.Encode(record.Select(fields, sel)))
+}
 
-	f.gzipBuffer.Reset()
+// decompress returns the original content of a stored 'value'.
+func (f *fsm) decompress(value []byte) []byte {
+	if !f.compress {
+		return value
+	}
 	rd := bytes.NewReader(value)
 	rdGzip, _ := gzip.NewReader(rd)
 	bytes, _ := ioutil.ReadAll(rdGzip)
 	rdGzip.Close()
-	return string(bytes)
+	return bytes
 }
 
+// Sections of the snapshots written by fsmSnapshot besides the key-value state, so that
+// metadata never collides with keys written by clients.
+const (
+	dedupSection snapshot.Section = iota + 1
+	historySection
+	leaseSection
+	expirySection
+	peerSection
+	revisionSection
+)
+
 type fsmSnapshot struct {
-	store map[string][]byte
+	store   engine.Snapshot
+	dedup   dedupTable
+	changes []*change
+	floor   uint64
+	leases  *leaseTable
+	peers   map[string]string
+
+	// decompress returns the original content of values on 'store', written on snapshots
+	// as clients set them, followed by their revision. 'compress' gzip compresses the
+	// snapshot itself.
+	decompress func([]byte) []byte
+	compress   bool
+
+	// index of the latest command applied on 'store', informed to 'onPersist' once the
+	// snapshot is safely persisted.
+	index     uint64
+	onPersist func(index uint64) error
 }
 
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
-		// Encode data.
-		b, err := json.Marshal(f.store)
+		// Stream data to sink.
+		wr, err := snapshot.NewWriter(sink, f.compress)
 		if err != nil {
 			return err
 		}
-
-		// Write data to sink.
-		if _, err := sink.Write(b); err != nil {
+		err = f.store.ForEach(func(key string, stored []byte) error {
+			rev, value, err := decodeEntry(stored)
+			if err != nil {
+				return fmt.Errorf("couldnt decode key '%s': %s", key, err.Error())
+			}
+			if err := wr.Write(key, f.decompress(value)); err != nil {
+				return err
+			}
+			return wr.WriteSection(revisionSection, key, encodeRevision(rev))
+		})
+		if err != nil {
+			return err
+		}
+		for id, cs := range f.dedup {
+			key, value := encodeSession(id, cs)
+			if err = wr.WriteSection(dedupSection, key, value); err != nil {
+				return err
+			}
+		}
+		for id, l := range f.leases.leases {
+			key, value := encodeLease(id, l)
+			if err = wr.WriteSection(leaseSection, key, value); err != nil {
+				return err
+			}
+		}
+		for k, ke := range f.leases.keys {
+			key, value := encodeKeyExpiry(k, ke)
+			if err = wr.WriteSection(expirySection, key, value); err != nil {
+				return err
+			}
+		}
+		for key, addr := range f.peers {
+			if err = wr.WriteSection(peerSection, key, []byte(addr)); err != nil {
+				return err
+			}
+		}
+		for _, c := range f.changes {
+			key, value := encodeChange(c)
+			if err = wr.WriteSection(historySection, key, value); err != nil {
+				return err
+			}
+		}
+		if f.floor > 0 {
+			var buf [binary.MaxVarintLen64]byte
+			n := binary.PutUvarint(buf[:], f.floor)
+			if err = wr.WriteSection(historySection, historyFloorKey, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err = wr.Close(); err != nil {
 			return err
 		}
 		return sink.Close()
 	}()
 	if err != nil {
 		sink.Cancel()
+		return err
 	}
-	return err
+
+	if f.onPersist != nil {
+		if err := f.onPersist(f.index); err != nil {
+			return fmt.Errorf("failed to compact the application log: %s", err.Error())
+		}
+	}
+	return nil
 }
 
-func (f *fsmSnapshot) Release() {}
+func (f *fsmSnapshot) Release() {
+	f.store.Release()
+}
 
 // LogCommand logs the received command on the choosen index following the configured
 // log strategy.
@@ -151,6 +546,10 @@ func (f *fsm) LogCommand(ind uint64, cmd *pb.Command, st LogStrategy) error {
 		return nil
 
 	case DiskTrad:
+		// appends only exclude compactions, which replace 'LogFile'
+		f.logMu.RLock()
+		defer f.logMu.RUnlock()
+
 		cmd.Id = ind
 		rawCmd, err := proto.Marshal(cmd)
 		if err != nil {
@@ -166,7 +565,7 @@ func (f *fsm) LogCommand(ind uint64, cmd *pb.Command, st LogStrategy) error {
 		if err != nil {
 			return err
 		}
-		atomic.AddUint32(&f.logCount, 1)
+		atomic.StoreUint64(&f.logLen, uint64(atomic.AddUint32(&f.logCount, 1)))
 		break
 
 	case InmemTrad:
@@ -176,16 +575,20 @@ func (f *fsm) LogCommand(ind uint64, cmd *pb.Command, st LogStrategy) error {
 			f.inMemLog = &[]pb.Command{}
 		}
 		*f.inMemLog = append(*f.inMemLog, *cmd)
+		atomic.StoreUint64(&f.logLen, uint64(len(*f.inMemLog)))
 		f.mu.Unlock()
 		atomic.AddUint32(&f.logCount, 1)
 		break
 
 	case BeelogList, BeelogArray, BeelogAVL, BeelogCircBuffer, BeelogConcTable:
 		cmd.Id = ind
-		err := f.st.Log(*cmd)
+		err := f.st.Log(asBeelogCommand(*cmd))
 		if err != nil {
 			return err
 		}
+		// counted on the fsm, since reads of the structure length race with its reduce,
+		// concurrent on some structures
+		atomic.AddUint64(&f.logLen, 1)
 		break
 
 	default:
@@ -193,3 +596,68 @@ func (f *fsm) LogCommand(ind uint64, cmd *pb.Command, st LogStrategy) error {
 	}
 	return nil
 }
+
+// asBeelogCommand translates a command to the representation understood by beelog
+// structures. Reduce algorithms only retain the latest SET on each key, discarding
+// any other operation as a read, so a DELETE is logged as an applog.Tombstone SET.
+func asBeelogCommand(cmd pb.Command) pb.Command {
+	if cmd.Op != pb.Command_DELETE {
+		return cmd
+	}
+	return applog.NewTombstone(cmd.Id, cmd.Key)
+}
+
+// compactDiskLog rewrites the DiskTrad log file discarding commands up to index 'snap',
+// already covered by a persisted snapshot. The new file replaces the old one atomically,
+// so any concurrent reader still interprets a consistent log. Must hold 'logMu'.
+func (f *fsm) compactDiskLog(snap uint64) (err error) {
+	fd, err := os.OpenFile(f.LogFname, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	cmds, err := bl.UnmarshalLogWithLenFromReader(fd, int(atomic.LoadUint32(&f.logCount)))
+	if err != nil {
+		return err
+	}
+	retained := make([]pb.Command, 0, len(cmds))
+	for _, c := range cmds {
+		if c.Id > snap {
+			retained = append(retained, c)
+		}
+	}
+
+	tmp, err := createWriteFile(f.LogFname+".tmp", true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	for _, c := range retained {
+		rawCmd, err := proto.Marshal(&c)
+		if err != nil {
+			return err
+		}
+		if err = binary.Write(tmp, binary.BigEndian, int32(len(rawCmd))); err != nil {
+			return err
+		}
+		if _, err = tmp.Write(rawCmd); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Rename(tmp.Name(), f.LogFname); err != nil {
+		return err
+	}
+	f.LogFile.Close()
+	f.LogFile = tmp
+	atomic.StoreUint32(&f.logCount, uint32(len(retained)))
+	atomic.StoreUint64(&f.logLen, uint64(len(retained)))
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"beelog-hraft/wire"
+)
+
+// historyFloorKey keys the floor of the history written on snapshots, along with the
+// changes retained keyed by their raft index.
+const historyFloorKey = "floor"
+
+// replies of reads on indexes outside the retention window.
+const (
+	errIndexCompacted = "ERR index compacted"
+	errFutureIndex    = "ERR future index"
+)
+
+// change is a write on 'key' applied at raft index 'index'. 'prev' is the entry superseded,
+// as stored by the fsm, or nil if the key was missing.
+type change struct {
+	index   uint64
+	key     string
+	deleted bool
+	prev    []byte
+}
+
+// history retains the changes applied within the latest 'window' raft indexes, so keys can
+// be read as of any index in the window and changes listed from it. It's written on
+// snapshots, so every replica retains the same changes after a Restore and log replay. A
+// zero window retains nothing, serving reads only as of the latest index.
+//
+// Changes are only recorded by the fsm, while reads served outside the fsm (i.e.
+// Store.ReadIndex) hold 'mu'. Each change is recorded before its write on the storage
+// engine, so readers loading a key before the history always find the change superseding
+// the loaded entry, if any.
+type history struct {
+	mu      sync.RWMutex
+	window  uint64
+	floor   uint64    // changes up to 'floor' were discarded
+	changes []*change // in index order
+	byKey   map[string][]*change
+}
+
+// record registers 'c', discarding changes out of the window.
+func (h *history) record(c *change) {
+	if h.window == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.byKey == nil {
+		h.byKey = make(map[string][]*change)
+	}
+	h.changes = append(h.changes, c)
+	h.byKey[c.key] = append(h.byKey[c.key], c)
+	if c.index > h.window {
+		h.prune(c.index - h.window)
+	}
+}
+
+// prune discards changes up to index 'floor'. Must hold 'mu'.
+func (h *history) prune(floor uint64) {
+	if floor <= h.floor {
+		return
+	}
+	i := 0
+	for ; i < len(h.changes) && h.changes[i].index <= floor; i++ {
+		c := h.changes[i]
+		if kc := h.byKey[c.key]; len(kc) > 1 {
+			kc[0] = nil
+			h.byKey[c.key] = kc[1:]
+		} else {
+			delete(h.byKey, c.key)
+		}
+		h.changes[i] = nil
+	}
+	h.changes = h.changes[i:]
+	h.floor = floor
+}
+
+// check returns the error reply of a read as of raft index 'index', or an empty string if
+// it's covered by the window. 'applied' is the latest index applied.
+func (h *history) check(index, applied uint64) string {
+	h.mu.RLock()
+	floor := h.floor
+	h.mu.RUnlock()
+
+	if applied > h.window && applied-h.window > floor {
+		floor = applied - h.window
+	}
+	if index > applied {
+		return errFutureIndex
+	}
+	if index < floor {
+		return errIndexCompacted
+	}
+	return ""
+}
+
+// after returns the first change on 'key' after raft index 'index', or nil if none. Must
+// hold 'mu'.
+func (h *history) after(key string, index uint64) *change {
+	kc := h.byKey[key]
+	i := sort.Search(len(kc), func(i int) bool {
+		return kc[i].index > index
+	})
+	if i == len(kc) {
+		return nil
+	}
+	return kc[i]
+}
+
+// snapshot returns the changes retained and the floor, safe to be read concurrently with
+// further commands since changes are never modified.
+func (h *history) snapshot() ([]*change, uint64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]*change(nil), h.changes...), h.floor
+}
+
+// reset replaces every change retained by 'changes', in any order, discarding those up to
+// 'floor'.
+func (h *history) reset(changes []*change, floor uint64) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].index < changes[j].index
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.changes, h.floor = nil, 0
+	h.byKey = make(map[string][]*change)
+	for _, c := range changes {
+		h.changes = append(h.changes, c)
+		h.byKey[c.key] = append(h.byKey[c.key], c)
+	}
+	h.prune(floor)
+}
+
+// encodeChange returns the snapshot entry of 'c' on 'historySection', keyed by its index. The
+// superseded entry is prefixed by its length plus one, zero meaning a missing key.
+func encodeChange(c *change) (string, []byte) {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64+len(c.key)+len(c.prev))
+	if c.deleted {
+		buf[0] = 1
+	}
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(c.key)))
+	n += copy(buf[n:], c.key)
+	if c.prev != nil {
+		n += binary.PutUvarint(buf[n:], uint64(len(c.prev))+1)
+		n += copy(buf[n:], c.prev)
+	} else {
+		n += binary.PutUvarint(buf[n:], 0)
+	}
+	return strconv.FormatUint(c.index, 10), buf[:n]
+}
+
+// decodeChange parses a snapshot entry encoded by 'encodeChange'.
+func decodeChange(key string, value []byte) (*change, error) {
+	index, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	errMalformed := errors.New("malformed history entry")
+	if len(value) == 0 || value[0] > 1 {
+		return nil, errMalformed
+	}
+	c := &change{index: index, deleted: value[0] == 1}
+
+	size, n := binary.Uvarint(value[1:])
+	if n <= 0 || size > uint64(len(value)-1-n) {
+		return nil, errMalformed
+	}
+	value = value[1+n:]
+	c.key, value = string(value[:size]), value[size:]
+
+	size, n = binary.Uvarint(value)
+	if n <= 0 || size > uint64(len(value)-n)+1 {
+		return nil, errMalformed
+	}
+	if size > 0 {
+		c.prev = append([]byte(nil), value[n:n+int(size-1)]...)
+	}
+	return c, nil
+}
+
+// entryAt returns the entry of 'key' as of raft index 'index', which must be checked by
+// history.check.
+func (f *fsm) entryAt(key string, index uint64) ([]byte, bool) {
+	entry, found := f.loadEntry(key)
+	if found {
+		if rev, _ := f.decode(key, entry); rev.modIndex <= index {
+			return entry, true
+		}
+	}
+
+	f.hist.mu.RLock()
+	defer f.hist.mu.RUnlock()
+	if c := f.hist.after(key, index); c != nil {
+		return c.prev, c.prev != nil
+	}
+	return entry, found
+}
+
+// applyGetVersion returns the latest revision and value of 'key', formatted by
+// formatRevision.
+func (f *fsm) applyGetVersion(key string) string {
+	return f.formatRevision(f.loadEntry(key))
+}
+
+// applyGetAt returns the revision and value of 'key' as of raft index 'index', formatted by
+// formatRevision, where 'applied' is the latest index applied. Fails if 'index' is outside
+// the retention window.
+func (f *fsm) applyGetAt(key string, index, applied uint64) string {
+	if res := f.hist.check(index, applied); res != "" {
+		return res
+	}
+	return f.formatRevision(f.entryAt(key, index))
+}
+
+// formatRevision returns the modification index, version and value of 'entry', separated
+// by spaces. Missing keys are replied on index and version zero.
+func (f *fsm) formatRevision(entry []byte, found bool) string {
+	if !found {
+		return "0 0 "
+	}
+	rev, value, err := decodeEntry(entry)
+	if err != nil {
+		return "ERR " + err.Error()
+	}
+	return fmt.Sprintf("%d %d %s", rev.modIndex, rev.version, f.decompress(value))
+}
+
+// applyChanges returns up to 'count' changes on keys prefixed by 'prefix' applied after
+// raft index 'index', encoded by wire.EncodeChanges, where 'applied' is the latest index
+// applied. Counts are bounded by maxScanCount, which is assumed if zero. Fails if 'index'
+// is outside the retention window.
+func (f *fsm) applyChanges(prefix string, index uint64, count uint32, applied uint64) string {
+	if res := f.hist.check(index, applied); res != "" {
+		return res
+	}
+	if count == 0 || count > maxScanCount {
+		count = maxScanCount
+	}
+
+	f.hist.mu.RLock()
+	defer f.hist.mu.RUnlock()
+	match := func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}
+	return string(wire.EncodeChanges(f.changesAfter(match, index, applied, int(count))))
+}
+
+// retainedChanges returns every change on keys matched by 'match' applied after raft index
+// 'index' up to 'applied', or false if the history doesn't retain them.
+func (f *fsm) retainedChanges(match func(string) bool, index, applied uint64) ([]wire.Change, bool) {
+	if f.hist.window == 0 || f.hist.check(index, applied) != "" {
+		return nil, false
+	}
+	f.hist.mu.RLock()
+	defer f.hist.mu.RUnlock()
+	return f.changesAfter(match, index, applied, 0), true
+}
+
+// changesAfter returns up to 'count' changes on keys matched by 'match' applied after raft
+// index 'index' up to 'applied', or every one if 'count' is zero. Must hold 'hist.mu'.
+func (f *fsm) changesAfter(match func(string) bool, index, applied uint64, count int) []wire.Change {
+	h := &f.hist
+	i := sort.Search(len(h.changes), func(i int) bool {
+		return h.changes[i].index > index
+	})
+	changes := make([]wire.Change, 0)
+	for _, c := range h.changes[i:] {
+		// later changes might not be written on the storage engine yet
+		if c.index > applied || count > 0 && len(changes) == count {
+			break
+		}
+		if !match(c.key) {
+			continue
+		}
+
+		wc := wire.Change{Index: c.index, Key: c.key, Deleted: c.deleted}
+		if !c.deleted {
+			// the resulting entry is superseded by the next change on the key, if any
+			entry, _ := f.loadEntry(c.key)
+			if next := h.after(c.key, c.index); next != nil {
+				entry = next.prev
+			}
+			rev, value := f.decode(c.key, entry)
+			wc.Version, wc.Value = rev.version, f.decompress(value)
+		}
+		changes = append(changes, wc)
+	}
+	return changes
+}
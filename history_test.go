@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"beelog-hraft/kvpb"
+	"beelog-hraft/snapshot"
+	"beelog-hraft/wire"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+)
+
+func TestVersions(t *testing.T) {
+	s := newLoggedStore(t, InmemTrad)
+	steps := []struct {
+		cmd *kvpb.Command
+		exp string
+	}{
+		{&kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar"}, ""},
+		{&kvpb.Command{Op: kvpb.Command_GETVERSION, Key: "foo"}, "1 1 bar"},
+		{&kvpb.Command{Op: kvpb.Command_CAS, Key: "foo", Version: 1, Value: "baz qux"}, "3"},
+		{&kvpb.Command{Op: kvpb.Command_GETVERSION, Key: "foo"}, "3 2 baz qux"},
+		{&kvpb.Command{Op: pb.Command_DELETE, Key: "foo"}, ""},
+		{&kvpb.Command{Op: kvpb.Command_GETVERSION, Key: "foo"}, "0 0 "},
+		{&kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "new"}, ""},
+		{&kvpb.Command{Op: kvpb.Command_GETVERSION, Key: "foo"}, "7 1 new"},
+
+		// no changes are retained with a zero window
+		{&kvpb.Command{Op: kvpb.Command_GETAT, Key: "foo", Index: 9}, "7 1 new"},
+		{&kvpb.Command{Op: kvpb.Command_GETAT, Key: "foo", Index: 3}, errIndexCompacted},
+		{&kvpb.Command{Op: kvpb.Command_GETAT, Key: "foo", Index: 20}, errFutureIndex},
+	}
+	for i, st := range steps {
+		res := applyKvCommand(t, s, uint64(i+1), st.cmd).(string)
+		if res = strings.TrimPrefix(res, "-"); res != st.exp {
+			t.Fatalf("expected reply %q on step %d, got %q", st.exp, i, res)
+		}
+	}
+	if n := len(*s.inMemLog); n != len(steps) {
+		t.Fatalf("expected every command logged, got %d", n)
+	}
+}
+
+func TestDecodeEntry(t *testing.T) {
+	rev := revision{modIndex: 300, version: 2}
+	if got, value, err := decodeEntry(encodeEntry(rev, []byte("v"))); err != nil || got != rev || string(value) != "v" {
+		t.Fatalf("expected revision %v of 'v', got %v of '%s' (err: %v)", rev, got, value, err)
+	}
+	for _, entry := range [][]byte{nil, []byte("raw"), {entryMarker}, {entryMarker, 0x80}, {entryMarker, 1, 0x80}} {
+		if _, _, err := decodeEntry(entry); err != errMalformedEntry {
+			t.Fatalf("expected entry %q to be malformed, got err: %v", entry, err)
+		}
+	}
+
+	// raw values restored from older snapshots are stored on their first version
+	sink := &memSink{}
+	wr, err := snapshot.NewWriter(sink, false)
+	if err != nil {
+		t.Fatalf("failed to create snapshot writer: %s", err.Error())
+	}
+	if err = wr.Write("foo", []byte("bar")); err != nil {
+		t.Fatalf("failed to write snapshot: %s", err.Error())
+	}
+	if err = wr.Close(); err != nil {
+		t.Fatalf("failed to close snapshot: %s", err.Error())
+	}
+	s := newLoggedStore(t, NotLog)
+	if err = (*fsm)(s).Restore(ioutil.NopCloser(sink)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err.Error())
+	}
+	res := applyKvCommand(t, s, 1, &kvpb.Command{Op: kvpb.Command_GETVERSION, Key: "foo"}).(string)
+	if res = strings.TrimPrefix(res, "-"); res != "0 1 bar" {
+		t.Fatalf("expected raw value restored on version 1, got %q", res)
+	}
+}
+
+func TestReadAtIndex(t *testing.T) {
+	s := newLoggedStore(t, NotLog)
+	s.hist.window = 4
+	f := (*fsm)(s)
+
+	applyHistoryCommands(t, s, 1, []*kvpb.Command{
+		{Op: pb.Command_SET, Key: "a", Value: "1"},
+		{Op: pb.Command_SET, Key: "a", Value: "2"},
+		{Op: pb.Command_DELETE, Key: "a"},
+		{Op: pb.Command_SET, Key: "b", Value: "x"},
+		{Op: pb.Command_SET, Key: "a", Value: "3"},
+	})
+	exp := []string{errIndexCompacted, "1 1 1", "2 2 2", "0 0 ", "0 0 ", "5 1 3", errFutureIndex}
+	for ind, e := range exp {
+		if res := f.applyGetAt("a", uint64(ind), 5); res != e {
+			t.Fatalf("expected %q reading 'a' as of index %d, got %q", e, ind, res)
+		}
+	}
+	if res := applyKvCommand(t, s, 6, &kvpb.Command{Op: kvpb.Command_GETAT, Key: "a", Index: 2}); res != "-2 2 2" {
+		t.Fatalf("expected logged read as of index 2, got %q", res)
+	}
+
+	changes, err := wire.DecodeChanges([]byte(f.applyChanges("", 1, 0, 5)))
+	if err != nil {
+		t.Fatalf("failed to decode changes: %s", err.Error())
+	}
+	expChanges := []wire.Change{
+		{Index: 2, Version: 2, Key: "a", Value: []byte("2")},
+		{Index: 3, Key: "a", Value: []byte{}, Deleted: true},
+		{Index: 4, Version: 1, Key: "b", Value: []byte("x")},
+		{Index: 5, Version: 1, Key: "a", Value: []byte("3")},
+	}
+	if !reflect.DeepEqual(expChanges, changes) {
+		t.Fatalf("expected changes %v, got %v", expChanges, changes)
+	}
+	if changes, _ = wire.DecodeChanges([]byte(f.applyChanges("a", 1, 2, 5))); !reflect.DeepEqual(expChanges[:2], changes) {
+		t.Fatalf("expected the first 2 changes on 'a', got %v", changes)
+	}
+	if res := f.applyChanges("", 0, 0, 5); res != errIndexCompacted {
+		t.Fatalf("expected changes out of the window to fail, got %q", res)
+	}
+}
+
+func TestHistoryConsistentAfterRestore(t *testing.T) {
+	s := newLoggedStore(t, NotLog)
+	s.hist.window = 4
+	applyHistoryCommands(t, s, 1, []*kvpb.Command{
+		{Op: pb.Command_SET, Key: "a", Value: "1"},
+		{Op: pb.Command_SET, Key: "a", Value: "2"},
+		{Op: pb.Command_DELETE, Key: "a"},
+		{Op: pb.Command_SET, Key: "b", Value: "x"},
+		{Op: kvpb.Command_INCR, Key: "c"},
+		{Op: pb.Command_SET, Key: "a", Value: "3"},
+	})
+
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %s", err.Error())
+	}
+	sink := &memSink{}
+	if err = snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err.Error())
+	}
+	r := newLoggedStore(t, NotLog)
+	r.hist.window = 4
+	if err = (*fsm)(r).Restore(ioutil.NopCloser(sink)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err.Error())
+	}
+	if r.m.Len() != 3 {
+		t.Fatalf("history entries restored as keys, got %d keys", r.m.Len())
+	}
+	compareHistory(t, s, r, 6)
+
+	// entries following the snapshot are replayed on both
+	next := []*kvpb.Command{
+		{Op: pb.Command_SET, Key: "a", Value: "4"},
+		{Op: pb.Command_DELETE, Key: "b"},
+		{Op: kvpb.Command_TXN, Txn: []*kvpb.Command{
+			{Op: kvpb.Command_INCR, Key: "c"},
+			{Op: pb.Command_SET, Key: "d", Value: "y"},
+		}},
+	}
+	applyHistoryCommands(t, s, 7, next)
+	applyHistoryCommands(t, r, 7, next)
+	compareHistory(t, s, r, 9)
+
+	if res := (*fsm)(r).applyGetAt("a", 4, 9); res != errIndexCompacted {
+		t.Fatalf("expected changes out of the window discarded, got %q", res)
+	}
+	if res := (*fsm)(r).applyGetVersion("c"); res != "9 2 2" {
+		t.Fatalf("expected 'c' on its second version, got %q", res)
+	}
+}
+
+func applyHistoryCommands(t *testing.T, s *Store, first uint64, cmds []*kvpb.Command) {
+	for i, cmd := range cmds {
+		applyKvCommand(t, s, first+uint64(i), cmd)
+	}
+}
+
+// compareHistory checks that 's' and 'r' reply the same reads as of every index up to
+// 'applied', and the same changes from each one.
+func compareHistory(t *testing.T, s, r *Store, applied uint64) {
+	for ind := uint64(0); ind <= applied+1; ind++ {
+		for _, key := range []string{"a", "b", "c", "d"} {
+			exp, got := (*fsm)(s).applyGetAt(key, ind, applied), (*fsm)(r).applyGetAt(key, ind, applied)
+			if exp != got {
+				t.Fatalf("expected %q reading '%s' as of index %d, got %q", exp, key, ind, got)
+			}
+		}
+		exp, got := (*fsm)(s).applyChanges("", ind, 0, applied), (*fsm)(r).applyChanges("", ind, 0, applied)
+		if exp != got {
+			t.Fatalf("expected changes %q from index %d, got %q", exp, ind, got)
+		}
+	}
+}
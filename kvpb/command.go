@@ -0,0 +1,218 @@
+// Package kvpb defines beelog-hraft protobuf messages. Since the 'pb' package is
+// owned by beelog, messages are declared here by hand following command.proto,
+// relying on struct tags for serialization. Keep both files in sync.
+package kvpb
+
+import (
+	"github.com/Lz-Gustavo/beelog/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Command_ReadMode indexes the different approaches for serving GET requests.
+type Command_ReadMode int32
+
+const (
+	// Command_LOG reads are proposed as commands, following total order on the raft log.
+	Command_LOG Command_ReadMode = 0
+
+	// Command_INDEX reads are served from the leader's state once it confirms leadership
+	// and applies every entry known at request time, without appending to the raft log.
+	Command_INDEX Command_ReadMode = 1
+)
+
+// Operations extending pb.Command_Operation, numbered from 16 like extension fields.
+const (
+	// Command_SCAN reads up to 'Count' keys greater or equal to 'Key', in increasing
+	// order. Logged by beelog as a GET.
+	Command_SCAN pb.Command_Operation = 16
+
+	// Command_SETFIELDS sets 'Fields' on the record 'Key', keeping any other field and
+	// creating the record if missing.
+	Command_SETFIELDS pb.Command_Operation = 17
+
+	// Command_PUTRECORD replaces the record 'Key' by 'Fields'.
+	Command_PUTRECORD pb.Command_Operation = 18
+
+	// Command_GETFIELDS reads the fields of the record 'Key' named on 'Fields', ignoring
+	// their values, or every field if none is named. Logged by beelog as a GET.
+	Command_GETFIELDS pb.Command_Operation = 19
+
+	// Command_CAS sets 'Value' on 'Key' if its modification index, the raft index of its
+	// latest write, equals 'Version' or, if zero, if its value equals 'Expected'. Missing
+	// keys never match.
+	Command_CAS pb.Command_Operation = 20
+
+	// Command_INCR and Command_DECR add or subtract 'Delta' (1 if zero) from the integer
+	// value of 'Key', a missing key counting as zero.
+	Command_INCR pb.Command_Operation = 21
+	Command_DECR pb.Command_Operation = 22
+
+	// Command_SETNX sets 'Value' on 'Key' only if it's missing.
+	Command_SETNX pb.Command_Operation = 23
+
+	// Command_TXN applies the SET, DELETE, CAS, INCR, DECR and SETNX commands on 'Txn' in
+	// order, either all of them or none if any condition fails.
+	Command_TXN pb.Command_Operation = 24
+
+	// Command_GETVERSION reads the value of 'Key' along with its modification index and
+	// version, the number of writes since it was created. Logged by beelog as a GET.
+	Command_GETVERSION pb.Command_Operation = 25
+
+	// Command_GETAT reads 'Key' as GETVERSION does, but as of raft index 'Index', bounded
+	// by the retention window of replicas. Logged by beelog as a GET.
+	Command_GETAT pb.Command_Operation = 26
+
+	// Command_CHANGES reads up to 'Count' changes on keys prefixed by 'Key' applied after
+	// raft index 'Index', bounded by the retention window of replicas. Logged by beelog
+	// as a GET.
+	Command_CHANGES pb.Command_Operation = 27
+
+	// Command_WATCH subscribes the client session to the changes on 'Key', or on every key
+	// prefixed by it if 'Prefix' is set. Changes logged after 'Index', if informed, are
+	// replied first. Never logged.
+	Command_WATCH pb.Command_Operation = 28
+
+	// Command_LEASEGRANT grants a lease expiring after 'TtlMsec', replying its ID. Keys
+	// written by a SET informing the ID on 'Lease' are deleted once the lease expires or
+	// is revoked. Logged by beelog as a GET.
+	Command_LEASEGRANT pb.Command_Operation = 29
+
+	// Command_LEASEREVOKE deletes the lease 'Lease' and every key attached to it.
+	Command_LEASEREVOKE pb.Command_Operation = 30
+
+	// Command_LEASEKEEPALIVE restarts the TTL of the lease 'Lease'. Logged by beelog as
+	// a GET.
+	Command_LEASEKEEPALIVE pb.Command_Operation = 31
+
+	// Command_EXPIRE is proposed by the leader once the TTL of 'Key', or of the lease
+	// 'Lease', elapses, deleting it only if it wasn't written, or refreshed, since raft
+	// index 'Index'. Logged as the deletes it applies.
+	Command_EXPIRE pb.Command_Operation = 32
+
+	// Command_ADVERTISE registers 'Value' as the address of a replica named by 'Key', kept
+	// apart from the key-value state. Proposed by leaders on their own behalf, rejected
+	// from clients and never logged.
+	Command_ADVERTISE pb.Command_Operation = 33
+)
+
+// Command_ReplyMode indexes the different channels for replying commands to clients.
+type Command_ReplyMode int32
+
+const (
+	// Command_UDP replies are sent to the UDP port informed on 'Ip', at the client address.
+	Command_UDP Command_ReplyMode = 0
+
+	// Command_SESSION replies are written back on the TCP session the command was received,
+	// identified by 'ReqId'.
+	Command_SESSION Command_ReplyMode = 1
+)
+
+// Command extends pb.Command with beelog-hraft specific attributes, sharing its field
+// numbers.
+type Command struct {
+	Id    uint64               `protobuf:"varint,1,opt,name=Id,proto3" json:"Id,omitempty"`
+	Ip    string               `protobuf:"bytes,2,opt,name=Ip,proto3" json:"Ip,omitempty"`
+	Op    pb.Command_Operation `protobuf:"varint,3,opt,name=Op,proto3,enum=pb.Command_Operation" json:"Op,omitempty"`
+	Key   string               `protobuf:"bytes,4,opt,name=Key,proto3" json:"Key,omitempty"`
+	Value string               `protobuf:"bytes,5,opt,name=Value,proto3" json:"Value,omitempty"`
+
+	Read  Command_ReadMode  `protobuf:"varint,16,opt,name=Read,proto3,enum=kvpb.Command_ReadMode" json:"Read,omitempty"`
+	ReqId uint64            `protobuf:"varint,17,opt,name=ReqId,proto3" json:"ReqId,omitempty"`
+	Reply Command_ReplyMode `protobuf:"varint,18,opt,name=Reply,proto3,enum=kvpb.Command_ReplyMode" json:"Reply,omitempty"`
+
+	// Redirect is set by clients talking to a single replica, requesting followers to reply
+	// with the leader's address instead of ignoring the command.
+	Redirect bool `protobuf:"varint,19,opt,name=Redirect,proto3" json:"Redirect,omitempty"`
+
+	// ClientId and Seq identify each command from a client, so retries are applied at most
+	// once. Commands with no ClientId are not deduplicated.
+	ClientId uint64 `protobuf:"varint,20,opt,name=ClientId,proto3" json:"ClientId,omitempty"`
+	Seq      uint64 `protobuf:"varint,21,opt,name=Seq,proto3" json:"Seq,omitempty"`
+
+	// Count is the maximum number of pairs replied to a SCAN, or changes to a CHANGES.
+	Count uint32 `protobuf:"varint,22,opt,name=Count,proto3" json:"Count,omitempty"`
+
+	// Fields of a record, written or read by record operations.
+	Fields []*Command_Field `protobuf:"bytes,23,rep,name=Fields,proto3" json:"Fields,omitempty"`
+
+	// Expected value or Version compared by a CAS, and Delta of an INCR or DECR.
+	Expected string `protobuf:"bytes,24,opt,name=Expected,proto3" json:"Expected,omitempty"`
+	Version  uint64 `protobuf:"varint,25,opt,name=Version,proto3" json:"Version,omitempty"`
+	Delta    int64  `protobuf:"varint,26,opt,name=Delta,proto3" json:"Delta,omitempty"`
+
+	// Txn holds the commands of a TXN, applied atomically.
+	Txn []*Command `protobuf:"bytes,27,rep,name=Txn,proto3" json:"Txn,omitempty"`
+
+	// Index is the raft index read by GETAT, or listed from by CHANGES and WATCH.
+	Index uint64 `protobuf:"varint,28,opt,name=Index,proto3" json:"Index,omitempty"`
+
+	// Prefix subscribes a WATCH to every key prefixed by 'Key'.
+	Prefix bool `protobuf:"varint,29,opt,name=Prefix,proto3" json:"Prefix,omitempty"`
+
+	// TtlMsec is the TTL of a key written by a SET, or of a lease granted by LEASEGRANT, in
+	// milliseconds. Lease is the lease a SET attaches its key to, or the lease handled by
+	// other lease commands. A SET informs at most one of them.
+	TtlMsec uint64 `protobuf:"varint,30,opt,name=TtlMsec,proto3" json:"TtlMsec,omitempty"`
+	Lease   uint64 `protobuf:"varint,31,opt,name=Lease,proto3" json:"Lease,omitempty"`
+}
+
+// Command_Field is a named field of a record.
+type Command_Field struct {
+	Name  string `protobuf:"bytes,1,opt,name=Name,proto3" json:"Name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=Value,proto3" json:"Value,omitempty"`
+}
+
+// Reset ...
+func (m *Command_Field) Reset() { *m = Command_Field{} }
+
+// String ...
+func (m *Command_Field) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage ...
+func (*Command_Field) ProtoMessage() {}
+
+// Reset ...
+func (m *Command) Reset() { *m = Command{} }
+
+// String ...
+func (m *Command) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage ...
+func (*Command) ProtoMessage() {}
+
+// Beelog returns the pb.Command representation of 'm', discarding any extension. Extended
+// reads, lease grants and keepalives are translated to GET. Record writes, conditional
+// commands, lease revokes and expiries must be translated to their effect before, since it
+// depends on the current state.
+func (m *Command) Beelog() pb.Command {
+	op := m.Op
+	switch op {
+	case Command_SCAN, Command_GETFIELDS, Command_GETVERSION, Command_GETAT, Command_CHANGES,
+		Command_WATCH, Command_LEASEGRANT, Command_LEASEKEEPALIVE, Command_ADVERTISE:
+		op = pb.Command_GET
+	}
+	return pb.Command{
+		Id:    m.Id,
+		Ip:    m.Ip,
+		Op:    op,
+		Key:   m.Key,
+		Value: m.Value,
+	}
+}
+
+// Header decodes only the reply attributes of a serialized Command, so commands failing to
+// unmarshal (e.g. with invalid UTF-8 on a string field) are still replied to their session.
+type Header struct {
+	ReqId uint64            `protobuf:"varint,17,opt,name=ReqId,proto3" json:"ReqId,omitempty"`
+	Reply Command_ReplyMode `protobuf:"varint,18,opt,name=Reply,proto3,enum=kvpb.Command_ReplyMode" json:"Reply,omitempty"`
+}
+
+// Reset ...
+func (m *Header) Reset() { *m = Header{} }
+
+// String ...
+func (m *Header) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage ...
+func (*Header) ProtoMessage() {}
@@ -0,0 +1,140 @@
+package kvpb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestCommandIsBeelogCompatible(t *testing.T) {
+	cmd := &Command{
+		Id:    10,
+		Ip:    "15000",
+		Op:    pb.Command_GET,
+		Key:   "foo",
+		Value: "bar",
+		Read:  Command_INDEX,
+		ReqId: 42,
+		Reply: Command_SESSION,
+	}
+	raw, err := proto.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err.Error())
+	}
+
+	base := &pb.Command{}
+	if err = proto.Unmarshal(raw, base); err != nil {
+		t.Fatalf("failed to unmarshal as pb.Command: %s", err.Error())
+	}
+	exp := cmd.Beelog()
+	if base.Id != exp.Id || base.Ip != exp.Ip || base.Op != exp.Op || base.Key != exp.Key || base.Value != exp.Value {
+		t.Fatalf("expected %v, got %v", exp, *base)
+	}
+
+	// extensions are preserved as unknown fields, surviving pb.Command round trips
+	raw, err = proto.Marshal(base)
+	if err != nil {
+		t.Fatalf("failed to marshal pb.Command: %s", err.Error())
+	}
+	ext := &Command{}
+	if err = proto.Unmarshal(raw, ext); err != nil {
+		t.Fatalf("failed to unmarshal as kvpb.Command: %s", err.Error())
+	}
+	if ext.Read != Command_INDEX || ext.ReqId != 42 || ext.Reply != Command_SESSION {
+		t.Fatalf("expected extensions to be preserved, got %v", ext)
+	}
+}
+
+func TestScanIsLoggedAsGet(t *testing.T) {
+	cmd := &Command{Op: Command_SCAN, Key: "foo", Count: 10}
+	raw, err := proto.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err.Error())
+	}
+	ext := &Command{}
+	if err = proto.Unmarshal(raw, ext); err != nil || ext.Op != Command_SCAN || ext.Count != 10 {
+		t.Fatalf("expected SCAN of 10 keys, got %v (err: %v)", ext, err)
+	}
+	if bcmd := cmd.Beelog(); bcmd.Op != pb.Command_GET || bcmd.Key != "foo" {
+		t.Fatalf("expected SCAN to be logged as a GET on foo, got %v", bcmd)
+	}
+}
+
+func TestRecordFieldsRoundTrip(t *testing.T) {
+	cmd := &Command{
+		Op:  Command_SETFIELDS,
+		Key: "user1",
+		Fields: []*Command_Field{
+			{Name: "field0", Value: "foo"},
+			{Name: "field1", Value: ""},
+		},
+	}
+	raw, err := proto.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err.Error())
+	}
+	ext := &Command{}
+	if err = proto.Unmarshal(raw, ext); err != nil {
+		t.Fatalf("failed to unmarshal command: %s", err.Error())
+	}
+	if !proto.Equal(cmd, ext) {
+		t.Fatalf("expected %v, got %v", cmd, ext)
+	}
+}
+
+func TestVersionedReadsAreLoggedAsGet(t *testing.T) {
+	for _, op := range []pb.Command_Operation{Command_GETVERSION, Command_GETAT, Command_CHANGES} {
+		cmd := &Command{Op: op, Key: "foo", Index: 300}
+		raw, err := proto.Marshal(cmd)
+		if err != nil {
+			t.Fatalf("failed to marshal command: %s", err.Error())
+		}
+		ext := &Command{}
+		if err = proto.Unmarshal(raw, ext); err != nil || ext.Op != op || ext.Index != 300 {
+			t.Fatalf("expected op %d on index 300, got %v (err: %v)", op, ext, err)
+		}
+		if bcmd := cmd.Beelog(); bcmd.Op != pb.Command_GET || bcmd.Key != "foo" {
+			t.Fatalf("expected op %d to be logged as a GET on foo, got %v", op, bcmd)
+		}
+	}
+}
+
+func TestLeaseCommandsRoundTrip(t *testing.T) {
+	cmd := &Command{Op: pb.Command_SET, Key: "foo", Value: "bar", TtlMsec: 1500, Lease: 7}
+	raw, err := proto.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err.Error())
+	}
+	ext := &Command{}
+	if err = proto.Unmarshal(raw, ext); err != nil || ext.TtlMsec != 1500 || ext.Lease != 7 {
+		t.Fatalf("expected a TTL of 1500ms and lease 7, got %v (err: %v)", ext, err)
+	}
+
+	for _, op := range []pb.Command_Operation{Command_LEASEGRANT, Command_LEASEKEEPALIVE} {
+		if bcmd := (&Command{Op: op, Lease: 7}).Beelog(); bcmd.Op != pb.Command_GET {
+			t.Fatalf("expected op %d to be logged as a GET, got %v", op, bcmd)
+		}
+	}
+}
+
+func TestHeaderOfInvalidCommand(t *testing.T) {
+	raw, err := proto.Marshal(&Command{Op: pb.Command_SET, Key: "\x01\x02", ReqId: 42, Reply: Command_SESSION})
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err.Error())
+	}
+	raw = bytes.Replace(raw, []byte("\x01\x02"), []byte{0xFF, 0xFE}, 1)
+
+	if err = proto.Unmarshal(raw, &Command{}); err == nil {
+		t.Fatal("expected commands with invalid UTF-8 keys to fail to unmarshal")
+	}
+	hdr := &Header{}
+	if err = proto.Unmarshal(raw, hdr); err != nil {
+		t.Fatalf("failed to unmarshal header: %s", err.Error())
+	}
+	if hdr.ReqId != 42 || hdr.Reply != Command_SESSION {
+		t.Fatalf("expected reply attributes to be decoded, got %v", hdr)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"beelog-hraft/kvpb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+)
+
+// Keys written by a SET informing a TTL, or attached to a lease, expire deterministically:
+// replicas only record their TTLs, and the leader proposes an EXPIRE once each one elapses
+// on its clock, informing the raft index of the write, or latest refresh, being expired.
+// Replicas apply it only if the key, or lease, wasn't written or refreshed since, so applied
+// state never depends on clocks. Each replica schedules the deadline of a TTL once it applies
+// its write, or refresh, so keys may outlive their TTL but are never expired earlier. Expiries
+// are staged and logged as the deletes they apply, as are revokes (see atomic.go).
+const (
+	// expiryCheckInterval is how often the leader checks for elapsed TTLs.
+	expiryCheckInterval = 100 * time.Millisecond
+
+	// replies of lease commands, besides the ID of granted leases
+	errLeaseNotFound = "ERR lease not found"
+	errInvalidTTL    = "ERR invalid ttl"
+	errTTLAndLease   = "ERR ttl and lease are exclusive"
+)
+
+// lease expires after 'ttl' milliseconds unless refreshed, deleting every key attached to it.
+type lease struct {
+	ttl       uint64
+	refreshed uint64 // raft index of the grant or latest keepalive
+	keys      map[string]struct{}
+	deadline  *deadline
+}
+
+// keyExpiry records how a key expires, either after its own 'ttl' since written at raft
+// index 'index', or along with 'lease'. Only keys expiring on their own TTL are scheduled
+// on 'deadline'.
+type keyExpiry struct {
+	ttl      uint64
+	lease    uint64
+	index    uint64
+	deadline *deadline
+}
+
+// expiry identifies the write of a key, or the refresh of a lease, expired by an EXPIRE.
+type expiry struct {
+	key   string
+	lease uint64
+	index uint64
+}
+
+// deadline schedules expiry 'e' at 'at', 'ttl' after the replica applied it.
+type deadline struct {
+	e   expiry
+	ttl time.Duration
+	at  time.Time
+	pos int // index on 'deadlineHeap'
+}
+
+// deadlineHeap orders deadlines by time, implementing heap.Interface.
+type deadlineHeap []*deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+
+func (h *deadlineHeap) Push(x interface{}) {
+	d := x.(*deadline)
+	d.pos = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return d
+}
+
+// leaseTable holds the granted leases and the keys expiring on each replica. Since it's only
+// modified by applied commands, every replica holds the same table, besides the deadlines
+// scheduled on 'deadlines'. The zero value is an empty table.
+type leaseTable struct {
+	// excludes the leader's expiry checks, the only access outside the fsm
+	mu        sync.RWMutex
+	leases    map[uint64]*lease
+	keys      map[string]*keyExpiry
+	deadlines deadlineHeap
+}
+
+// schedule adds the deadline of 'e', expiring 'ttl' milliseconds from now. Must hold 'mu'.
+func (t *leaseTable) schedule(e expiry, ttl uint64) *deadline {
+	d := &deadline{e: e, ttl: time.Duration(ttl) * time.Millisecond}
+	d.at = time.Now().Add(d.ttl)
+	heap.Push(&t.deadlines, d)
+	return d
+}
+
+// unschedule discards deadline 'd', if any. Must hold 'mu'.
+func (t *leaseTable) unschedule(d *deadline) {
+	if d != nil {
+		heap.Remove(&t.deadlines, d.pos)
+	}
+}
+
+// grant registers lease 'id' expiring after 'ttl'.
+func (t *leaseTable) grant(id, ttl uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.leases == nil {
+		t.leases = make(map[uint64]*lease)
+	}
+	l := &lease{ttl: ttl, refreshed: id, keys: make(map[string]struct{})}
+	l.deadline = t.schedule(expiry{lease: id, index: id}, ttl)
+	t.leases[id] = l
+}
+
+// keepAlive refreshes lease 'id' at raft index 'index', returning false if it's not granted.
+func (t *leaseTable) keepAlive(id, index uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.leases[id]
+	if ok {
+		l.refreshed = index
+		l.deadline.e.index = index
+		l.deadline.at = time.Now().Add(l.deadline.ttl)
+		heap.Fix(&t.deadlines, l.deadline.pos)
+	}
+	return ok
+}
+
+func (t *leaseTable) granted(id uint64) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.leases[id]
+	return ok
+}
+
+// attached returns the keys attached to lease 'id', in order.
+func (t *leaseTable) attached(id uint64) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	l, ok := t.leases[id]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// revoke discards lease 'id'. Keys attached to it must be deleted before.
+func (t *leaseTable) revoke(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.leases[id]; ok {
+		t.unschedule(l.deadline)
+		delete(t.leases, id)
+	}
+}
+
+// attach registers 'key', written at raft index 'index', to expire after 'ttl' or along
+// with lease 'id', ignored if both are zero. The lease must be granted.
+func (t *leaseTable) attach(key string, index, ttl, id uint64) {
+	if ttl == 0 && id == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.keys == nil {
+		t.keys = make(map[string]*keyExpiry)
+	}
+	ke := &keyExpiry{ttl: ttl, lease: id, index: index}
+	if id != 0 {
+		t.leases[id].keys[key] = struct{}{}
+	} else {
+		ke.deadline = t.schedule(expiry{key: key, index: index}, ttl)
+	}
+	t.keys[key] = ke
+}
+
+// detach discards the TTL or lease of 'key'. Must be called on every write, since keys only
+// keep the TTL informed by their latest write.
+func (t *leaseTable) detach(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.keys[key]
+	if !ok {
+		return
+	}
+	delete(t.keys, key)
+	t.unschedule(e.deadline)
+	if l, ok := t.leases[e.lease]; ok {
+		delete(l.keys, key)
+	}
+}
+
+// current reports whether 'e' still identifies the latest write of its key, or the latest
+// refresh of its lease.
+func (t *leaseTable) current(e expiry) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if e.lease != 0 {
+		l, ok := t.leases[e.lease]
+		return ok && l.refreshed == e.index
+	}
+	ke, ok := t.keys[e.key]
+	return ok && ke.lease == 0 && ke.index == e.index
+}
+
+// expiries returns every key, and lease, scheduled to expire on its own TTL.
+func (t *leaseTable) expiries() map[expiry]time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	exp := make(map[expiry]time.Duration, len(t.deadlines))
+	for _, d := range t.deadlines {
+		exp[d.e] = d.ttl
+	}
+	return exp
+}
+
+// due returns every expiry whose deadline elapsed by 'now', postponing each one by 'retry'
+// while its EXPIRE is pending.
+func (t *leaseTable) due(now time.Time, retry time.Duration) []expiry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var exp []expiry
+	for len(t.deadlines) > 0 && !now.Before(t.deadlines[0].at) {
+		d := t.deadlines[0]
+		exp = append(exp, d.e)
+		d.at = now.Add(retry)
+		heap.Fix(&t.deadlines, 0)
+	}
+	return exp
+}
+
+// retry reschedules 'e' at 'at' once its EXPIRE failed to be applied, unless a later write,
+// or refresh, already replaced its deadline.
+func (t *leaseTable) retry(e expiry, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var d *deadline
+	if e.lease != 0 {
+		if l, ok := t.leases[e.lease]; ok {
+			d = l.deadline
+		}
+	} else if ke, ok := t.keys[e.key]; ok {
+		d = ke.deadline
+	}
+	if d == nil || d.e != e {
+		return
+	}
+	d.at = at
+	heap.Fix(&t.deadlines, d.pos)
+}
+
+// clone returns a copy of the table, safe to be read concurrently with further commands.
+// Keys attached to each lease are omitted, restored from 'keys'.
+func (t *leaseTable) clone() *leaseTable {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	o := &leaseTable{
+		leases: make(map[uint64]*lease, len(t.leases)),
+		keys:   make(map[string]*keyExpiry, len(t.keys)),
+	}
+	for id, l := range t.leases {
+		o.leases[id] = &lease{ttl: l.ttl, refreshed: l.refreshed}
+	}
+	for key, ke := range t.keys {
+		o.keys[key] = &keyExpiry{ttl: ke.ttl, lease: ke.lease, index: ke.index}
+	}
+	return o
+}
+
+// reset replaces the table by 'leases' and 'keys', restored from a snapshot, rescheduling
+// every deadline from now.
+func (t *leaseTable) reset(leases map[uint64]*lease, keys map[string]*keyExpiry) error {
+	for key, ke := range keys {
+		if ke.lease == 0 {
+			continue
+		}
+		l, ok := leases[ke.lease]
+		if !ok {
+			return fmt.Errorf("key '%s' attached to missing lease %d", key, ke.lease)
+		}
+		if l.keys == nil {
+			l.keys = make(map[string]struct{})
+		}
+		l.keys[key] = struct{}{}
+	}
+	for _, l := range leases {
+		if l.keys == nil {
+			l.keys = make(map[string]struct{})
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.leases, t.keys, t.deadlines = leases, keys, nil
+	for id, l := range leases {
+		l.deadline = t.schedule(expiry{lease: id, index: l.refreshed}, l.ttl)
+	}
+	for key, ke := range keys {
+		if ke.lease == 0 {
+			ke.deadline = t.schedule(expiry{key: key, index: ke.index}, ke.ttl)
+		}
+	}
+	return nil
+}
+
+// encodeLease returns the snapshot entry of lease 'id' on 'leaseSection', keyed by its ID.
+func encodeLease(id uint64, l *lease) (string, []byte) {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, l.ttl)
+	n += binary.PutUvarint(buf[n:], l.refreshed)
+	return strconv.FormatUint(id, 10), buf[:n]
+}
+
+// decodeLease parses a snapshot entry encoded by 'encodeLease'.
+func decodeLease(key string, value []byte) (uint64, *lease, error) {
+	id, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	ttl, n := binary.Uvarint(value)
+	if n <= 0 {
+		return 0, nil, errors.New("malformed lease entry")
+	}
+	refreshed, m := binary.Uvarint(value[n:])
+	if m <= 0 {
+		return 0, nil, errors.New("malformed lease entry")
+	}
+	return id, &lease{ttl: ttl, refreshed: refreshed}, nil
+}
+
+// encodeKeyExpiry returns the snapshot entry of the expiry of 'key' on 'expirySection',
+// keyed by 'key' itself.
+func encodeKeyExpiry(key string, ke *keyExpiry) (string, []byte) {
+	buf := make([]byte, 3*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, ke.ttl)
+	n += binary.PutUvarint(buf[n:], ke.lease)
+	n += binary.PutUvarint(buf[n:], ke.index)
+	return key, buf[:n]
+}
+
+// decodeKeyExpiry parses a snapshot entry encoded by 'encodeKeyExpiry'.
+func decodeKeyExpiry(key string, value []byte) (string, *keyExpiry, error) {
+	var (
+		fields [3]uint64
+		n      int
+	)
+	for i := range fields {
+		v, m := binary.Uvarint(value[n:])
+		if m <= 0 {
+			return "", nil, errors.New("malformed expiry entry")
+		}
+		fields[i], n = v, n+m
+	}
+	ke := &keyExpiry{ttl: fields[0], lease: fields[1], index: fields[2]}
+	return key, ke, nil
+}
+
+// applyLeaseGrant grants a lease expiring after 'ttl', identified by its raft index 'index'.
+func (f *fsm) applyLeaseGrant(index, ttl uint64) string {
+	if ttl == 0 {
+		return errInvalidTTL
+	}
+	f.leases.grant(index, ttl)
+	return strconv.FormatUint(index, 10)
+}
+
+func (f *fsm) applyLeaseKeepAlive(index, id uint64) string {
+	if !f.leases.keepAlive(id, index) {
+		return errLeaseNotFound
+	}
+	return ""
+}
+
+// checkExpiring validates the TTL or lease informed by the SET 'cmd', replying why it fails.
+func (s *stage) checkExpiring(cmd *kvpb.Command) (string, bool) {
+	if cmd.TtlMsec != 0 && cmd.Lease != 0 {
+		return errTTLAndLease, false
+	}
+	if cmd.Lease != 0 && !s.f.leases.granted(cmd.Lease) {
+		return errLeaseNotFound, false
+	}
+	return "", true
+}
+
+// evalExpiry stages the deletes of a LEASEREVOKE or EXPIRE command. Expiries of keys, or
+// leases, written or refreshed since the expired index are discarded.
+func (s *stage) evalExpiry(cmd *kvpb.Command) (string, bool) {
+	t := &s.f.leases
+	switch {
+	case cmd.Op == kvpb.Command_EXPIRE && !t.current(expiry{key: cmd.Key, lease: cmd.Lease, index: cmd.Index}):
+		return condFailed, false
+
+	case cmd.Op == kvpb.Command_EXPIRE && cmd.Lease == 0:
+		s.put(cmd.Key, &stagedWrite{deleted: true})
+		return "", true
+
+	case !t.granted(cmd.Lease):
+		return errLeaseNotFound, false
+	}
+
+	for _, key := range t.attached(cmd.Lease) {
+		s.put(key, &stagedWrite{deleted: true})
+	}
+	s.revoked = cmd.Lease
+	return "", true
+}
+
+// expireOnLeadership proposes an EXPIRE for every key, and lease, whose deadline elapsed
+// while the store is the leader, until raft is shut down. Expiries whose EXPIRE fails to be
+// applied are retried on the next check, and stale ones are discarded by replicas.
+func (s *Store) expireOnLeadership() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		state := s.raft.State()
+		if state == raft.Shutdown {
+			return
+		}
+		if state != raft.Leader {
+			continue
+		}
+
+		// every expiry is proposed before waiting, letting raft append them together
+		due := s.leases.due(time.Now(), raftTimeout)
+		futures := make([]raft.ApplyFuture, len(due))
+		for i, e := range due {
+			f, err := s.proposeExpiry(e)
+			if err != nil {
+				s.logger.Error(fmt.Sprintf("failed to propose expiry: %s", err.Error()))
+				continue
+			}
+			futures[i] = f
+		}
+
+		for i, f := range futures {
+			if f == nil {
+				continue
+			}
+			if err := f.Error(); err != nil {
+				s.logger.Error(fmt.Sprintf("failed to apply expiry: %s", err.Error()))
+				s.leases.retry(due[i], time.Now())
+			}
+		}
+	}
+}
+
+// proposeExpiry appends the EXPIRE of 'e' to the raft log, returning its future.
+func (s *Store) proposeExpiry(e expiry) (raft.ApplyFuture, error) {
+	cmd := &kvpb.Command{
+		Op:    kvpb.Command_EXPIRE,
+		Key:   e.key,
+		Lease: e.lease,
+		Index: e.index,
+	}
+	raw, err := proto.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return s.raft.Apply(raw, raftTimeout), nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"beelog-hraft/kvpb"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+)
+
+func TestLeaseCommands(t *testing.T) {
+	for _, ls := range []LogStrategy{DiskTrad, BeelogList, BeelogAVL} {
+		s := newLoggedStore(t, ls)
+		var ind uint64
+		apply := func(cmd *kvpb.Command) string {
+			ind++
+			return strings.TrimPrefix(applyKvCommand(t, s, ind, cmd).(string), "-")
+		}
+
+		steps := []struct {
+			cmd *kvpb.Command
+			exp string
+		}{
+			{&kvpb.Command{Op: pb.Command_SET, Key: "a", Value: "1", TtlMsec: 1000}, ""},
+			{&kvpb.Command{Op: pb.Command_SET, Key: "b", Value: "2", Lease: 99}, errLeaseNotFound},
+			{&kvpb.Command{Op: kvpb.Command_LEASEGRANT}, errInvalidTTL},
+			{&kvpb.Command{Op: kvpb.Command_LEASEGRANT, TtlMsec: 500}, "4"},
+			{&kvpb.Command{Op: pb.Command_SET, Key: "b", Value: "2", Lease: 4}, ""},
+			{&kvpb.Command{Op: pb.Command_SET, Key: "c", Value: "3", Lease: 4}, ""},
+			{&kvpb.Command{Op: pb.Command_SET, Key: "d", Value: "4", Lease: 4, TtlMsec: 10}, errTTLAndLease},
+			{&kvpb.Command{Op: kvpb.Command_LEASEKEEPALIVE, Lease: 4}, ""},
+
+			// stale expiries, not informing the latest refresh of the lease or write of 'a'
+			{&kvpb.Command{Op: kvpb.Command_EXPIRE, Lease: 4, Index: 4}, condFailed},
+			{&kvpb.Command{Op: kvpb.Command_EXPIRE, Key: "a", Index: 2}, condFailed},
+
+			// 'c' is written again with no lease, so it's not deleted along with the lease
+			{&kvpb.Command{Op: pb.Command_SET, Key: "c", Value: "5"}, ""},
+			{&kvpb.Command{Op: kvpb.Command_EXPIRE, Key: "a", Index: 1}, ""},
+			{&kvpb.Command{Op: kvpb.Command_EXPIRE, Lease: 4, Index: 8}, ""},
+			{&kvpb.Command{Op: kvpb.Command_LEASEKEEPALIVE, Lease: 4}, errLeaseNotFound},
+			{&kvpb.Command{Op: kvpb.Command_LEASEREVOKE, Lease: 4}, errLeaseNotFound},
+
+			// revokes delete every key attached, leases inside transactions are rejected
+			{&kvpb.Command{Op: kvpb.Command_LEASEGRANT, TtlMsec: 500}, "16"},
+			{&kvpb.Command{Op: kvpb.Command_TXN, Txn: []*kvpb.Command{
+				{Op: pb.Command_SET, Key: "e", Value: "6", Lease: 16},
+				{Op: pb.Command_SET, Key: "f", Value: "7", Lease: 16},
+			}}, "17"},
+			{&kvpb.Command{Op: kvpb.Command_TXN, Txn: []*kvpb.Command{
+				{Op: kvpb.Command_LEASEREVOKE, Lease: 16},
+			}}, condFailed},
+			{&kvpb.Command{Op: pb.Command_SET, Key: "g", Value: "8", TtlMsec: 1000}, ""},
+			{&kvpb.Command{Op: kvpb.Command_LEASEREVOKE, Lease: 16}, ""},
+		}
+		for i, st := range steps {
+			if res := apply(st.cmd); res != st.exp {
+				t.Fatalf("%s: expected reply %q on step %d, got %q", ls, st.exp, i, res)
+			}
+		}
+
+		exp := map[string]string{"c": "5", "g": "8"}
+		for _, key := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			_, ok, _ := s.m.Get(key)
+			if value, want := exp[key]; ok != want || ok && s.testGet(key) != value {
+				t.Fatalf("%s: expected '%s' on key '%s', got '%s'", ls, value, key, s.testGet(key))
+			}
+		}
+		expiries := map[expiry]time.Duration{{key: "g", index: 19}: time.Second}
+		if got := s.leases.expiries(); !reflect.DeepEqual(expiries, got) {
+			t.Fatalf("%s: expected expiries %v, got %v", ls, expiries, got)
+		}
+
+		// expiries and revokes are logged as deletes, recovering the same state
+		if state := recoverStateFromLog(t, s, 1, ind); !reflect.DeepEqual(exp, state) {
+			t.Fatalf("%s: expected recovered state %v, got %v", ls, exp, state)
+		}
+	}
+}
+
+func TestLeasesConsistentAfterRestore(t *testing.T) {
+	s := newLoggedStore(t, NotLog)
+	cmds := []*kvpb.Command{
+		{Op: kvpb.Command_LEASEGRANT, TtlMsec: 500},
+		{Op: pb.Command_SET, Key: "a", Value: "1", Lease: 1},
+		{Op: pb.Command_SET, Key: "b", Value: "2", Lease: 1},
+		{Op: pb.Command_SET, Key: "c", Value: "3", TtlMsec: 200},
+		{Op: kvpb.Command_LEASEGRANT, TtlMsec: 300},
+		{Op: kvpb.Command_LEASEKEEPALIVE, Lease: 1},
+
+		// keys never collide with the lease table written on snapshots
+		{Op: pb.Command_SET, Key: "\x00lease/1", Value: "4"},
+	}
+	for i, cmd := range cmds {
+		applyKvCommand(t, s, uint64(i+1), cmd)
+	}
+
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %s", err.Error())
+	}
+	sink := &memSink{}
+	if err = snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err.Error())
+	}
+	r := newLoggedStore(t, NotLog)
+	if err = (*fsm)(r).Restore(ioutil.NopCloser(sink)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err.Error())
+	}
+	if r.m.Len() != 4 || r.testGet("\x00lease/1") != "4" {
+		t.Fatalf("lease entries restored as keys, got %d keys", r.m.Len())
+	}
+
+	exp := map[expiry]time.Duration{
+		{lease: 1, index: 6}: 500 * time.Millisecond,
+		{lease: 5, index: 5}: 300 * time.Millisecond,
+		{key: "c", index: 4}: 200 * time.Millisecond,
+	}
+	if got := r.leases.expiries(); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected expiries %v, got %v", exp, got)
+	}
+	if keys := r.leases.attached(1); !reflect.DeepEqual([]string{"a", "b"}, keys) {
+		t.Fatalf("expected 'a' and 'b' attached to lease 1, got %v", keys)
+	}
+
+	// expiries following the snapshot are applied the same on both
+	for _, st := range []*Store{s, r} {
+		applyKvCommand(t, st, 8, &kvpb.Command{Op: kvpb.Command_EXPIRE, Lease: 1, Index: 6})
+		if _, ok, _ := st.m.Get("a"); ok || st.m.Len() != 2 {
+			t.Fatalf("expected keys attached to the lease deleted, got %d keys", st.m.Len())
+		}
+	}
+}
+
+func TestLeaseDeadlines(t *testing.T) {
+	var tbl leaseTable
+	tbl.grant(1, 500)
+	tbl.attach("a", 2, 0, 1)
+	tbl.attach("b", 3, 200, 0)
+	tbl.attach("c", 4, 100, 0)
+	tbl.detach("c")
+
+	now := time.Now()
+	if exp := tbl.due(now, time.Second); len(exp) != 0 {
+		t.Fatalf("expected no expiry before any TTL elapses, got %v", exp)
+	}
+	exp := []expiry{{key: "b", index: 3}}
+	if got := tbl.due(now.Add(300*time.Millisecond), time.Second); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected expiries %v, got %v", exp, got)
+	}
+
+	// keepalives reschedule the lease, and due expiries are retried once postponed
+	tbl.keepAlive(1, 5)
+	exp = []expiry{{lease: 1, index: 5}}
+	if got := tbl.due(now.Add(time.Second), time.Second); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected expiries %v, got %v", exp, got)
+	}
+	tbl.revoke(1)
+	exp = []expiry{{key: "b", index: 3}}
+	if got := tbl.due(now.Add(3*time.Second), time.Second); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected expiries %v, got %v", exp, got)
+	}
+
+	// failed expiries are retried sooner, unless rewritten or revoked since
+	tbl.retry(expiry{key: "b", index: 3}, now.Add(3*time.Second))
+	tbl.retry(expiry{key: "b", index: 2}, now)
+	tbl.retry(expiry{lease: 1, index: 5}, now)
+	if got := tbl.due(now.Add(3*time.Second), time.Second); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected expiries %v, got %v", exp, got)
+	}
+}
+
+func TestExpiryProposedByLeader(t *testing.T) {
+	prev := cfg
+	defer func() { cfg = prev }()
+	cfg = defaultConfig()
+	cfg.LogStrategy, cfg.PreInitialize = "InmemTrad", false
+	if err := cfg.validate(""); err != nil {
+		t.Fatalf("failed to validate config: %s", err.Error())
+	}
+
+	s := startClusterNode(t, "node0", freeAddr(t), "", true)
+	defer stopClusterNode(s)
+	waitLeader(t, s)
+
+	propose := func(cmd *kvpb.Command) string {
+		cmd.Reply = kvpb.Command_SESSION
+		rep, ok := proposeOnSession(t, s, cmd)
+		if !ok || !strings.HasPrefix(rep, "OK: ") {
+			t.Fatalf("failed to apply %v, got reply: %q", cmd, rep)
+		}
+		return strings.TrimPrefix(rep, "OK: ")
+	}
+	id, err := strconv.ParseUint(propose(&kvpb.Command{Op: kvpb.Command_LEASEGRANT, TtlMsec: 600}), 10, 64)
+	if err != nil {
+		t.Fatalf("expected the ID of the granted lease: %s", err.Error())
+	}
+	propose(&kvpb.Command{Op: pb.Command_SET, Key: "member/1", Value: "up", Lease: id})
+	propose(&kvpb.Command{Op: pb.Command_SET, Key: "ephemeral", Value: "x", TtlMsec: 300})
+	propose(&kvpb.Command{Op: pb.Command_SET, Key: "durable", Value: "y"})
+
+	// expiries are reserved to the leader
+	exp := &kvpb.Command{Op: kvpb.Command_EXPIRE, Key: "durable", Reply: kvpb.Command_SESSION}
+	if rep, _ := proposeOnSession(t, s, exp); rep != "OK: "+errInternalCommand {
+		t.Fatalf("expected expiries from clients rejected, got: %q", rep)
+	}
+
+	// the lease is kept alive past its TTL, while the key expiring on its own TTL is deleted
+	for i := 0; i < 6; i++ {
+		time.Sleep(200 * time.Millisecond)
+		propose(&kvpb.Command{Op: kvpb.Command_LEASEKEEPALIVE, Lease: id})
+	}
+	if v := s.testGet("member/1"); v != "up" {
+		t.Fatalf("expected key attached to a lease kept alive, got '%s'", v)
+	}
+	if _, ok, _ := s.m.Get("ephemeral"); ok {
+		t.Fatal("expected key expired once its TTL elapsed")
+	}
+
+	time.Sleep(time.Second)
+	if _, ok, _ := s.m.Get("member/1"); ok {
+		t.Fatal("expected key deleted once its lease expired")
+	}
+	if v := s.testGet("durable"); v != "y" {
+		t.Fatalf("expected key with no TTL kept, got '%s'", v)
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
-	"sync/atomic"
+	"time"
 
 	"github.com/Lz-Gustavo/beelog/pb"
 
@@ -20,6 +20,7 @@ type fsm Logger
 
 // Apply proposes a new value to the consensus cluster
 func (s *fsm) Apply(l *raft.Log) interface{} {
+	defer applyDuration.Since(time.Now())
 
 	command := &pb.Command{}
 	err := proto.Unmarshal(l.Data, command)
@@ -30,10 +31,7 @@ func (s *fsm) Apply(l *raft.Log) interface{} {
 	serializedCmd, _ := proto.Marshal(command)
 	binary.Write(s.LogFile, binary.BigEndian, int32(len(serializedCmd)))
 	_, err = s.LogFile.Write(serializedCmd)
-
-	if monitoringThroughtput {
-		atomic.AddUint64(&s.req, 1)
-	}
+	commandsTotal.Inc()
 	return err
 }
 
@@ -11,9 +11,11 @@ import (
 	"os"
 	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 
+	"beelog-hraft/metrics"
+	"beelog-hraft/raftstore"
+
 	"github.com/hashicorp/raft"
 )
 
@@ -22,9 +24,6 @@ const (
 	// all nodes presented in the consensus cluster are down. Always set to false in any
 	// other cases, because this strong assumption greatly degradates performance.
 	catastrophicFaults = false
-
-	// Each second writes current throughput to stdout.
-	monitoringThroughtput = true
 )
 
 // Custom configuration over default for testing
@@ -40,14 +39,11 @@ func configRaft() *raft.Config {
 // Logger struct represents the Logger process state. Member of the Raft cluster as a
 // non-Voter participant and thus, just recording proposed commands to the FSM
 type Logger struct {
-	log     *log.Logger
-	raft    *raft.Raft
-	LogFile *os.File
-	req     uint64
-	cancel  context.CancelFunc
-
-	t          *time.Timer
-	throughput *os.File
+	log      *log.Logger
+	raft     *raft.Raft
+	logStore raft.LogStore
+	LogFile  *os.File
+	cancel   context.CancelFunc
 }
 
 // NewLogger constructs a new Logger struct and its dependencies
@@ -56,7 +52,6 @@ func NewLogger(id string) *Logger {
 	ctx, c := context.WithCancel(context.Background())
 	l := &Logger{
 		log:    log.New(os.Stderr, "[logger] ", log.LstdFlags),
-		req:    0,
 		cancel: c,
 	}
 
@@ -66,12 +61,6 @@ func NewLogger(id string) *Logger {
 
 	logFileName := *logfolder + "log-file-" + id + ".log"
 	l.LogFile = createFile(logFileName)
-
-	if monitoringThroughtput {
-		l.t = time.NewTimer(time.Second)
-		l.throughput = createFile(id + "-throughput.out")
-		go l.monitor(ctx)
-	}
 	return l
 }
 
@@ -93,12 +82,14 @@ func (lgr *Logger) StartRaft(localID, raftAddr string) error {
 		return err
 	}
 
-	// Using just in-memory storage (could use boltDB in the key-value application)
-	logStore := raft.NewInmemStore()
-	stableStore := raft.NewInmemStore()
+	// Using in-memory storage by default, or a durable one if '-raftstore' is set to 'file'
+	dir := "checkpoints/" + localID
+	logStore, stableStore, err := newRaftStores(dir)
+	if err != nil {
+		return err
+	}
 
 	// Create a fake snapshot store
-	dir := "checkpoints/" + localID
 	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
 	if err != nil {
 		return fmt.Errorf("file snapshot store: %s", err)
@@ -110,20 +101,25 @@ func (lgr *Logger) StartRaft(localID, raftAddr string) error {
 		return fmt.Errorf("new raft: %s", err)
 	}
 	lgr.raft = ra
+	lgr.logStore = logStore
 	return nil
 }
 
-func (lgr *Logger) monitor(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
+// newRaftStores returns the raft log and stable stores configured by '-raftstore'.
+func newRaftStores(dir string) (raft.LogStore, raft.StableStore, error) {
+	switch *raftStore {
+	case "inmem":
+		return raft.NewInmemStore(), raft.NewInmemStore(), nil
 
-		case <-lgr.t.C:
-			cont := atomic.SwapUint64(&lgr.req, 0)
-			lgr.throughput.WriteString(fmt.Sprintf("%v\n", cont))
-			lgr.t.Reset(time.Second)
+	case "file":
+		fs, err := raftstore.NewFileStore(dir+"/raftlog", !catastrophicFaults)
+		if err != nil {
+			return nil, nil, fmt.Errorf("file raft store: %s", err)
 		}
+		return fs, fs, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknow raft store '%s' provided", *raftStore)
 	}
 }
 
@@ -180,7 +176,10 @@ func (lgr *Logger) ListenStateTransfer(ctx context.Context, addr string) {
 			data[1] = strings.TrimSuffix(data[1], "\n")
 			requestedLogIndex, _ := strconv.Atoi(data[1])
 
-			err = lgr.UnsafeStateRecover(uint64(requestedLogIndex), conn)
+			start, cc := time.Now(), &metrics.CountConn{Conn: conn}
+			err = lgr.UnsafeStateRecover(uint64(requestedLogIndex), cc)
+			recovBytes.Add(cc.Written())
+			recovDuration.Since(start)
 			if err != nil {
 				log.Fatalf("failed to transfer log to node located at %s: %s", data[0], err.Error())
 			}
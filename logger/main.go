@@ -4,20 +4,28 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"time"
+
+	"beelog-hraft/membership"
 )
 
+// membershipTimeout bounds the time waiting for join and leave requests to be answered.
+const membershipTimeout = 20 * time.Second
+
 var (
 	numApps          int
 	logIDs           []string
 	raftAddrs        []string
 	joinAddrs        []string
 	recovHandlerAddr string
+	metricsAddr      string
 	logfolder        *string
+	raftStore        *string
 )
 
 func init() {
@@ -29,6 +37,10 @@ func init() {
 }
 
 func main() {
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
+
 	loggerInstances := make([]*Logger, numApps)
 	for i := 0; i < numApps; i++ {
 		go func(j int) {
@@ -47,26 +59,33 @@ func main() {
 	signal.Notify(terminate, os.Interrupt)
 	<-terminate
 
-	for _, l := range loggerInstances {
+	for j, l := range loggerInstances {
+		if l == nil {
+			continue
+		}
+
+		// detaches from the cluster before shutting down, so the leader no longer replicates
+		// entries to it
+		if err := sendLeaveRequest(logIDs[j], raftAddrs[j], joinAddrs[j]); err != nil {
+			log.Printf("failed to leave the cluster through node at %s: %s", joinAddrs[j], err.Error())
+		}
 		l.cancel()
+		l.raft.Shutdown().Error()
+		if c, ok := l.logStore.(io.Closer); ok {
+			c.Close()
+		}
 		l.LogFile.Close()
 	}
 }
 
 func sendJoinRequest(logID, raftAddr, joinAddr string) error {
-	joinConn, err := net.Dial("tcp", joinAddr)
-	if err != nil {
-		return err
-	}
-	_, err = fmt.Fprint(joinConn, logID+"-"+raftAddr+"-"+"false"+"\n")
-	if err != nil {
-		return err
-	}
-	err = joinConn.Close()
-	if err != nil {
-		return err
-	}
-	return nil
+	req := &membership.Request{Op: membership.Join, ID: logID, Addr: raftAddr}
+	return membership.Send(joinAddr, req, membershipTimeout)
+}
+
+func sendLeaveRequest(logID, raftAddr, joinAddr string) error {
+	req := &membership.Request{Op: membership.Leave, ID: logID, Addr: raftAddr}
+	return membership.Send(joinAddr, req, membershipTimeout)
 }
 
 func countDiffStrInSlice(elements []string) int {
@@ -88,6 +107,8 @@ func parseIPsFromArgsConfig() error {
 	flag.StringVar(&raft, "raft", ":12000", "Set RAFT consensus bind address")
 	flag.StringVar(&joins, "join", ":13000", "Set join address to an already configured raft node")
 	flag.StringVar(&recovHandlerAddr, "hrecov", "", "Set port id to receive state transfer requests from the application log")
+	flag.StringVar(&metricsAddr, "metrics", "", "Serve metrics in the Prometheus text format at specified address, disabled if empty")
+	raftStore = flag.String("raftstore", "inmem", "Set the raft log and stable storage, 'inmem' or a durable 'file' store")
 	flag.Parse()
 
 	if logs == "" {
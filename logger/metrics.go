@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"beelog-hraft/metrics"
+)
+
+// Logger metrics, shared by every logger instance of the process and exported on the
+// "-metrics" address. Throughput is computed from 'commandsTotal' by the scraper.
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	commandsTotal = metricsRegistry.NewCounter("beelog_logger_commands_total",
+		"Commands logged.")
+
+	applyDuration = metricsRegistry.NewHistogram("beelog_logger_apply_duration_seconds",
+		"Time logging a committed command on the log file.", metrics.LatencyBuckets)
+
+	recovBytes = metricsRegistry.NewCounter("beelog_logger_recovery_transfer_bytes_total",
+		"Bytes transferred to recovering replicas.")
+
+	recovDuration = metricsRegistry.NewHistogram("beelog_logger_recovery_transfer_duration_seconds",
+		"Time serving a state transfer to a recovering replica.", metrics.ExponentialBuckets(0.001, 2, 18))
+)
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsRegistry)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("failed to serve metrics at %s: %s", addr, err.Error())
+	}
+}
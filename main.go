@@ -10,6 +10,9 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"time"
+
+	"beelog-hraft/membership"
 )
 
 var (
@@ -22,6 +25,15 @@ var (
 	cpuprofile       *string
 	memprofile       *string
 	logfolder        *string
+	raftStore        *string
+	snapInterval     *time.Duration
+	snapThreshold    *uint64
+	snapCompress     *bool
+	maxInflight      *int
+	maxSessions      *int
+	idleTimeout      *time.Duration
+	adminAddr        *string
+	configFile       *string
 )
 
 func init() {
@@ -29,6 +41,16 @@ func init() {
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to a file")
 	memprofile = flag.String("memprofile", "", "write memory profile to a file")
 	logfolder = flag.String("logfolder", "", "log received commands to a file at specified destination folder")
+	raftStore = flag.String("raftstore", "inmem", "set the raft log and stable storage, 'inmem' or a durable 'file' store")
+	snapInterval = flag.Duration("snapinterval", 24*time.Hour, "set the interval between checks for a raft snapshot")
+	snapThreshold = flag.Uint64("snapthreshold", 2<<62, "set the number of raft log entries that trigger a snapshot")
+	snapCompress = flag.Bool("snapcompress", false, "gzip compress snapshots persisted by raft")
+	maxInflight = flag.Int("maxinflight", 4096, "set the maximum number of proposals in flight, client reads are paused once reached")
+	maxSessions = flag.Int("maxsessions", 4096, "set the maximum number of client sessions, 0 for no limit")
+	idleTimeout = flag.Duration("idletimeout", 5*time.Minute, "disconnect clients not sending requests for this long, 0 for no timeout")
+	adminAddr = flag.String("admin", "", "serve the admin HTTP endpoint at specified address, disabled if empty")
+	configFile = flag.String("config", "", "load store settings from a toml file, overridden by flags explicitly set")
+	cfg.registerFlags(flag.CommandLine)
 }
 
 func main() {
@@ -49,6 +71,7 @@ func main() {
 
 	// Initialize the Key-value store
 	kvs := NewStore(ctx, true)
+	kvs.ClientAddr = svrPort
 	listener, err := net.Listen("tcp", svrPort)
 	if err != nil {
 		log.Fatalf("failed to start connection: %s", err.Error())
@@ -61,6 +84,11 @@ func main() {
 
 	// Initialize the server
 	server := NewServer(ctx, kvs)
+	if *adminAddr != "" {
+		if err = server.ServeAdmin(*adminAddr); err != nil {
+			log.Fatalf("failed to start admin endpoint: %s", err.Error())
+		}
+	}
 
 	// Send a join request, if any
 	if joinAddr != "" {
@@ -94,25 +122,20 @@ func main() {
 			log.Fatal("could not write memory profile: ", err)
 		}
 	}
-	cancel()
+	// drains in-flight requests before cancelling the server goroutines
 	server.Exit()
+	cancel()
 }
 
 func sendJoinRequest() error {
-	joinConn, err := net.Dial("tcp", joinAddr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to leader node at %s: %s", joinAddr, err.Error())
+	req := &membership.Request{
+		Op:         membership.Join,
+		ID:         svrID,
+		Addr:       raftAddr,
+		Voter:      true,
+		ClientAddr: svrPort,
 	}
-
-	_, err = fmt.Fprint(joinConn, svrID+"-"+raftAddr+"-"+"true"+"\n")
-	if err != nil {
-		return fmt.Errorf("failed to send join request to node at %s: %s", joinAddr, err.Error())
-	}
-
-	if err = joinConn.Close(); err != nil {
-		return err
-	}
-	return nil
+	return membership.Send(joinAddr, req, 2*raftTimeout)
 }
 
 func parseIPsFromArgsConfig() {
@@ -129,6 +152,9 @@ func parseAndDebugConfig() {
 	if svrID == "" {
 		log.Fatalln("Must set a server ID, run with: ./server -id 'svrID'")
 	}
+	if err := cfg.load(flag.CommandLine, *configFile, *logfolder); err != nil {
+		log.Fatalln("invalid config:", err.Error())
+	}
 
 	fmt.Println(
 		"=========================",
@@ -139,6 +165,8 @@ func parseAndDebugConfig() {
 		"\njoin:  ", joinAddr,
 		"\nhjoin: ", joinHandlerAddr,
 		"\nhrecov:", recovHandlerAddr,
+		"\nrstore:", *raftStore,
+		"\nlog:   ", cfg.logStrategy,
 		"\n=========================",
 	)
 }
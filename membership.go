@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"beelog-hraft/membership"
+
+	"github.com/hashicorp/raft"
+)
+
+// ListenRaftJoins handles membership requests to the raft cluster (e.g. joins, leaves and
+// promotions), following the 'membership' protocol. Its initialized when "-hjoin" flag is
+// specified, and requests received by followers are forwarded to the leader, as long as
+// the leader is also listening.
+func (s *Store) ListenRaftJoins(ctx context.Context, addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("failed to bind membership handler at %s: %s", addr, err.Error()))
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Error(fmt.Sprintf("membership handler stopped accepting: %s", err.Error()))
+			}
+			return
+		}
+		go s.handleMembership(conn)
+	}
+}
+
+// handleMembership answers the membership request received on 'conn'. Failures are only
+// replied to the requester, never halting the replica.
+func (s *Store) handleMembership(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * raftTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	req, err := membership.Parse(line)
+	if err == nil {
+		err = s.ChangeMembership(req)
+	}
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("membership request %q failed: %s", line, err.Error()))
+	}
+	fmt.Fprint(conn, membership.FormatReply(err)+"\n")
+}
+
+// ChangeMembership applies 'req' on the leader, or forwards it to the leader if called on
+// a follower. Returned errors are always of type *membership.Error.
+func (s *Store) ChangeMembership(req *membership.Request) error {
+	if s.raft.State() != raft.Leader {
+		if req.Forwarded {
+			return membership.Errorf(membership.NotLeader, "forwarded to a follower, leader is at '%s'", s.raft.Leader())
+		}
+		addr := s.leaderMemberAddr()
+		if addr == "" {
+			return membership.Errorf(membership.Unavailable, "leader or its membership address unknown")
+		}
+
+		fwd := *req
+		fwd.Forwarded = true
+		return membership.Send(addr, &fwd, 2*raftTimeout)
+	}
+
+	var err error
+	switch req.Op {
+	case membership.Join:
+		err = s.JoinRaft(req.ID, req.Addr, req.Voter)
+		if err == nil && req.ClientAddr != "" {
+			err = s.registerPeer(req.Addr, advertiseAddr(req.ClientAddr, req.Addr))
+		}
+
+	case membership.Leave:
+		err = s.RemoveRaft(req.ID, req.Addr)
+
+	case membership.Remove:
+		err = s.RemoveRaft(req.ID, "")
+
+	case membership.Promote:
+		err = s.PromoteRaft(req.ID)
+
+	case membership.Demote:
+		err = s.DemoteRaft(req.ID)
+
+	default:
+		err = membership.Errorf(membership.BadRequest, "unknown operation %q", req.Op)
+	}
+	return membershipError(err)
+}
+
+// membershipError classifies 'err' as a *membership.Error, if it isn't already.
+func membershipError(err error) error {
+	switch err.(type) {
+	case nil, *membership.Error:
+		return err
+	}
+
+	switch err {
+	case raft.ErrNotLeader, raft.ErrLeadershipLost, raft.ErrLeadershipTransferInProgress:
+		return membership.Errorf(membership.Unavailable, "%s", err.Error())
+	default:
+		return membership.Errorf(membership.Internal, "%s", err.Error())
+	}
+}
+
+// findServer returns the server with ID 'nodeID' on the latest raft configuration.
+func (s *Store) findServer(nodeID string) (raft.Server, error) {
+	configFuture := s.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return raft.Server{}, err
+	}
+	for _, rep := range configFuture.Configuration().Servers {
+		if rep.ID == raft.ServerID(nodeID) {
+			return rep, nil
+		}
+	}
+	return raft.Server{}, membership.Errorf(membership.NotFound, "node %s is not a member of the cluster", nodeID)
+}
+
+// RemoveRaft removes node 'nodeID' from the cluster. If 'addr' is informed, the node is only
+// removed if it's still bound at 'addr', so a leaving node never removes its replacement.
+func (s *Store) RemoveRaft(nodeID, addr string) error {
+	rep, err := s.findServer(nodeID)
+	if err != nil {
+		return err
+	}
+	if addr != "" && rep.Address != raft.ServerAddress(addr) {
+		return membership.Errorf(membership.NotFound, "node %s is bound at %s, not %s", nodeID, rep.Address, addr)
+	}
+
+	if err = s.raft.RemoveServer(rep.ID, 0, 0).Error(); err != nil {
+		return err
+	}
+	s.logger.Debug(fmt.Sprintf("node %s at %s removed successfully", nodeID, rep.Address))
+	return nil
+}
+
+// PromoteRaft turns the non-voter 'nodeID' into a voter, ignored if it's already a voter.
+func (s *Store) PromoteRaft(nodeID string) error {
+	rep, err := s.findServer(nodeID)
+	if err != nil {
+		return err
+	}
+	if rep.Suffrage == raft.Voter {
+		return nil
+	}
+	return s.raft.AddVoter(rep.ID, rep.Address, 0, 0).Error()
+}
+
+// DemoteRaft turns the voter 'nodeID' into a non-voter, ignored if it's already a non-voter.
+func (s *Store) DemoteRaft(nodeID string) error {
+	rep, err := s.findServer(nodeID)
+	if err != nil {
+		return err
+	}
+	if rep.Suffrage != raft.Voter {
+		return nil
+	}
+	return s.raft.DemoteVoter(rep.ID, 0, 0).Error()
+}
@@ -0,0 +1,248 @@
+// Package membership implements the protocol for changing the raft cluster configuration,
+// shared by beelog-hraft replicas, loggers and tools. Each request is a single text line:
+//
+//	JOIN <id> <raftAddr> <voter|nonvoter> [clientAddr]
+//	LEAVE <id> <raftAddr>
+//	REMOVE <id>
+//	PROMOTE <id>
+//	DEMOTE <id>
+//
+// answered by either "OK" or "ERR <code> <message>". Requests may be sent to any replica,
+// being forwarded to the current leader. Legacy join requests, formatted as
+// "id-raftAddr-voter[-clientAddr]", are still accepted.
+package membership
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Op identifies a membership change.
+type Op string
+
+const (
+	// Join adds a voter or non-voter to the cluster, replacing any server with the same ID
+	// or address.
+	Join Op = "JOIN"
+
+	// Leave removes the requesting server, only if both its ID and address match.
+	Leave Op = "LEAVE"
+
+	// Remove removes any server with the informed ID.
+	Remove Op = "REMOVE"
+
+	// Promote turns a non-voter into a voter.
+	Promote Op = "PROMOTE"
+
+	// Demote turns a voter into a non-voter.
+	Demote Op = "DEMOTE"
+)
+
+// forwardedPrefix marks requests forwarded by a follower, never forwarded again.
+const forwardedPrefix = "FWD "
+
+// Request is a membership change requested to the cluster.
+type Request struct {
+	Op Op
+	ID string
+
+	// Addr is the raft address of the server, informed on Join and Leave.
+	Addr string
+
+	// Voter and ClientAddr are informed on Join. ClientAddr is where the joining replica
+	// serves clients, if any.
+	Voter      bool
+	ClientAddr string
+
+	// Forwarded is set on requests forwarded to the leader.
+	Forwarded bool
+}
+
+// String returns the request line of 'r', without the trailing newline.
+func (r *Request) String() string {
+	fields := []string{string(r.Op), r.ID}
+	switch r.Op {
+	case Join:
+		suffrage := "nonvoter"
+		if r.Voter {
+			suffrage = "voter"
+		}
+		fields = append(fields, r.Addr, suffrage)
+		if r.ClientAddr != "" {
+			fields = append(fields, r.ClientAddr)
+		}
+
+	case Leave:
+		fields = append(fields, r.Addr)
+	}
+
+	line := strings.Join(fields, " ")
+	if r.Forwarded {
+		line = forwardedPrefix + line
+	}
+	return line
+}
+
+// Parse returns the request on 'line', informing a BadRequest error if malformed.
+func Parse(line string) (*Request, error) {
+	line = strings.TrimSpace(line)
+	r := &Request{}
+	if strings.HasPrefix(line, forwardedPrefix) {
+		r.Forwarded = true
+		line = strings.TrimPrefix(line, forwardedPrefix)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 1 && !r.Forwarded {
+		return parseLegacy(fields[0])
+	}
+	if len(fields) < 2 {
+		return nil, Errorf(BadRequest, "malformed request %q", line)
+	}
+
+	r.Op, r.ID = Op(strings.ToUpper(fields[0])), fields[1]
+	args := fields[2:]
+	switch r.Op {
+	case Join:
+		if len(args) < 2 || len(args) > 3 {
+			return nil, Errorf(BadRequest, "expected JOIN <id> <raftAddr> <voter|nonvoter> [clientAddr], got %q", line)
+		}
+		switch args[1] {
+		case "voter":
+			r.Voter = true
+		case "nonvoter":
+		default:
+			return nil, Errorf(BadRequest, "unknown suffrage %q", args[1])
+		}
+		r.Addr = args[0]
+		if len(args) == 3 {
+			r.ClientAddr = args[2]
+		}
+
+	case Leave:
+		if len(args) != 1 {
+			return nil, Errorf(BadRequest, "expected LEAVE <id> <raftAddr>, got %q", line)
+		}
+		r.Addr = args[0]
+
+	case Remove, Promote, Demote:
+		if len(args) != 0 {
+			return nil, Errorf(BadRequest, "expected %s <id>, got %q", r.Op, line)
+		}
+
+	default:
+		return nil, Errorf(BadRequest, "unknown operation %q", fields[0])
+	}
+	return r, nil
+}
+
+// parseLegacy parses join requests formatted as "id-raftAddr-voter[-clientAddr]".
+func parseLegacy(line string) (*Request, error) {
+	data := strings.Split(line, "-")
+	if len(data) < 3 || len(data) > 4 {
+		return nil, Errorf(BadRequest, "malformed join request %q", line)
+	}
+	voter, err := strconv.ParseBool(data[2])
+	if err != nil {
+		return nil, Errorf(BadRequest, "malformed join request %q", line)
+	}
+
+	r := &Request{Op: Join, ID: data[0], Addr: data[1], Voter: voter}
+	if len(data) == 4 {
+		r.ClientAddr = data[3]
+	}
+	return r, nil
+}
+
+// Code classifies the errors returned by membership requests.
+type Code string
+
+const (
+	// BadRequest is returned for malformed requests.
+	BadRequest Code = "BAD_REQUEST"
+
+	// NotFound is returned when the informed server isn't a member of the cluster.
+	NotFound Code = "NOT_FOUND"
+
+	// NotLeader is returned when a forwarded request reaches a follower.
+	NotLeader Code = "NOT_LEADER"
+
+	// Unavailable is returned when the leader is unknown or unreachable, and the request
+	// may succeed if retried later.
+	Unavailable Code = "UNAVAILABLE"
+
+	// Internal is returned when the configuration change fails on the leader.
+	Internal Code = "INTERNAL"
+)
+
+// Error is the structured error replied to a failed request.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+// Errorf returns an Error with code 'code', formatting its message.
+func Errorf(code Code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// FormatReply returns the reply line informing 'err', without the trailing newline. Errors
+// other than *Error are reported as Internal.
+func FormatReply(err error) string {
+	if err == nil {
+		return "OK"
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: Internal, Message: err.Error()}
+	}
+	// messages must fit on the reply line
+	msg := strings.Join(strings.Fields(e.Message), " ")
+	return "ERR " + string(e.Code) + " " + msg
+}
+
+// ParseReply returns the error informed by a reply line, or nil on "OK".
+func ParseReply(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "OK" {
+		return nil
+	}
+
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || fields[0] != "ERR" {
+		return Errorf(Internal, "malformed reply %q", line)
+	}
+	e := &Error{Code: Code(fields[1])}
+	if len(fields) == 3 {
+		e.Message = fields[2]
+	}
+	return e
+}
+
+// Send sends 'r' to the membership handler at 'addr', returning the error replied, if any.
+// Connection failures are reported as Unavailable.
+func Send(addr string, r *Request, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return Errorf(Unavailable, "failed to connect to %s: %s", addr, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err = fmt.Fprint(conn, r.String()+"\n"); err != nil {
+		return Errorf(Unavailable, "failed to send request to %s: %s", addr, err.Error())
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return Errorf(Unavailable, "failed to read reply from %s: %s", addr, err.Error())
+	}
+	return ParseReply(reply)
+}
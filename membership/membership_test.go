@@ -0,0 +1,83 @@
+package membership
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	reqs := []*Request{
+		{Op: Join, ID: "node1", Addr: "10.0.0.1:12001", Voter: true, ClientAddr: ":11001"},
+		{Op: Join, ID: "log0", Addr: ":12100"},
+		{Op: Leave, ID: "log0", Addr: ":12100"},
+		{Op: Remove, ID: "node2"},
+		{Op: Promote, ID: "node3", Forwarded: true},
+		{Op: Demote, ID: "node3"},
+	}
+	for _, r := range reqs {
+		got, err := Parse(r.String() + "\n")
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", r.String(), err.Error())
+		}
+		if !reflect.DeepEqual(r, got) {
+			t.Fatalf("expected request %+v, got %+v", r, got)
+		}
+	}
+}
+
+func TestParseLegacyJoin(t *testing.T) {
+	exp := map[string]*Request{
+		"node1-:12001-true\n":        {Op: Join, ID: "node1", Addr: ":12001", Voter: true},
+		"node1-:12001-true-:11001\n": {Op: Join, ID: "node1", Addr: ":12001", Voter: true, ClientAddr: ":11001"},
+		"log0-:12100-false\n":        {Op: Join, ID: "log0", Addr: ":12100"},
+	}
+	for line, r := range exp {
+		got, err := Parse(line)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", line, err.Error())
+		}
+		if !reflect.DeepEqual(r, got) {
+			t.Fatalf("expected request %+v, got %+v", r, got)
+		}
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	lines := []string{
+		"",
+		"node1",
+		"node1-:12001",
+		"node1-:12001-maybe",
+		"JOIN node1",
+		"JOIN node1 :12001 sometimes",
+		"LEAVE node1",
+		"REMOVE node1 :12001",
+		"RESTART node1",
+		"FWD node1-:12001-true",
+	}
+	for _, line := range lines {
+		_, err := Parse(line)
+		var e *Error
+		if !errors.As(err, &e) || e.Code != BadRequest {
+			t.Fatalf("expected a bad request error parsing %q, got: %v", line, err)
+		}
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	if err := ParseReply(FormatReply(nil) + "\n"); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+
+	err := ParseReply(FormatReply(Errorf(NotFound, "no server\nwith ID %q", "node9")))
+	exp := &Error{Code: NotFound, Message: `no server with ID "node9"`}
+	if !reflect.DeepEqual(err, exp) {
+		t.Fatalf("expected error %v, got %v", exp, err)
+	}
+
+	err = ParseReply(FormatReply(errors.New("disk failure")))
+	if e, ok := err.(*Error); !ok || e.Code != Internal {
+		t.Fatalf("expected an internal error, got: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"beelog-hraft/membership"
+
+	"github.com/hashicorp/raft"
+)
+
+// startMemberNode starts a replica handling membership requests at 'memberAddr'.
+func startMemberNode(ctx context.Context, t *testing.T, id, raftAddr, memberAddr string, bootstrap bool) *Store {
+	dir, err := ioutil.TempDir("", "beelog-hraft")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+
+	s := NewStore(context.TODO(), true)
+	s.RaftDir = dir
+	s.MembershipAddr = memberAddr
+	if err := s.StartRaft(bootstrap, id, raftAddr); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	go s.ListenRaftJoins(ctx, memberAddr)
+	return s
+}
+
+func TestMembershipChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	localAddr := func() string {
+		return "127.0.0.1" + freeAddr(t)
+	}
+	leaderMember, followerMember := localAddr(), localAddr()
+	leader := startMemberNode(ctx, t, "node0", localAddr(), leaderMember, true)
+	defer stopClusterNode(leader)
+	waitLeader(t, leader)
+
+	followerAddr := localAddr()
+	follower := startMemberNode(ctx, t, "node1", followerAddr, followerMember, false)
+	defer stopClusterNode(follower)
+	join := &membership.Request{Op: membership.Join, ID: "node1", Addr: followerAddr, Voter: true}
+	if err := membership.Send(leaderMember, join, 5*time.Second); err != nil {
+		t.Fatalf("failed to join node1: %s", err.Error())
+	}
+
+	// the leader advertises its membership address through the raft log
+	waitFor(t, "follower to learn the leader membership address", func() bool {
+		return follower.leaderMemberAddr() == leaderMember
+	})
+
+	otherAddr := localAddr()
+	other := startClusterNode(t, "node2", otherAddr, "", false)
+	defer stopClusterNode(other)
+
+	// every request is sent to the follower, forwarding them to the leader
+	reqs := []struct {
+		line     string
+		suffrage raft.ServerSuffrage
+		member   bool
+		code     membership.Code
+	}{
+		{"JOIN node2 " + otherAddr + " nonvoter", raft.Nonvoter, true, ""},
+		{"PROMOTE node2", raft.Voter, true, ""},
+		{"PROMOTE node2", raft.Voter, true, ""},
+		{"DEMOTE node2", raft.Nonvoter, true, ""},
+		{"LEAVE node2 127.0.0.1:19999", raft.Nonvoter, true, membership.NotFound},
+		{"REMOVE node9", raft.Nonvoter, true, membership.NotFound},
+		{"node2-:12032", raft.Nonvoter, true, membership.BadRequest},
+		{"RESTART node2", raft.Nonvoter, true, membership.BadRequest},
+		{"LEAVE node2 " + otherAddr, 0, false, ""},
+		{"JOIN node2 " + otherAddr + " voter", raft.Voter, true, ""},
+		{"REMOVE node2", 0, false, ""},
+	}
+	for _, r := range reqs {
+		err := sendMembershipLine(t, followerMember, r.line)
+		var e *membership.Error
+		switch {
+		case r.code == "" && err != nil:
+			t.Fatalf("request %q failed: %s", r.line, err.Error())
+		case r.code != "" && (!errors.As(err, &e) || e.Code != r.code):
+			t.Fatalf("expected request %q to fail with %s, got: %v", r.line, r.code, err)
+		}
+
+		rep, err := leader.findServer("node2")
+		if member := err == nil; member != r.member {
+			t.Fatalf("after request %q, expected membership %v, got %v", r.line, r.member, member)
+		}
+		if r.member && rep.Suffrage != r.suffrage {
+			t.Fatalf("after request %q, expected suffrage %v, got %v", r.line, r.suffrage, rep.Suffrage)
+		}
+	}
+
+	if leader.raft.State() != raft.Leader {
+		t.Fatalf("leader lost its leadership after failed requests")
+	}
+}
+
+// sendMembershipLine sends a raw request line to the membership handler at 'addr', returning
+// the error replied.
+func sendMembershipLine(t *testing.T, addr, line string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to membership handler: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err = fmt.Fprint(conn, line+"\n"); err != nil {
+		t.Fatalf("failed to send request: %s", err.Error())
+	}
+	rep := make([]byte, 512)
+	n, err := conn.Read(rep)
+	if err != nil {
+		t.Fatalf("failed to read reply: %s", err.Error())
+	}
+	return membership.ParseReply(string(rep[:n]))
+}
@@ -0,0 +1,30 @@
+package main
+
+import "beelog-hraft/metrics"
+
+// Replica metrics, exported on the "/metrics" admin endpoint. Throughput is computed from
+// 'requestsTotal' by the scraper (e.g. 'rate(beelog_requests_total[1s])').
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	requestsTotal = metricsRegistry.NewCounter("beelog_requests_total",
+		"Client requests replied.")
+
+	sessionsGauge = metricsRegistry.NewGauge("beelog_sessions",
+		"Client sessions currently connected.")
+
+	proposalDuration = metricsRegistry.NewHistogram("beelog_proposal_duration_seconds",
+		"Time from a client request being read until replied.", metrics.LatencyBuckets)
+
+	applyDuration = metricsRegistry.NewHistogram("beelog_apply_duration_seconds",
+		"Time applying a committed command on the fsm, including its logging.", metrics.LatencyBuckets)
+
+	logCommandDuration = metricsRegistry.NewHistogramVec("beelog_log_command_duration_seconds",
+		"Time logging a command on the application log, per log strategy.", "strategy", metrics.LatencyBuckets)
+
+	recovBytes = metricsRegistry.NewCounter("beelog_recovery_transfer_bytes_total",
+		"Bytes transferred to recovering replicas.")
+
+	recovDuration = metricsRegistry.NewHistogram("beelog_recovery_transfer_duration_seconds",
+		"Time serving a state transfer to a recovering replica.", metrics.ExponentialBuckets(0.001, 2, 18))
+)
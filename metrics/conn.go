@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// CountConn counts the bytes written on a connection, e.g. to add the size of a state
+// transfer to a Counter once it's done.
+type CountConn struct {
+	net.Conn
+	n uint64
+}
+
+func (c *CountConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.n, uint64(n))
+	return n, err
+}
+
+// Written returns the number of bytes written on the connection.
+func (c *CountConn) Written() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
@@ -0,0 +1,304 @@
+// Package metrics implements counters, gauges and histograms exported in the Prometheus
+// text format, so replicas and loggers can be scraped during experiments. Metrics are
+// created through a Registry, and are safe for concurrent use.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the default histogram buckets for latencies measured in seconds,
+// ranging from 50us to about 13s.
+var LatencyBuckets = ExponentialBuckets(0.00005, 2, 19)
+
+// ExponentialBuckets returns 'count' bucket upper bounds, starting at 'start' and each
+// 'factor' times the previous one.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// metric is implemented by every metric type.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics exported together, in their registration order.
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]struct{}
+	metrics []metric
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.names[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.names[name] = struct{}{}
+	r.metrics = append(r.metrics, m)
+}
+
+// NewCounter registers a new Counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{header: header{name, help, "counter"}}
+	r.register(name, c)
+	return c
+}
+
+// NewGauge registers a new Gauge.
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{header: header{name, help, "gauge"}}
+	r.register(name, g)
+	return g
+}
+
+// NewHistogram registers a new Histogram with the upper bounds 'buckets', sorted in
+// increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	h.header = header{name, help, "histogram"}
+	r.register(name, h)
+	return h
+}
+
+// NewHistogramVec registers a new HistogramVec, partitioned by 'label'.
+func (r *Registry) NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	v := &HistogramVec{
+		header:  header{name, help, "histogram"},
+		label:   label,
+		buckets: buckets,
+		hists:   make(map[string]*Histogram),
+	}
+	r.register(name, v)
+	return v
+}
+
+// WriteTo writes every metric on 'w' following the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP exports the registry on an HTTP endpoint, scraped by Prometheus.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type header struct {
+	name, help, typ string
+}
+
+func (h header) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", h.name, h.help, h.name, h.typ)
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	header
+	v uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments the counter by 'n'.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header.write(w)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// Gauge is a value that may go up and down.
+type Gauge struct {
+	header
+	v int64
+}
+
+// Set sets the gauge to 'v'.
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+// Add adds 'd' to the gauge, which may be negative.
+func (g *Gauge) Add(d int64) {
+	atomic.AddInt64(&g.v, d)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.header.write(w)
+	fmt.Fprintf(w, "%s %d\n", g.name, g.Value())
+}
+
+// Histogram counts observations into cumulative buckets, also tracking their sum.
+type Histogram struct {
+	header
+	buckets []float64
+	counts  []uint64 // atomic, non-cumulative, last one counts observations over every bucket
+	count   uint64   // atomic
+	sumBits uint64   // atomic, float64 bits
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds 'v' to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Since observes the seconds elapsed since 'start'.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of every observation.
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header.write(w)
+	h.writeSeries(w, h.name, "")
+}
+
+// writeSeries writes the samples of 'h', prefixing its labels with 'labels'. Samples are
+// read one by one, so the count may include observations not yet on any bucket.
+func (h *Histogram) writeSeries(w *bufio.Writer, name, labels string) {
+	var cum uint64
+	for i, b := range h.buckets {
+		cum += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(b), cum)
+	}
+	cum += atomic.LoadUint64(&h.counts[len(h.buckets)])
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, cum)
+
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.Sum()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, cum)
+}
+
+// HistogramVec is a set of histograms sharing the same name and buckets, partitioned by
+// the value of a label.
+type HistogramVec struct {
+	header
+	label   string
+	buckets []float64
+
+	mu    sync.RWMutex
+	hists map[string]*Histogram
+}
+
+// With returns the histogram where 'label' is 'value', created on first use.
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.RLock()
+	h, ok := v.hists[value]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok = v.hists[value]; !ok {
+		h = newHistogram(v.buckets)
+		v.hists[value] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.header.write(w)
+
+	v.mu.RLock()
+	values := make([]string, 0, len(v.hists))
+	for value := range v.hists {
+		values = append(values, value)
+	}
+	v.mu.RUnlock()
+
+	sort.Strings(values)
+	for _, value := range values {
+		labels := fmt.Sprintf("%s=%s,", v.label, strconv.Quote(value))
+		v.With(value).writeSeries(w, v.name, labels)
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestWritePrometheusFormat(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests replied.")
+	g := r.NewGauge("sessions", "Connected sessions.")
+	h := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1})
+	v := r.NewHistogramVec("log_seconds", "Logging latency.", "strategy", []float64{1})
+
+	c.Add(3)
+	g.Add(2)
+	g.Add(-1)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+	v.With("b").Observe(0.5)
+	v.With("a").Observe(1.5)
+
+	exp := `# HELP requests_total Requests replied.
+# TYPE requests_total counter
+requests_total 3
+# HELP sessions Connected sessions.
+# TYPE sessions gauge
+sessions 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+# HELP log_seconds Logging latency.
+# TYPE log_seconds histogram
+log_seconds_bucket{strategy="a",le="1"} 0
+log_seconds_bucket{strategy="a",le="+Inf"} 1
+log_seconds_sum{strategy="a"} 1.5
+log_seconds_count{strategy="a"} 1
+log_seconds_bucket{strategy="b",le="1"} 1
+log_seconds_bucket{strategy="b",le="+Inf"} 1
+log_seconds_sum{strategy="b"} 0.5
+log_seconds_count{strategy="b"} 1
+`
+	buf := bytes.NewBuffer(nil)
+	n, err := r.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("failed to write metrics: %s", err.Error())
+	}
+	if buf.String() != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, buf.String())
+	}
+	if n != int64(len(exp)) {
+		t.Fatalf("expected %d bytes written, got %d", len(exp), n)
+	}
+}
+
+func TestConcurrentObservations(t *testing.T) {
+	h := NewRegistry().NewHistogram("latency_seconds", "Request latency.", LatencyBuckets)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				h.Observe(0.25)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if h.Count() != 8000 || h.Sum() != 2000 {
+		t.Fatalf("expected 8000 observations summing 2000, got %d summing %v", h.Count(), h.Sum())
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests replied.")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected duplicated metric to panic")
+		}
+	}()
+	r.NewGauge("requests_total", "Requests replied.")
+}
+
+func TestCountConn(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go io.Copy(ioutil.Discard, cli)
+
+	cc := &CountConn{Conn: srv}
+	for _, p := range []string{"snapshot", " 2 ", "10\n"} {
+		if _, err := cc.Write([]byte(p)); err != nil {
+			t.Fatalf("failed to write: %s", err.Error())
+		}
+	}
+	if n := cc.Written(); n != 14 {
+		t.Fatalf("expected 14 bytes written, got %d", n)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"beelog-hraft/kvpb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// peerKeyPrefix prefixes the keys of the peer table mapping each replica raft address to
+	// the address where it serves clients.
+	peerKeyPrefix = "\x00peer/"
+
+	// memberKeyPrefix prefixes the keys of the peer table mapping each replica raft address
+	// to the address where it handles membership requests.
+	memberKeyPrefix = "\x00member/"
+
+	// notLeaderRepply is returned by followers to commands requesting a redirect, followed
+	// by the leader's client address, or empty if the leader is unknown.
+	notLeaderRepply = "NOT_LEADER "
+
+	// errInternalCommand replies clients proposing commands reserved to replicas.
+	errInternalCommand = "ERR internal command"
+)
+
+// peerTable holds the addresses advertised by replicas, keyed by peerKey or memberKey. It's
+// replicated through ADVERTISE commands, applied by the fsm apart from the key-value state,
+// so every replica learns them through the raft log and snapshots without exposing them to
+// clients, application logs or watches.
+type peerTable struct {
+	mu    sync.RWMutex
+	addrs map[string]string
+}
+
+func (p *peerTable) get(key string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.addrs[key]
+}
+
+func (p *peerTable) set(key, addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.addrs == nil {
+		p.addrs = make(map[string]string)
+	}
+	p.addrs[key] = addr
+}
+
+// clone returns a copy of every address, written on snapshots.
+func (p *peerTable) clone() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	addrs := make(map[string]string, len(p.addrs))
+	for key, addr := range p.addrs {
+		addrs[key] = addr
+	}
+	return addrs
+}
+
+// reset replaces every address by 'addrs', restored from a snapshot.
+func (p *peerTable) reset(addrs map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addrs = addrs
+}
+
+func peerKey(raftAddr string) string {
+	return peerKeyPrefix + raftAddr
+}
+
+func memberKey(raftAddr string) string {
+	return memberKeyPrefix + raftAddr
+}
+
+// advertiseAddr returns the address clients should dial to reach a replica bound at 'bind',
+// assuming the host of its raft address 'raftAddr' if 'bind' informs only a port.
+func advertiseAddr(bind, raftAddr string) string {
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil || host != "" {
+		return bind
+	}
+	raftHost, _, err := net.SplitHostPort(raftAddr)
+	if err != nil {
+		return bind
+	}
+	return net.JoinHostPort(raftHost, port)
+}
+
+// registerPeer proposes the client address of the replica at 'raftAddr', ignored if it's
+// already registered. Must be called on the leader.
+func (s *Store) registerPeer(raftAddr, clientAddr string) error {
+	return s.registerAddr(peerKey(raftAddr), clientAddr)
+}
+
+// registerAddr proposes 'addr' as the address under 'key' on the peer table, ignored if it's
+// already set. Must be called on the leader.
+func (s *Store) registerAddr(key, addr string) error {
+	if s.peers.get(key) == addr {
+		return nil
+	}
+
+	cmd := &kvpb.Command{
+		Op:    kvpb.Command_ADVERTISE,
+		Key:   key,
+		Value: addr,
+	}
+	raw, err := proto.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return s.raft.Apply(raw, raftTimeout).Error()
+}
+
+// leaderClientAddr returns the client address of the current leader, or an empty string if
+// the leader or its address are unknown.
+func (s *Store) leaderClientAddr() string {
+	leader := s.raft.Leader()
+	if leader == "" {
+		return ""
+	}
+	return s.peers.get(peerKey(string(leader)))
+}
+
+// leaderMemberAddr returns the membership address of the current leader, or an empty string
+// if the leader or its address are unknown.
+func (s *Store) leaderMemberAddr() string {
+	leader := s.raft.Leader()
+	if leader == "" {
+		return ""
+	}
+	return s.peers.get(memberKey(string(leader)))
+}
+
+// advertiseOnLeadership registers the store client and membership addresses whenever it
+// acquires leadership, so the bootstrapping replica, which never sends a join request, is
+// also known by others.
+func (s *Store) advertiseOnLeadership() {
+	// non-blocking, since registerPeer waits on the raft goroutine that notifies observers
+	ch := make(chan raft.Observation, 16)
+	s.observerCh = ch
+	s.observer = raft.NewObserver(ch, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	})
+	s.raft.RegisterObserver(s.observer)
+
+	local := s.transport.LocalAddr()
+	go func() {
+		for o := range ch {
+			if o.Data.(raft.LeaderObservation).Leader != local {
+				continue
+			}
+			if s.ClientAddr != "" {
+				err := s.registerPeer(string(local), advertiseAddr(s.ClientAddr, string(local)))
+				if err != nil {
+					s.logger.Error(fmt.Sprintf("failed to advertise client address: %s", err.Error()))
+				}
+			}
+			if s.MembershipAddr != "" {
+				err := s.registerAddr(memberKey(string(local)), advertiseAddr(s.MembershipAddr, string(local)))
+				if err != nil {
+					s.logger.Error(fmt.Sprintf("failed to advertise membership address: %s", err.Error()))
+				}
+			}
+		}
+	}()
+}
+
+// stopAdvertising deregisters the leadership observer, halting its goroutine.
+func (s *Store) stopAdvertising() {
+	if s.observer == nil {
+		return
+	}
+	s.raft.DeregisterObserver(s.observer)
+	close(s.observerCh)
+	s.observer = nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"beelog-hraft/kvpb"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// sessionQueueSize bounds the number of proposals in flight from a single session.
+	sessionQueueSize = 64
+
+	// errMalformedCommand replies requests failing to unmarshal, followed by the cause.
+	errMalformedCommand = "ERR malformed command: "
+)
+
+// proposal is a request from a client session, proposed without waiting for previous ones
+// to be applied.
+type proposal struct {
+	req   *Request
+	cmd   *kvpb.Command
+	start time.Time
+
+	// f is the raft future of the proposal, nil if 'cmd' isn't logged and must be served
+	// once previous proposals are replied (i.e. on followers, ReadIndex reads or watches).
+	// Only set after 'ready' is closed.
+	f     raft.ApplyFuture
+	ready chan struct{}
+
+	// done is closed once a ReadIndex read or watch is replied, nil for other commands
+	done chan struct{}
+
+	// malformed is the error replied instead of proposing a request failing to unmarshal,
+	// holding only the reply attributes on 'cmd'
+	malformed string
+}
+
+// pipeline launches the request path of 'client'. Requests are proposed in order by one
+// goroutine and replied in the same order by another, so a proposal stuck on raft, or a
+// client not consuming its replies, only delays its own session. Once the session is
+// disconnected, or the server exits, requests already proposed are still replied before
+// the session is closed and removed from the server.
+func (svr *Server) pipeline(ctx context.Context, client *Session) {
+	queue := make(chan *proposal, sessionQueueSize)
+	svr.pipelines.Add(1)
+	go svr.propose(ctx, client, queue)
+	go func() {
+		defer svr.pipelines.Done()
+		svr.replyInOrder(ctx, queue)
+		svr.leave(client)
+	}()
+}
+
+// propose reads requests from 'client', proposing and queueing each one on 'queue'. Once
+// 'queue' or the server-wide limit of in-flight proposals are full, requests are no longer
+// consumed, blocking Session.Read and, consequently, reads from the client connection.
+func (svr *Server) propose(ctx context.Context, client *Session, queue chan<- *proposal) {
+	defer close(queue)
+	for {
+		var req *Request
+		select {
+		case <-ctx.Done():
+			return
+		case <-svr.quit:
+			return
+		case <-client.ctx.Done():
+			return
+		case req = <-client.incoming:
+		}
+		start := time.Now()
+
+		cmd, malformed := &kvpb.Command{}, ""
+		if err := proto.Unmarshal(req.Command, cmd); err != nil {
+			svr.kvstore.logger.Error(fmt.Sprintf("Failed to propose message: %q, error: %s\n", req.Command, err.Error()))
+
+			// session replies are still matched by the client, so the error is replied
+			hdr := &kvpb.Header{}
+			if proto.Unmarshal(req.Command, hdr) != nil || hdr.Reply != kvpb.Command_SESSION {
+				continue
+			}
+			cmd = &kvpb.Command{ReqId: hdr.ReqId, Reply: hdr.Reply}
+			malformed = errMalformedCommand + err.Error()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-svr.quit:
+			return
+		case svr.inflight <- struct{}{}:
+		}
+
+		p := &proposal{req: req, cmd: cmd, start: start, ready: make(chan struct{}), malformed: malformed}
+		if malformed != "" {
+			close(p.ready)
+		} else if isLocal(cmd) {
+			p.done = make(chan struct{})
+			close(p.ready)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case queue <- p:
+		}
+		if malformed != "" {
+			continue
+		}
+
+		// reads must not observe later commands from the session, which are only proposed
+		// once it's replied
+		if p.done != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.done:
+			}
+			continue
+		}
+
+		p.f = svr.kvstore.applyAsync(req.Command, cmd)
+		close(p.ready)
+	}
+}
+
+// replyInOrder waits for each proposal on 'queue' to be applied, replying its result, until
+// 'queue' is closed.
+func (svr *Server) replyInOrder(ctx context.Context, queue <-chan *proposal) {
+	for p := range queue {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.ready:
+		}
+
+		var err error
+		switch {
+		case p.malformed != "":
+			err = svr.reply(p.req, p.cmd, "OK: "+p.malformed)
+		case p.f != nil:
+			err = svr.kvstore.replyApplied(p.f, p.cmd, svr, p.req)
+		default:
+			err = svr.kvstore.propose(p.req.Command, p.cmd, svr, p.req)
+		}
+		if err != nil {
+			svr.kvstore.logger.Error(fmt.Sprintf("Failed to propose message: %q, error: %s\n", p.req.Command, err.Error()))
+		}
+
+		if p.done != nil {
+			close(p.done)
+		}
+		<-svr.inflight
+		proposalDuration.Since(p.start)
+		requestsTotal.Inc()
+	}
+}
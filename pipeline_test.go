@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"beelog-hraft/kvpb"
+	"beelog-hraft/wire"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestStuckSessionDoesNotBlockOthers(t *testing.T) {
+	s := startClusterNode(t, "node0", freeAddr(t), "", true)
+	defer stopClusterNode(s)
+	waitLeader(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svr := startTestServer(ctx, s)
+
+	stuckSrv, stuck := net.Pipe()
+	svr.joins <- stuckSrv
+	defer stuck.Close()
+
+	srvConn, conn := net.Pipe()
+	svr.joins <- srvConn
+	defer conn.Close()
+
+	// never consumes replies, so its first proposal is stuck on the session. Later ones
+	// fill its pipeline, until reads from the connection are paused.
+	cmd := &kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar", Reply: kvpb.Command_SESSION}
+	paused := false
+	for i := 0; i < 4*sessionQueueSize; i++ {
+		cmd.ReqId++
+		raw, _ := proto.Marshal(cmd)
+		stuck.SetWriteDeadline(time.Now().Add(time.Second))
+		if err := wire.WriteFrame(stuck, wire.MsgCommand, raw); err != nil {
+			paused = true
+			break
+		}
+	}
+	if !paused {
+		t.Fatalf("stuck session never stopped consuming commands")
+	}
+
+	for i := 0; i < 10; i++ {
+		cmd := &kvpb.Command{
+			Op:    pb.Command_SET,
+			Key:   "baz",
+			Value: strconv.Itoa(i),
+			ReqId: uint64(i + 1),
+			Reply: kvpb.Command_SESSION,
+		}
+		raw, _ := proto.Marshal(cmd)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if err := wire.WriteFrame(conn, wire.MsgCommand, raw); err != nil {
+			t.Fatalf("failed to send command %d: %s", i, err.Error())
+		}
+
+		typ, payload, err := wire.ReadFrame(conn)
+		if err != nil || typ != wire.MsgReply {
+			t.Fatalf("failed to read reply %d, type %d, err: %v", i, typ, err)
+		}
+		if id, rep, _ := wire.DecodeReply(payload); id != cmd.ReqId || string(rep) != "OK: " {
+			t.Fatalf("expected reply %d \"OK: \", got %d %q", cmd.ReqId, id, rep)
+		}
+	}
+}
@@ -0,0 +1,617 @@
+// Package raftstore implements a durable raft.LogStore and raft.StableStore backed by
+// append-only segment files, allowing replicas to recover their term, vote and log
+// after a crash.
+package raftstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// default maximum size of a segment file before rotating to a new one.
+	defaultSegmentSize int64 = 64 << 20
+
+	segmentExt = ".seg"
+	metaFname  = "meta"
+	stableFn   = "stable"
+
+	// record header: body len and crc32 checksum, each 32b BigEndian.
+	headerSize = 8
+)
+
+var (
+	errNotFound   = errors.New("not found")
+	errNotInOrder = errors.New("log entries must be stored in contiguous order")
+)
+
+// segment is an append-only file storing a contiguous sequence of log entries,
+// starting at index 'first'.
+type segment struct {
+	first uint64
+	fd    *os.File
+	size  int64
+	offs  []int64 // offset of each entry, 'offs[i]' stores entry 'first + i'
+}
+
+func (sg *segment) last() uint64 {
+	return sg.first + uint64(len(sg.offs)) - 1
+}
+
+// FileStore implements both raft.LogStore and raft.StableStore interfaces, persisting
+// log entries on segment files at 'dir' and stable keys on a single file, atomically
+// replaced on each update. Log entries are read from disk on GetLog calls, only their
+// offsets are kept in memory.
+type FileStore struct {
+	dir    string
+	noSync bool
+
+	// segments are rotated once they reach 'segmentSize' bytes
+	segmentSize int64
+
+	mu          sync.RWMutex
+	segs        []*segment
+	first, last uint64
+
+	stMu   sync.RWMutex
+	stable map[string][]byte
+}
+
+// NewFileStore opens or creates a FileStore at 'dir', replaying any existing segment.
+// If 'noSync' is set, log appends are not synced to stable storage, trading durability on
+// OS crashes for throughput. Stable keys (i.e. the current term and vote) and the first
+// index are always synced, since a replica forgetting its vote could vote twice on a term.
+func NewFileStore(dir string, noSync bool) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		dir:         dir,
+		noSync:      noSync,
+		segmentSize: defaultSegmentSize,
+		stable:      make(map[string][]byte),
+	}
+	if err := fs.loadStable(); err != nil {
+		return nil, err
+	}
+	if err := fs.loadSegments(); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Close releases every open segment file.
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var err error
+	for _, sg := range fs.segs {
+		if e := sg.fd.Close(); e != nil {
+			err = e
+		}
+	}
+	fs.segs = nil
+	return err
+}
+
+// FirstIndex returns the first index written. 0 for no entries.
+func (fs *FileStore) FirstIndex() (uint64, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.first, nil
+}
+
+// LastIndex returns the last index written. 0 for no entries.
+func (fs *FileStore) LastIndex() (uint64, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.last, nil
+}
+
+// GetLog gets a log entry at a given index.
+func (fs *FileStore) GetLog(index uint64, log *raft.Log) error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if fs.last == 0 || index < fs.first || index > fs.last {
+		return raft.ErrLogNotFound
+	}
+
+	// first segment starting after 'index', then step back
+	i := sort.Search(len(fs.segs), func(i int) bool {
+		return fs.segs[i].first > index
+	}) - 1
+	if i < 0 {
+		return raft.ErrLogNotFound
+	}
+	sg := fs.segs[i]
+
+	var hdr [headerSize]byte
+	off := sg.offs[index-sg.first]
+	if _, err := sg.fd.ReadAt(hdr[:], off); err != nil {
+		return err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(hdr[:4]))
+	if _, err := sg.fd.ReadAt(body, off+headerSize); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(hdr[4:]) {
+		return fmt.Errorf("corrupted log entry at index %d", index)
+	}
+	return decodeLog(body, log)
+}
+
+// StoreLog stores a log entry.
+func (fs *FileStore) StoreLog(log *raft.Log) error {
+	return fs.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs stores multiple log entries, serialized then appended on a single write.
+func (fs *FileStore) StoreLogs(logs []*raft.Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.last > 0 && logs[0].Index != fs.last+1 {
+		return errNotInOrder
+	}
+
+	sg, err := fs.activeSegment(logs[0].Index)
+	if err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	offs := make([]int64, 0, len(logs))
+	for i, l := range logs {
+		if i > 0 && l.Index != logs[i-1].Index+1 {
+			return errNotInOrder
+		}
+		offs = append(offs, sg.size+int64(buf.Len()))
+		encodeLog(buf, l)
+	}
+
+	if _, err = sg.fd.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if !fs.noSync {
+		if err = sg.fd.Sync(); err != nil {
+			return err
+		}
+	}
+
+	sg.size += int64(buf.Len())
+	sg.offs = append(sg.offs, offs...)
+	if fs.last == 0 {
+		fs.first = logs[0].Index
+	}
+	fs.last = logs[len(logs)-1].Index
+	return nil
+}
+
+// DeleteRange deletes a range of log entries. The range is inclusive. Only prefix and
+// suffix deletions are supported, which are the only ones requested by raft: prefixes
+// are compacted after snapshots, and suffixes are truncated on conflicting entries.
+func (fs *FileStore) DeleteRange(min, max uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.last == 0 || max < fs.first || min > fs.last {
+		return nil
+	}
+	prefix, suffix := min <= fs.first, max >= fs.last
+	if !prefix && !suffix {
+		return fmt.Errorf("cannot delete entries [%d, %d] from the middle of the log", min, max)
+	}
+
+	if suffix {
+		if err := fs.truncateSuffix(min); err != nil {
+			return err
+		}
+	}
+
+	if prefix {
+		if err := fs.removePrefix(max); err != nil {
+			return err
+		}
+		fs.first = max + 1
+	}
+
+	if fs.first > fs.last {
+		fs.first, fs.last = 0, 0
+	}
+	return fs.writeMeta()
+}
+
+// truncateSuffix removes every entry starting at 'min', from the last segment backwards.
+// Each segment is removed, or truncated, before 'fs.last' is moved behind it, so the last
+// index never covers entries missing on disk. Truncations are always synced, regardless of
+// 'noSync', since conflicting entries recovered after a crash would diverge from the leader.
+func (fs *FileStore) truncateSuffix(min uint64) error {
+	removed := false
+	for len(fs.segs) > 0 {
+		sg := fs.segs[len(fs.segs)-1]
+		if sg.first >= min {
+			if err := fs.removeSegment(sg); err != nil {
+				return err
+			}
+			fs.segs = fs.segs[:len(fs.segs)-1]
+			fs.last = sg.first - 1
+			removed = true
+			continue
+		}
+
+		if min <= sg.last() {
+			pos := min - sg.first
+			if err := sg.fd.Truncate(sg.offs[pos]); err != nil {
+				return err
+			}
+			if err := sg.fd.Sync(); err != nil {
+				return err
+			}
+			sg.size = sg.offs[pos]
+			sg.offs = sg.offs[:pos]
+		}
+		break
+	}
+	fs.last = min - 1
+
+	if removed {
+		return syncDir(fs.dir)
+	}
+	return nil
+}
+
+// removePrefix removes every segment entirely covered by 'max'. Entries from a partially
+// covered segment are kept on disk, but ignored due to the persisted first index.
+func (fs *FileStore) removePrefix(max uint64) error {
+	for len(fs.segs) > 0 && fs.segs[0].last() <= max {
+		if err := fs.removeSegment(fs.segs[0]); err != nil {
+			return err
+		}
+		fs.segs = fs.segs[1:]
+	}
+	return nil
+}
+
+func (fs *FileStore) removeSegment(sg *segment) error {
+	if err := sg.fd.Close(); err != nil {
+		return err
+	}
+	return os.Remove(sg.fd.Name())
+}
+
+// activeSegment returns the segment receiving new entries, rotating to a new file
+// starting at 'index' if the current one is full or no segment exists.
+func (fs *FileStore) activeSegment(index uint64) (*segment, error) {
+	if n := len(fs.segs); n > 0 && fs.segs[n-1].size < fs.segmentSize && fs.last > 0 {
+		return fs.segs[n-1], nil
+	}
+
+	fn := filepath.Join(fs.dir, fmt.Sprintf("%020d%s", index, segmentExt))
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sg := &segment{first: index, fd: fd}
+	fs.segs = append(fs.segs, sg)
+	return sg, nil
+}
+
+// loadSegments replays every segment file on 'fs.dir', truncating any incomplete or
+// corrupted record found on tail, caused by a crash during an append.
+func (fs *FileStore) loadSegments() error {
+	fns, err := filepath.Glob(filepath.Join(fs.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(fns) // zero-padded names sort by first index
+
+	for _, fn := range fns {
+		var first uint64
+		if _, err = fmt.Sscanf(filepath.Base(fn), "%020d"+segmentExt, &first); err != nil {
+			return fmt.Errorf("unexpected segment file '%s'", fn)
+		}
+
+		fd, err := os.OpenFile(fn, os.O_RDWR|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		sg := &segment{first: first, fd: fd}
+		fs.segs = append(fs.segs, sg)
+
+		if err = sg.replay(); err != nil {
+			return err
+		}
+		if len(sg.offs) == 0 {
+			if err = fs.removeSegment(sg); err != nil {
+				return err
+			}
+			fs.segs = fs.segs[:len(fs.segs)-1]
+		}
+	}
+
+	if len(fs.segs) == 0 {
+		return nil
+	}
+	fs.first = fs.segs[0].first
+	fs.last = fs.segs[len(fs.segs)-1].last()
+
+	metaFirst, err := fs.readMeta()
+	if err != nil {
+		return err
+	}
+	if metaFirst > fs.first {
+		fs.first = metaFirst
+	}
+	if fs.first > fs.last {
+		fs.first, fs.last = 0, 0
+	}
+	return nil
+}
+
+// replay reads every record from the segment file, registering their offsets. An
+// incomplete or corrupted record on tail is discarded.
+func (sg *segment) replay() error {
+	rd := &countingReader{rd: bufio.NewReader(sg.fd)}
+	for {
+		off := rd.n
+		var hdr [headerSize]byte
+		_, err := io.ReadFull(rd, hdr[:])
+		if err == io.EOF {
+			return nil
+
+		} else if err == io.ErrUnexpectedEOF {
+			return sg.truncateAt(off)
+
+		} else if err != nil {
+			return err
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(hdr[:4]))
+		_, err = io.ReadFull(rd, body)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sg.truncateAt(off)
+
+		} else if err != nil {
+			return err
+		}
+
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(hdr[4:]) {
+			return sg.truncateAt(off)
+		}
+		sg.offs = append(sg.offs, off)
+		sg.size = rd.n
+	}
+}
+
+// truncateAt discards the segment content starting at 'off'.
+func (sg *segment) truncateAt(off int64) error {
+	sg.size = off
+	return sg.fd.Truncate(off)
+}
+
+// countingReader counts the number of bytes read from 'rd'.
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.rd.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeMeta persists the first log index, so entries already compacted on a partially
+// removed segment are not recovered.
+func (fs *FileStore) writeMeta() error {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], fs.first)
+	return writeFileAtomic(filepath.Join(fs.dir, metaFname), raw[:])
+}
+
+func (fs *FileStore) readMeta() (uint64, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(fs.dir, metaFname))
+	if os.IsNotExist(err) {
+		return 0, nil
+
+	} else if err != nil {
+		return 0, err
+	}
+	if len(raw) != 8 {
+		return 0, fmt.Errorf("corrupted meta file, expected 8 bytes, got %d", len(raw))
+	}
+	return binary.BigEndian.Uint64(raw), nil
+}
+
+// Set stores 'val' for 'key' on stable storage.
+func (fs *FileStore) Set(key []byte, val []byte) error {
+	fs.stMu.Lock()
+	defer fs.stMu.Unlock()
+
+	fs.stable[string(key)] = append([]byte(nil), val...)
+	return fs.writeStable()
+}
+
+// Get returns the value for key, or a "not found" error, matching raft.InmemStore.
+func (fs *FileStore) Get(key []byte) ([]byte, error) {
+	fs.stMu.RLock()
+	defer fs.stMu.RUnlock()
+
+	val, ok := fs.stable[string(key)]
+	if !ok {
+		return nil, errNotFound
+	}
+	return val, nil
+}
+
+// SetUint64 stores 'val' for 'key' on stable storage.
+func (fs *FileStore) SetUint64(key []byte, val uint64) error {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], val)
+	return fs.Set(key, raw[:])
+}
+
+// GetUint64 returns the uint64 value for key, or 0 if key was not found.
+func (fs *FileStore) GetUint64(key []byte) (uint64, error) {
+	val, err := fs.Get(key)
+	if err == errNotFound {
+		return 0, nil
+	}
+	if len(val) != 8 {
+		return 0, fmt.Errorf("value for key '%s' is not an uint64", key)
+	}
+	return binary.BigEndian.Uint64(val), nil
+}
+
+// writeStable serializes every stable key as a sequence of length prefixed key and
+// value pairs, atomically replacing the previous file. Must be called within mutual
+// exclusion scope.
+func (fs *FileStore) writeStable() error {
+	buf := bytes.NewBuffer(nil)
+	for k, v := range fs.stable {
+		writeBytes(buf, []byte(k))
+		writeBytes(buf, v)
+	}
+	return writeFileAtomic(filepath.Join(fs.dir, stableFn), buf.Bytes())
+}
+
+func (fs *FileStore) loadStable() error {
+	raw, err := ioutil.ReadFile(filepath.Join(fs.dir, stableFn))
+	if os.IsNotExist(err) {
+		return nil
+
+	} else if err != nil {
+		return err
+	}
+
+	rd := bytes.NewReader(raw)
+	for rd.Len() > 0 {
+		k, err := readBytes(rd)
+		if err != nil {
+			return fmt.Errorf("corrupted stable file: %s", err.Error())
+		}
+		v, err := readBytes(rd)
+		if err != nil {
+			return fmt.Errorf("corrupted stable file: %s", err.Error())
+		}
+		fs.stable[string(k)] = v
+	}
+	return nil
+}
+
+// encodeLog appends 'l' into 'buf' as a record: a header with the body length and
+// checksum, followed by index, term, type, data and extensions.
+func encodeLog(buf *bytes.Buffer, l *raft.Log) {
+	body := bytes.NewBuffer(make([]byte, 0, 25+len(l.Data)+len(l.Extensions)))
+	var num [8]byte
+	binary.BigEndian.PutUint64(num[:], l.Index)
+	body.Write(num[:])
+	binary.BigEndian.PutUint64(num[:], l.Term)
+	body.Write(num[:])
+	body.WriteByte(byte(l.Type))
+	writeBytes(body, l.Data)
+	writeBytes(body, l.Extensions)
+
+	var hdr [headerSize]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(body.Len()))
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(body.Bytes()))
+	buf.Write(hdr[:])
+	buf.Write(body.Bytes())
+}
+
+func decodeLog(body []byte, l *raft.Log) error {
+	if len(body) < 17 {
+		return io.ErrUnexpectedEOF
+	}
+	l.Index = binary.BigEndian.Uint64(body[:8])
+	l.Term = binary.BigEndian.Uint64(body[8:16])
+	l.Type = raft.LogType(body[16])
+
+	var err error
+	rd := bytes.NewReader(body[17:])
+	if l.Data, err = readBytes(rd); err != nil {
+		return err
+	}
+	l.Extensions, err = readBytes(rd)
+	return err
+}
+
+// writeBytes writes 'b' prefixed by its binary encoded size, 32b, BigEndian format.
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	var ln [4]byte
+	binary.BigEndian.PutUint32(ln[:], uint32(len(b)))
+	buf.Write(ln[:])
+	buf.Write(b)
+}
+
+func readBytes(rd *bytes.Reader) ([]byte, error) {
+	var ln uint32
+	if err := binary.Read(rd, binary.BigEndian, &ln); err != nil {
+		return nil, err
+	}
+	if int(ln) > rd.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if ln == 0 {
+		return nil, nil
+	}
+	b := make([]byte, ln)
+	_, err := io.ReadFull(rd, b)
+	return b, err
+}
+
+// writeFileAtomic writes 'data' to a temporary file, then renames it to 'fn', syncing both
+// the file and its directory so the rename survives OS crashes.
+func writeFileAtomic(fn string, data []byte) error {
+	tmp := fn + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fn); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fn))
+}
+
+// syncDir syncs directory 'dn', persisting files created, renamed or removed on it.
+func syncDir(dn string) error {
+	dir, err := os.Open(dn)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,199 @@
+package raftstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs := openStore(t, dir)
+	storeRange(t, fs, 1, 100)
+	if err := fs.SetUint64([]byte("CurrentTerm"), 7); err != nil {
+		t.Fatalf("failed to set stable key: %s", err.Error())
+	}
+	if err := fs.Set([]byte("LastVoteCand"), []byte("node1")); err != nil {
+		t.Fatalf("failed to set stable key: %s", err.Error())
+	}
+	fs.Close()
+
+	fs = openStore(t, dir)
+	defer fs.Close()
+	checkIndexes(t, fs, 1, 100)
+	checkEntries(t, fs, 1, 100)
+
+	term, err := fs.GetUint64([]byte("CurrentTerm"))
+	if err != nil || term != 7 {
+		t.Fatalf("expected term 7, got %d, err: %v", term, err)
+	}
+	cand, err := fs.Get([]byte("LastVoteCand"))
+	if err != nil || string(cand) != "node1" {
+		t.Fatalf("expected candidate 'node1', got '%s', err: %v", cand, err)
+	}
+	if _, err = fs.Get([]byte("unknown")); err == nil || err.Error() != "not found" {
+		t.Fatalf("expected a 'not found' error, got: %v", err)
+	}
+}
+
+func TestFileStoreDeleteRange(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs := openStore(t, dir)
+	storeRange(t, fs, 1, 100)
+
+	// conflicting suffix, then new entries
+	if err := fs.DeleteRange(81, 100); err != nil {
+		t.Fatalf("failed to delete suffix: %s", err.Error())
+	}
+	checkIndexes(t, fs, 1, 80)
+	storeRange(t, fs, 81, 120)
+
+	// compaction after a snapshot
+	if err := fs.DeleteRange(1, 50); err != nil {
+		t.Fatalf("failed to delete prefix: %s", err.Error())
+	}
+	checkIndexes(t, fs, 51, 120)
+	if err := fs.GetLog(50, &raft.Log{}); err != raft.ErrLogNotFound {
+		t.Fatalf("expected compacted entry to be not found, got: %v", err)
+	}
+	fs.Close()
+
+	fs = openStore(t, dir)
+	defer fs.Close()
+	checkIndexes(t, fs, 51, 120)
+	checkEntries(t, fs, 51, 120)
+}
+
+func TestFileStoreReopenAfterTruncation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// each batch of 10 entries exceeds the segment size, filling a segment of its own
+	fs := openStore(t, dir)
+	fs.segmentSize = 256
+	for i := uint64(0); i < 6; i++ {
+		storeRange(t, fs, 10*i+1, 10*i+10)
+	}
+	checkSegments(t, dir, 6)
+
+	// removes the last segments, truncating the one holding the first conflicting entry
+	if err := fs.DeleteRange(25, 60); err != nil {
+		t.Fatalf("failed to delete suffix: %s", err.Error())
+	}
+	checkIndexes(t, fs, 1, 24)
+	checkSegments(t, dir, 3)
+	fs.Close()
+
+	fs = openStore(t, dir)
+	fs.segmentSize = 256
+	checkIndexes(t, fs, 1, 24)
+	checkEntries(t, fs, 1, 24)
+	if err := fs.GetLog(25, &raft.Log{}); err != raft.ErrLogNotFound {
+		t.Fatalf("expected truncated entry to be not found, got: %v", err)
+	}
+
+	// truncated on a segment boundary, then appended again
+	if err := fs.DeleteRange(21, 24); err != nil {
+		t.Fatalf("failed to delete suffix: %s", err.Error())
+	}
+	checkSegments(t, dir, 2)
+	storeRange(t, fs, 21, 30)
+	fs.Close()
+
+	fs = openStore(t, dir)
+	defer fs.Close()
+	checkIndexes(t, fs, 1, 30)
+	checkEntries(t, fs, 1, 30)
+}
+
+func TestFileStoreTruncatesPartialWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fs := openStore(t, dir)
+	storeRange(t, fs, 1, 10)
+	fs.Close()
+
+	// simulates a crash in the middle of an append
+	fns, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	fd, err := os.OpenFile(fns[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("failed to open segment: %s", err.Error())
+	}
+	fd.Write([]byte{0, 0, 1, 0, 42})
+	fd.Close()
+
+	fs = openStore(t, dir)
+	defer fs.Close()
+	checkIndexes(t, fs, 1, 10)
+	storeRange(t, fs, 11, 20)
+	checkEntries(t, fs, 1, 20)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "raftstore")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	return dir
+}
+
+func openStore(t *testing.T, dir string) *FileStore {
+	fs, err := NewFileStore(dir, false)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err.Error())
+	}
+	return fs
+}
+
+func storeRange(t *testing.T, fs *FileStore, first, last uint64) {
+	logs := make([]*raft.Log, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		logs = append(logs, &raft.Log{
+			Index: i,
+			Term:  i / 10,
+			Type:  raft.LogCommand,
+			Data:  []byte(strconv.FormatUint(i, 10)),
+		})
+	}
+	if err := fs.StoreLogs(logs); err != nil {
+		t.Fatalf("failed to store logs: %s", err.Error())
+	}
+}
+
+func checkIndexes(t *testing.T, fs *FileStore, first, last uint64) {
+	f, _ := fs.FirstIndex()
+	l, _ := fs.LastIndex()
+	if f != first || l != last {
+		t.Fatalf("expected indexes [%d, %d], got [%d, %d]", first, last, f, l)
+	}
+}
+
+func checkSegments(t *testing.T, dir string, n int) {
+	fns, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(fns) != n {
+		t.Fatalf("expected %d segment files, got %d", n, len(fns))
+	}
+}
+
+func checkEntries(t *testing.T, fs *FileStore, first, last uint64) {
+	for i := first; i <= last; i++ {
+		l := &raft.Log{}
+		if err := fs.GetLog(i, l); err != nil {
+			t.Fatalf("failed to get log %d: %s", i, err.Error())
+		}
+		exp := []byte(strconv.FormatUint(i, 10))
+		if l.Index != i || l.Term != i/10 || l.Type != raft.LogCommand || !bytes.Equal(l.Data, exp) {
+			t.Fatalf("unexpected entry at index %d: %+v", i, *l)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package record implements the encoding of multi-field records, stored as a single value
+// on the key-value store. Fields are sorted by name and each one is formatted as:
+//
+//	<len(name)>:<name><len(value)>:<value>
+//
+// where lengths are decimal. The encoding is textual, so records composed of valid UTF-8
+// names and values are also valid UTF-8, as required by protobuf strings when logged.
+package record
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// ErrMalformed is returned when decoding a value that isn't an encoded record.
+var ErrMalformed = errors.New("malformed record")
+
+// Encode returns the encoding of 'fields', sorted by name.
+func Encode(fields map[string][]byte) []byte {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		buf = appendString(buf, []byte(name))
+		buf = appendString(buf, fields[name])
+	}
+	return buf
+}
+
+func appendString(buf, s []byte) []byte {
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, ':')
+	return append(buf, s...)
+}
+
+// Decode returns the fields of the encoded record 'value'. An empty value is a record with
+// no fields.
+func Decode(value []byte) (map[string][]byte, error) {
+	fields := make(map[string][]byte)
+	for len(value) > 0 {
+		name, rest, err := readString(value)
+		if err != nil {
+			return nil, err
+		}
+		val, rest, err := readString(rest)
+		if err != nil {
+			return nil, err
+		}
+		fields[string(name)] = val
+		value = rest
+	}
+	return fields, nil
+}
+
+// readString reads a length-prefixed string from 'buf', returning the remaining bytes.
+func readString(buf []byte) ([]byte, []byte, error) {
+	i := 0
+	for i < len(buf) && buf[i] >= '0' && buf[i] <= '9' {
+		i++
+	}
+	if i == 0 || i > 9 || i == len(buf) || buf[i] != ':' {
+		return nil, nil, ErrMalformed
+	}
+
+	size, _ := strconv.Atoi(string(buf[:i]))
+	buf = buf[i+1:]
+	if size > len(buf) {
+		return nil, nil, ErrMalformed
+	}
+	return buf[:size], buf[size:], nil
+}
+
+// Select returns the subset of 'fields' named on 'names', ignoring missing ones. Every
+// field is returned if 'names' is empty.
+func Select(fields map[string][]byte, names []string) map[string][]byte {
+	if len(names) == 0 {
+		return fields
+	}
+	sel := make(map[string][]byte, len(names))
+	for _, name := range names {
+		if v, ok := fields[name]; ok {
+			sel[name] = v
+		}
+	}
+	return sel
+}
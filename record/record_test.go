@@ -0,0 +1,53 @@
+package record
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRoundTrip(t *testing.T) {
+	fields := map[string][]byte{
+		"field1": []byte("bar"),
+		"field0": []byte("1:2:"),
+		"":       {},
+		"field9": []byte("ação"),
+	}
+	enc := Encode(fields)
+	if !utf8.Valid(enc) {
+		t.Fatalf("expected a valid UTF-8 encoding, got %q", enc)
+	}
+	if exp := "0:0:6:field04:1:2:6:field13:bar6:field96:ação"; string(enc) != exp {
+		t.Fatalf("expected encoding %q, got %q", exp, enc)
+	}
+
+	got, err := Decode(enc)
+	if err != nil {
+		t.Fatalf("failed to decode record: %s", err.Error())
+	}
+	if !reflect.DeepEqual(fields, got) {
+		t.Fatalf("expected %v, got %v", fields, got)
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	for _, v := range []string{"bar", "3:foo", "3:foo4:bar", ":foo", "3foo0:", "9999999999:"} {
+		if _, err := Decode([]byte(v)); err != ErrMalformed {
+			t.Fatalf("expected ErrMalformed decoding %q, got: %v", v, err)
+		}
+	}
+	if fields, err := Decode(nil); err != nil || len(fields) != 0 {
+		t.Fatalf("expected an empty record, got %v (err: %v)", fields, err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	fields := map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")}
+	exp := map[string][]byte{"a": []byte("1"), "c": []byte("3")}
+	if got := Select(fields, []string{"a", "c", "missing"}); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	if got := Select(fields, nil); !reflect.DeepEqual(fields, got) {
+		t.Fatalf("expected every field, got %v", got)
+	}
+}
@@ -22,6 +22,7 @@ var (
 	recovAddr             string
 	firstIndex, lastIndex string
 	multipleLogs          bool
+	withSnapshot          bool
 )
 
 func init() {
@@ -31,6 +32,7 @@ func init() {
 	flag.StringVar(&firstIndex, "p", "", "set the first index of requested state")
 	flag.StringVar(&lastIndex, "n", "", "set the last index of requested state")
 	flag.BoolVar(&multipleLogs, "mult", false, "inform wheter multiple logs will be returned")
+	flag.BoolVar(&withSnapshot, "snap", false, "request the latest snapshot followed by the log suffix after it")
 }
 
 func main() {
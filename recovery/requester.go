@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -65,14 +66,23 @@ func MeasureStateInstallation(replica *MockState, recvState []byte) (nCmds, dur
 	var err error
 
 	start := time.Now()
+	rd := bytes.NewReader(recvState)
+	if withSnapshot {
+		ind, err := replica.InstallSnapshotFromReader(rd)
+		if err != nil {
+			log.Fatalf("failed to install the received snapshot: %s", err.Error())
+		}
+		fmt.Println("Installed snapshot up to index:", ind)
+	}
+
 	if multipleLogs {
-		cmds, err = replica.InstallRecovStateForMultipleLogs(recvState)
+		cmds, err = replica.InstallRecovStateForMultipleLogsFromReader(rd)
 		if err != nil {
 			log.Fatalf("failed to install the received state: %s", err.Error())
 		}
 
 	} else {
-		cmds, err = replica.InstallRecovState(recvState)
+		cmds, err = replica.InstallRecovStateFromReader(rd)
 		if err != nil {
 			log.Fatalf("failed to install the received state: %s", err.Error())
 		}
@@ -87,7 +97,11 @@ func sendStateRequest(first, last string) ([]byte, error) {
 		return nil, fmt.Errorf("failed to connect to node at '%s', error: %s", recovAddr, err.Error())
 	}
 
-	reqMsg := stateConn.LocalAddr().String() + "-" + first + "-" + last + "\n"
+	reqMsg := stateConn.LocalAddr().String() + "-" + first + "-" + last
+	if withSnapshot {
+		reqMsg += "-snap"
+	}
+	reqMsg += "\n"
 	_, err = fmt.Fprint(stateConn, reqMsg)
 	if err != nil {
 		return nil, fmt.Errorf("failed sending state request to node at '%s', error: %s", recovAddr, err.Error())
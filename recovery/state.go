@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 
+	"beelog-hraft/applog"
+	"beelog-hraft/snapshot"
+
 	bl "github.com/Lz-Gustavo/beelog"
 	"github.com/Lz-Gustavo/beelog/pb"
 )
@@ -47,10 +51,42 @@ func (m *MockState) InstallRecovStateFromReader(rd io.Reader) (uint64, error) {
 		return 0, err
 	}
 
-	m.applyLog(cmds)
+	if err = m.applyLog(cmds); err != nil {
+		return 0, err
+	}
 	return uint64(len(cmds)), nil
 }
 
+// InstallSnapshotFromReader installs a snapshot preceded by a "snapshot <index> <size>" line,
+// returning its index. A zero size informs that no snapshot was transferred.
+func (m *MockState) InstallSnapshotFromReader(rd io.Reader) (uint64, error) {
+	var ind, size uint64
+	_, err := fmt.Fscanf(rd, "snapshot %d %d\n", &ind, &size)
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, nil
+	}
+
+	lr := io.LimitReader(rd, int64(size))
+	snap := make(map[string][]byte)
+	err = snapshot.Read(lr, func(key string, value []byte) error {
+		snap[key] = value
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// discard any trailing content not consumed by the decoder
+	if _, err = io.Copy(ioutil.Discard, lr); err != nil {
+		return 0, err
+	}
+	m.state = snap
+	return ind, nil
+}
+
 // InstallRecovStateForMultipleLogs ...
 func (m *MockState) InstallRecovStateForMultipleLogs(newState []byte) (uint64, error) {
 	rd := bytes.NewReader(newState)
@@ -80,22 +116,23 @@ func (m *MockState) InstallRecovStateForMultipleLogsFromReader(rd io.Reader) (ui
 		}
 
 		nCmds += uint64(len(cmds))
-		m.applyLog(cmds)
+		if err = m.applyLog(cmds); err != nil {
+			return 0, err
+		}
 	}
 	return nCmds, nil
 }
 
-// applyLog executes received commands on mock state.
-func (m *MockState) applyLog(log []pb.Command) {
-	for _, cmd := range log {
-		switch cmd.Op {
-		case pb.Command_SET:
-			m.state[cmd.Key] = []byte(cmd.Value)
-
-		default:
-			break
+// applyLog executes received commands on mock state, replayed by applog.Replay in index
+// order.
+func (m *MockState) applyLog(log []pb.Command) error {
+	return applog.Replay(log, func(_ uint64, w applog.Write) {
+		if w.Deleted {
+			delete(m.state, w.Key)
+			return
 		}
-	}
+		m.state[w.Key] = w.Value
+	})
 }
 
 // applyLogCountingDiffKeys executes received commands on mock state, returning the
@@ -111,8 +148,8 @@ func (m *MockState) applyLogCountingDiffKeys(log []pb.Command) int {
 		case pb.Command_SET:
 			m.state[cmd.Key] = []byte(cmd.Value)
 
-		case pb.Command_GET:
-			// insert an empty value to count READ operations on unique keys
+		case pb.Command_GET, pb.Command_DELETE:
+			// insert an empty value to count READ and DELETE operations on unique keys
 			m.state[cmd.Key] = []byte{}
 
 		default:
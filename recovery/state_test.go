@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"beelog-hraft/applog"
+	"beelog-hraft/snapshot"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+)
+
+func TestApplyLogDeletes(t *testing.T) {
+	m := &MockState{state: make(map[string][]byte)}
+	m.applyLog([]pb.Command{
+		{Id: 1, Op: pb.Command_SET, Key: "a", Value: "1"},
+		{Id: 2, Op: pb.Command_SET, Key: "b", Value: "2"},
+		{Id: 3, Op: pb.Command_SET, Key: "c", Value: "3"},
+		{Id: 4, Op: pb.Command_DELETE, Key: "a"},
+		applog.NewTombstone(5, "b"),
+	})
+
+	if _, ok := m.state["a"]; ok {
+		t.Fatalf("key deleted by a DELETE command still present")
+	}
+	if _, ok := m.state["b"]; ok {
+		t.Fatalf("key deleted by a tombstone SET still present")
+	}
+	if string(m.state["c"]) != "3" {
+		t.Fatalf("expected value '3', got '%s'", m.state["c"])
+	}
+}
+
+func TestApplyLogTransactions(t *testing.T) {
+	m := &MockState{state: make(map[string][]byte)}
+
+	// reduced logs are unordered, the transaction must still override the previous SET
+	err := m.applyLog([]pb.Command{
+		applog.NewTxn(5, []applog.Write{{Key: "a", Value: []byte("x")}, {Key: "b", Deleted: true}}),
+		{Id: 3, Op: pb.Command_SET, Key: "a", Value: "1"},
+		{Id: 2, Op: pb.Command_SET, Key: "b", Value: "2"},
+		{Id: 7, Op: pb.Command_SET, Key: "b", Value: "3"},
+	})
+	if err != nil {
+		t.Fatalf("failed to apply log: %s", err.Error())
+	}
+	if string(m.state["a"]) != "x" || string(m.state["b"]) != "3" || len(m.state) != 2 {
+		t.Fatalf("unexpected state after transaction: %v", m.state)
+	}
+
+	malformed := applog.NewTxn(8, nil)
+	malformed.Value = "1:a"
+	if err = m.applyLog([]pb.Command{malformed}); err != applog.ErrMalformedTxn {
+		t.Fatalf("expected ErrMalformedTxn on a malformed transaction, got: %v", err)
+	}
+}
+
+func TestInstallSnapshotSkipsMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	wr, err := snapshot.NewWriter(buf, false)
+	if err != nil {
+		t.Fatalf("failed to create snapshot writer: %s", err.Error())
+	}
+	wr.Write("a", []byte("1"))
+	wr.WriteSection(snapshot.Section(1), "7", []byte("metadata"))
+	wr.WriteSection(snapshot.Section(2), "a", []byte("metadata"))
+	if err = wr.Close(); err != nil {
+		t.Fatalf("failed to close snapshot writer: %s", err.Error())
+	}
+
+	m := &MockState{state: make(map[string][]byte)}
+	rd := bytes.NewBufferString(fmt.Sprintf("snapshot 5 %d\n", buf.Len()))
+	rd.Write(buf.Bytes())
+	ind, err := m.InstallSnapshotFromReader(rd)
+	if err != nil || ind != 5 {
+		t.Fatalf("failed to install snapshot at index 5, got %d (err: %v)", ind, err)
+	}
+	if string(m.state["a"]) != "1" || len(m.state) != 1 {
+		t.Fatalf("expected only the key-value state installed, got %v", m.state)
+	}
+}
@@ -1,108 +1,171 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net"
-	"os"
+	"net/http"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
+
+	"beelog-hraft/kvpb"
 )
 
 // Server stores the state between every client
 type Server struct {
-	clients  []*Session
-	joins    chan net.Conn
-	incoming chan *Request
-
-	t          *time.Timer
-	req        uint64
-	throughput *os.File
-	kvstore    *Store
+	clients map[*Session]struct{}
+	mu      sync.Mutex // guards clients
+	joins   chan net.Conn
+
+	// maxSessions bounds the number of connected sessions, and idleTimeout disconnects
+	// sessions not sending requests. Zero disables any of them.
+	maxSessions int
+	idleTimeout time.Duration
+
+	// quit stops every session from consuming new requests, while 'pipelines' tracks those
+	// still replying in-flight ones.
+	quit      chan struct{}
+	pipelines sync.WaitGroup
+
+	// inflight bounds the number of proposals in flight from every session
+	inflight chan struct{}
+
+	kvstore *Store
+
+	// admin serves the admin HTTP endpoint, nil if disabled
+	admin *http.Server
 }
 
 // NewServer constructs and starts a new Server
 func NewServer(ctx context.Context, s *Store) *Server {
 	svr := &Server{
-		clients:  make([]*Session, 0),
-		joins:    make(chan net.Conn),
-		incoming: make(chan *Request),
-		req:      0,
-		kvstore:  s,
-		t:        time.NewTimer(time.Second),
+		clients:     make(map[*Session]struct{}),
+		joins:       make(chan net.Conn),
+		maxSessions: *maxSessions,
+		idleTimeout: *idleTimeout,
+		quit:        make(chan struct{}),
+		inflight:    make(chan struct{}, *maxInflight),
+		kvstore:     s,
 	}
 
-	svr.throughput = createWriteFile(svrID+"-throughput.out", false)
 	go svr.Listen(ctx)
-	go svr.monitor(ctx)
 	return svr
 }
 
-// Exit closes the raft context and releases any resources allocated
+// Exit stops consuming new requests and waits for the in-flight ones to be replied, up to
+// 'raftTimeout', then closes the raft context and releases any resources allocated
 func (svr *Server) Exit() {
-	svr.kvstore.raft.Shutdown()
+	close(svr.quit)
+	drained := make(chan struct{})
+	go func() {
+		svr.pipelines.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(raftTimeout):
+		svr.kvstore.logger.Warn("Exiting with in-flight requests not yet replied")
+	}
+
+	if svr.admin != nil {
+		svr.admin.Close()
+	}
+	svr.kvstore.stopAdvertising()
+	svr.kvstore.raft.Shutdown().Error()
+	svr.kvstore.transport.Close()
+	if c, ok := svr.kvstore.logStore.(io.Closer); ok {
+		c.Close()
+	}
 	if svr.kvstore.Logging == DiskTrad {
 		svr.kvstore.LogFile.Close()
 	}
-	for _, v := range svr.clients {
+	svr.kvstore.m.Close()
+	for _, v := range svr.sessions() {
 		v.Disconnect()
 	}
 }
 
-// Broadcast sends a message to every other client on the room
+// Broadcast sends a message to every other client on the room, as a reply to no
+// particular request (i.e. request ID zero)
 func (svr *Server) Broadcast(data string) {
-	for _, client := range svr.clients {
-		client.outgoing <- data
+	for _, client := range svr.sessions() {
+		client.Reply(0, data)
+	}
+}
+
+// sessions returns every connected session.
+func (svr *Server) sessions() []*Session {
+	svr.mu.Lock()
+	defer svr.mu.Unlock()
+	clients := make([]*Session, 0, len(svr.clients))
+	for c := range svr.clients {
+		clients = append(clients, c)
 	}
+	return clients
 }
 
 // SendUDP sends a UDP repply to a client listening on 'addr'
-func (svr *Server) SendUDP(addr string, message string) {
-	conn, _ := net.Dial("udp", addr)
+func (svr *Server) SendUDP(addr string, message string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
-	conn.Write([]byte(message))
+	_, err = conn.Write([]byte(message))
+	return err
 }
 
-// HandleRequest handles the client requistion, checking if it matches the right syntax
-// before proposing it to the FSM
-func (svr *Server) HandleRequest(cmd *Request) {
-	data := bytes.TrimSuffix(cmd.Command, []byte("\n"))
-	if err := svr.kvstore.Propose(data, svr, cmd.IP); err != nil {
-		svr.kvstore.logger.Error(fmt.Sprintf("Failed to propose message: %q, error: %s\n", data, err.Error()))
+// reply informs 'msg' to the client that originated 'cmd', either written back on its
+// session or through a UDP repply, following the requested reply mode.
+func (svr *Server) reply(origin *Request, cmd *kvpb.Command, msg string) error {
+	if origin == nil {
+		return nil
+	}
+	if cmd.Reply == kvpb.Command_SESSION && origin.Session != nil {
+		return origin.Session.Reply(cmd.ReqId, msg)
 	}
-	atomic.AddUint64(&svr.req, 1)
+	return svr.SendUDP(origin.IP+":"+cmd.Ip, msg+"\n")
 }
 
-// Join threats a join requisition from clients to the Server state
+// Join threats a join requisition from clients to the Server state. Connections exceeding
+// 'maxSessions' are refused.
 func (svr *Server) Join(ctx context.Context, connection net.Conn) {
-	client := NewSession(connection)
-	svr.clients = append(svr.clients, client)
+	svr.mu.Lock()
+	if svr.maxSessions > 0 && len(svr.clients) >= svr.maxSessions {
+		svr.mu.Unlock()
+		svr.kvstore.logger.Warn(fmt.Sprintf("Refused client '%s', too many sessions", connection.RemoteAddr()))
+		connection.Close()
+		return
+	}
+	client := NewSession(connection, svr.idleTimeout)
+	svr.clients[client] = struct{}{}
+	svr.mu.Unlock()
+	sessionsGauge.Add(1)
+
 	svr.kvstore.logger.Info("New client connected!")
+	svr.pipeline(ctx, client)
+}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case data := <-client.incoming:
-				svr.incoming <- data
-			}
-		}
-	}()
+// leave removes a session whose pipeline is finished.
+func (svr *Server) leave(client *Session) {
+	svr.mu.Lock()
+	delete(svr.clients, client)
+	svr.mu.Unlock()
+	sessionsGauge.Add(-1)
+	client.Close()
 }
 
-// Listen receives incoming messagens and new connections from clients
+// Listen receives new connections from clients, each one served by its own pipeline
 func (svr *Server) Listen(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 
-		case data := <-svr.incoming:
-			svr.HandleRequest(data)
+		case <-svr.quit:
+			return
 
 		case conn := <-svr.joins:
 			svr.Join(ctx, conn)
@@ -110,21 +173,6 @@ func (svr *Server) Listen(ctx context.Context) {
 	}
 }
 
-func (svr *Server) monitor(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-
-		case <-svr.t.C:
-			cont := atomic.SwapUint64(&svr.req, 0)
-			//svr.kvstore.logger.Info(fmt.Sprintf("Thoughput(cmds/s): %d", cont))
-			svr.throughput.WriteString(fmt.Sprintf("%v\n", cont))
-			svr.t.Reset(time.Second)
-		}
-	}
-}
-
 // Legacy code, used only on ad-hoc message formats.
 func validateReq(requisition string) bool {
 	requisition = strings.ToLower(requisition)
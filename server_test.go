@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"beelog-hraft/kvpb"
+	"beelog-hraft/wire"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestSessionLifecycle(t *testing.T) {
+	s := startClusterNode(t, "node0", freeAddr(t), "", true)
+	defer stopClusterNode(s)
+	waitLeader(t, s)
+
+	t.Run("NoGoroutineLeak", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		svr := startTestServer(ctx, s)
+		base := runtime.NumGoroutine()
+
+		conns := make([]net.Conn, 20)
+		for i := range conns {
+			srvConn, cliConn := net.Pipe()
+			svr.joins <- srvConn
+			conns[i] = cliConn
+		}
+		for i, conn := range conns {
+			if rep := sendOnConn(t, conn, uint64(i+1)); rep != "OK: " {
+				t.Fatalf("unexpected reply: %q", rep)
+			}
+		}
+		if n := len(svr.sessions()); n != len(conns) {
+			t.Fatalf("expected %d sessions, got %d", len(conns), n)
+		}
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+		waitFor(t, "sessions to be removed", func() bool {
+			return len(svr.sessions()) == 0
+		})
+		waitFor(t, "session goroutines to finish", func() bool {
+			return runtime.NumGoroutine() <= base
+		})
+	})
+
+	t.Run("IdleTimeout", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		svr := startTestServer(ctx, s)
+		svr.idleTimeout = 200 * time.Millisecond
+
+		srvConn, conn := net.Pipe()
+		svr.joins <- srvConn
+		defer conn.Close()
+		if rep := sendOnConn(t, conn, 1); rep != "OK: " {
+			t.Fatalf("unexpected reply: %q", rep)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := wire.ReadFrame(conn); err != io.EOF {
+			t.Fatalf("expected idle session to be closed, got: %v", err)
+		}
+		waitFor(t, "idle session to be removed", func() bool {
+			return len(svr.sessions()) == 0
+		})
+	})
+
+	t.Run("MaxSessions", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		svr := startTestServer(ctx, s)
+		svr.maxSessions = 1
+
+		srvConn, conn := net.Pipe()
+		svr.joins <- srvConn
+		defer conn.Close()
+
+		srvRefused, refused := net.Pipe()
+		svr.joins <- srvRefused
+		refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := wire.ReadFrame(refused); err != io.EOF {
+			t.Fatalf("expected session over the limit to be refused, got: %v", err)
+		}
+
+		if rep := sendOnConn(t, conn, 1); rep != "OK: " {
+			t.Fatalf("unexpected reply: %q", rep)
+		}
+	})
+}
+
+func TestExitDrainsInflightRequests(t *testing.T) {
+	s := startClusterNode(t, "node0", freeAddr(t), "", true)
+	defer os.RemoveAll(s.RaftDir)
+	waitLeader(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svr := startTestServer(ctx, s)
+	replied := requestsTotal.Value()
+
+	srvConn, conn := net.Pipe()
+	svr.joins <- srvConn
+	defer conn.Close()
+
+	// replies aren't consumed until Exit is called, keeping requests in flight
+	const numReqs = 3
+	for i := 1; i <= numReqs; i++ {
+		cmd := &kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar", ReqId: uint64(i), Reply: kvpb.Command_SESSION}
+		raw, _ := proto.Marshal(cmd)
+		if err := wire.WriteFrame(conn, wire.MsgCommand, raw); err != nil {
+			t.Fatalf("failed to send command: %s", err.Error())
+		}
+	}
+	// the first reply is already handed to the session, blocked writing it
+	waitFor(t, "requests to be in flight", func() bool {
+		return requestsTotal.Value() == replied+1 && len(svr.inflight) == numReqs-1
+	})
+
+	exited := make(chan struct{})
+	go func() {
+		svr.Exit()
+		close(exited)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 1; i <= numReqs; i++ {
+		typ, payload, err := wire.ReadFrame(conn)
+		if err != nil || typ != wire.MsgReply {
+			t.Fatalf("failed to read reply %d, type %d, err: %v", i, typ, err)
+		}
+		if id, rep, _ := wire.DecodeReply(payload); id != uint64(i) || string(rep) != "OK: " {
+			t.Fatalf("expected reply %d \"OK: \", got %d %q", i, id, rep)
+		}
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Exit never returned after draining requests")
+	}
+	if _, _, err := wire.ReadFrame(conn); err != io.EOF {
+		t.Fatalf("expected session to be closed after Exit, got: %v", err)
+	}
+}
+
+// sendOnConn sends a SET command with request ID 'id' on a client connection, returning its
+// reply.
+func sendOnConn(t *testing.T, conn net.Conn, id uint64) string {
+	cmd := &kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar", ReqId: id, Reply: kvpb.Command_SESSION}
+	raw, _ := proto.Marshal(cmd)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if err := wire.WriteFrame(conn, wire.MsgCommand, raw); err != nil {
+		t.Fatalf("failed to send command: %s", err.Error())
+	}
+	typ, payload, err := wire.ReadFrame(conn)
+	if err != nil || typ != wire.MsgReply {
+		t.Fatalf("failed to read reply, type %d, err: %v", typ, err)
+	}
+	_, rep, _ := wire.DecodeReply(payload)
+	return string(rep)
+}
+
+// waitFor polls 'cond' until it's satisfied, failing after 5 seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
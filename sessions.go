@@ -2,48 +2,62 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"io"
+	"fmt"
 	"net"
 	"strings"
-)
+	"sync"
+	"time"
 
-var (
-	// Any ocurrence of 'closeToken' signals a leaving client, gently stopping
-	// goroutines and releasing acquired resources.
-	closeToken = []byte("-CLOSE\n")
+	"beelog-hraft/wire"
 )
 
 // Request struct represents received requests to the KVstore service.
 type Request struct {
 	Command []byte
 	IP      string
+	Session *Session // originating session, where replies are written back
 }
 
 // Session struct represents each active client session connected on the cluster.
 type Session struct {
 	incoming chan *Request
-	outgoing chan string
+	outgoing chan []byte // marshaled frames
 	reader   *bufio.Reader
 	writer   *bufio.Writer
 	conn     net.Conn
+	ctx      context.Context
 	cancel   context.CancelFunc
+
+	// idle is the maximum time waiting for a new request before disconnecting, or zero if
+	// the session never times out. Sessions holding watches never time out, since they're
+	// expected to only receive notifications.
+	idle     time.Duration
+	idleMu   sync.Mutex
+	watching int
+
+	// closing gracefully disconnects the session once every pending reply is written.
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
-// NewSession instantiates a new client.
-func NewSession(connection net.Conn) *Session {
+// NewSession instantiates a new client, disconnected after 'idle' without sending requests.
+// Zero disables the idle timeout.
+func NewSession(connection net.Conn, idle time.Duration) *Session {
 	reader := bufio.NewReader(connection)
 	writer := bufio.NewWriter(connection)
 	ctx, c := context.WithCancel(context.Background())
 
 	client := &Session{
 		incoming: make(chan *Request),
-		outgoing: make(chan string),
+		outgoing: make(chan []byte),
 		reader:   reader,
 		writer:   writer,
 		conn:     connection,
+		ctx:      ctx,
 		cancel:   c,
+		idle:     idle,
+		closing:  make(chan struct{}),
 	}
 	client.Listen(ctx)
 	return client
@@ -56,20 +70,31 @@ func (client *Session) Read(ctx context.Context) {
 			return
 
 		default:
-			line, err := client.reader.ReadBytes('\n')
-			if err == nil && len(line) > 1 {
-				if bytes.Contains(line, closeToken) {
-					client.Disconnect()
-					return
-				}
-
-				ip := client.conn.RemoteAddr().String()
-				ipContent := strings.Split(ip, ":")
-				newRequest := &Request{line, ipContent[0]}
-				client.incoming <- newRequest
-
-			} else if err == io.EOF {
+			// a malformed frame cannot be skipped, since the stream is no longer aligned
+			// with frame boundaries. A MsgClose gently stops goroutines and releases
+			// acquired resources.
+			client.idleMu.Lock()
+			client.resetIdle()
+			client.idleMu.Unlock()
+
+			typ, payload, err := wire.ReadFrame(client.reader)
+			if err != nil || typ == wire.MsgClose {
+				client.Disconnect()
+				return
+			}
+			if typ != wire.MsgCommand {
+				continue
+			}
+
+			ip := client.conn.RemoteAddr().String()
+			ipContent := strings.Split(ip, ":")
+			newRequest := &Request{payload, ipContent[0], client}
+
+			// blocks while the server pipeline is full, applying backpressure on the client
+			select {
+			case <-ctx.Done():
 				return
+			case client.incoming <- newRequest:
 			}
 		}
 	}
@@ -81,12 +106,65 @@ func (client *Session) Write(ctx context.Context) {
 		case <-ctx.Done():
 			return
 
-		case data := <-client.outgoing:
-			client.writer.WriteString(data)
+		// replies are handed over unbuffered, so any reply sent before Close is already
+		// flushed
+		case <-client.closing:
+			client.Disconnect()
+			return
+
+		case frame := <-client.outgoing:
+			client.writer.Write(frame)
+			if err := client.writer.Flush(); err != nil {
+				client.Disconnect()
+				return
+			}
 		}
 	}
 }
 
+// Reply writes a response to request 'id' back on the session, as a wire.MsgReply frame.
+// Returns an error if the session is already disconnected.
+func (client *Session) Reply(id uint64, data string) error {
+	frame := wire.Marshal(wire.MsgReply, wire.EncodeReply(id, []byte(data)))
+	select {
+	case <-client.ctx.Done():
+		return fmt.Errorf("session with '%s' is closed", client.conn.RemoteAddr())
+
+	case client.outgoing <- frame:
+		return nil
+	}
+}
+
+// addWatch registers a watch notified on the session, disabling the idle timeout until
+// every watch is removed.
+func (client *Session) addWatch() {
+	client.idleMu.Lock()
+	defer client.idleMu.Unlock()
+	client.watching++
+	client.resetIdle()
+}
+
+// removeWatch unregisters a watch added by addWatch.
+func (client *Session) removeWatch() {
+	client.idleMu.Lock()
+	defer client.idleMu.Unlock()
+	client.watching--
+	client.resetIdle()
+}
+
+// resetIdle restarts the idle timeout, or disables it while the session holds watches.
+// Must hold 'idleMu'.
+func (client *Session) resetIdle() {
+	if client.idle == 0 {
+		return
+	}
+	if client.watching > 0 {
+		client.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	client.conn.SetReadDeadline(time.Now().Add(client.idle))
+}
+
 // Listen launches Read and Write for every new client connected, async.
 // sending/receiving messages following publish/subscriber pattern
 func (client *Session) Listen(ctx context.Context) {
@@ -94,6 +172,13 @@ func (client *Session) Listen(ctx context.Context) {
 	go client.Write(ctx)
 }
 
+// Close disconnects the session after writing any reply already sent through Reply.
+func (client *Session) Close() {
+	client.closeOnce.Do(func() {
+		close(client.closing)
+	})
+}
+
 // Disconnect cancels the active context, consequently halting all active goroutines.
 func (client *Session) Disconnect() {
 	client.cancel()
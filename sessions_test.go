@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"beelog-hraft/kvpb"
+	"beelog-hraft/wire"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// TestSessionBinaryCommands sends commands with binary keys and values through a session,
+// as raw frames. Escaped ones must be applied intact, while unescaped ones with invalid
+// UTF-8 must be replied with an error, keeping the session usable.
+func TestSessionBinaryCommands(t *testing.T) {
+	s := startClusterNode(t, "node0", freeAddr(t), "", true)
+	defer stopClusterNode(s)
+	waitLeader(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svr := startTestServer(ctx, s)
+
+	srvConn, conn := net.Pipe()
+	svr.joins <- srvConn
+	defer conn.Close()
+
+	var reqID uint64
+	send := func(raw []byte) (uint64, string) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := wire.WriteFrame(conn, wire.MsgCommand, raw); err != nil {
+			t.Fatalf("failed to send command: %s", err.Error())
+		}
+		typ, payload, err := wire.ReadFrame(conn)
+		if err != nil || typ != wire.MsgReply {
+			t.Fatalf("failed to read reply, type %d, err: %v", typ, err)
+		}
+		id, rep, _ := wire.DecodeReply(payload)
+		return id, string(rep)
+	}
+
+	pairs := []struct{ key, value []byte }{
+		{[]byte("foo"), []byte("bar")},
+		{[]byte("\n"), []byte("0123456789")}, // encodes a 0x0A value length
+		{[]byte{0x0A, 0x0A}, []byte{}},
+		{[]byte{0xFF, 0x00}, []byte{0x1F, 0x8B, 0x80}},
+		{[]byte("chave"), []byte("ação")},
+		{[]byte("truncated"), []byte{0x61, 0xC3}},
+		{[]byte{0xED, 0xA0, 0x80}, []byte("surrogate")},
+	}
+	for _, p := range pairs {
+		// unescaped pairs are framed by hand, since proto.Marshal rejects invalid UTF-8
+		reqID++
+		raw, _ := proto.Marshal(&kvpb.Command{Op: pb.Command_SET, ReqId: reqID, Reply: kvpb.Command_SESSION})
+		buf := proto.NewBuffer(raw)
+		buf.EncodeVarint(4<<3 | proto.WireBytes)
+		buf.EncodeRawBytes(p.key)
+		buf.EncodeVarint(5<<3 | proto.WireBytes)
+		buf.EncodeRawBytes(p.value)
+
+		id, rep := send(buf.Bytes())
+		if id != reqID {
+			t.Fatalf("expected reply to request %d, got %d", reqID, id)
+		}
+		if utf8.Valid(p.key) && utf8.Valid(p.value) {
+			if rep != "OK: " {
+				t.Fatalf("expected SET of valid key %q applied, got: %q", p.key, rep)
+			}
+		} else if !strings.HasPrefix(rep, "OK: "+errMalformedCommand) {
+			t.Fatalf("expected SET of key %q value %q rejected, got: %q", p.key, p.value, rep)
+		}
+
+		reqID++
+		key, value := wire.Escape(p.key), wire.Escape(p.value)
+		raw, _ = proto.Marshal(&kvpb.Command{Op: pb.Command_SET, Key: key, Value: value, ReqId: reqID, Reply: kvpb.Command_SESSION})
+		if _, rep = send(raw); rep != "OK: " {
+			t.Fatalf("expected SET of escaped key %q applied, got: %q", key, rep)
+		}
+
+		reqID++
+		raw, _ = proto.Marshal(&kvpb.Command{Op: pb.Command_GET, Key: key, ReqId: reqID, Reply: kvpb.Command_SESSION})
+		_, rep = send(raw)
+		got, err := wire.Unescape(strings.TrimPrefix(rep, "OK: "))
+		if err != nil || string(got) != string(p.value) {
+			t.Fatalf("expected value %q for key %q, got %q (err: %v)", p.value, p.key, got, err)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Package snapshot implements the binary snapshot format of the key-value store, streaming
+// key-value pairs in length-prefixed chunks instead of encoding the entire state at once.
+//
+// A snapshot starts with a header composed of a 4 byte magic, a version byte and a flags
+// byte. Following the header, possibly gzip compressed, a sequence of chunks is written,
+// each one formatted as:
+//
+//	[u32 len][u32 crc32][entries]
+//
+// where every entry is a section byte followed by an uvarint length-prefixed key and an
+// uvarint length-prefixed value. Entries on the State section hold the key-value state,
+// while any other section holds metadata defined by the application, skipped by Read. A
+// zero length chunk marks the end of the snapshot. Version 1 snapshots carry no section
+// byte, every entry holding state, and snapshots lacking the header are interpreted as the
+// legacy JSON encoding of the entire map.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// Version is the latest snapshot format version, written on every new snapshot.
+	Version byte = 2
+
+	// State is the section of key-value pairs holding the key-value state.
+	State Section = 0
+
+	// flagGzip informs that chunks are gzip compressed.
+	flagGzip byte = 1 << 0
+
+	// approximate size of each chunk, entries larger than it are written on a chunk
+	// of their own.
+	chunkSize = 1 << 20
+
+	// chunk header: entries len and crc32 checksum, each 32b BigEndian.
+	chunkHeaderSize = 8
+)
+
+// Section tags each snapshot entry, so that metadata written along the key-value state never
+// collides with keys.
+type Section byte
+
+var (
+	magic = []byte("BLSN")
+
+	errCorrupted = errors.New("corrupted snapshot chunk")
+)
+
+// Writer streams key-value pairs into a snapshot, flushing a new chunk to the underlying
+// writer whenever the configured chunk size is reached.
+type Writer struct {
+	dst   io.Writer
+	gz    *gzip.Writer
+	chunk bytes.Buffer
+	hdr   [chunkHeaderSize]byte
+	lenb  [binary.MaxVarintLen64]byte
+}
+
+// NewWriter writes the snapshot header on 'w', returning a Writer for the snapshot
+// entries. If 'compress' is set, chunks are gzip compressed.
+func NewWriter(w io.Writer, compress bool) (*Writer, error) {
+	var flags byte
+	if compress {
+		flags |= flagGzip
+	}
+
+	hdr := append(append([]byte{}, magic...), Version, flags)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	sw := &Writer{dst: w}
+	if compress {
+		sw.gz = gzip.NewWriter(w)
+		sw.dst = sw.gz
+	}
+	return sw, nil
+}
+
+// Write appends a new key-value pair of the key-value state into the snapshot.
+func (w *Writer) Write(key string, value []byte) error {
+	return w.WriteSection(State, key, value)
+}
+
+// WriteSection appends a new key-value pair on section 'sec' into the snapshot.
+func (w *Writer) WriteSection(sec Section, key string, value []byte) error {
+	w.chunk.WriteByte(byte(sec))
+	n := binary.PutUvarint(w.lenb[:], uint64(len(key)))
+	w.chunk.Write(w.lenb[:n])
+	w.chunk.WriteString(key)
+
+	n = binary.PutUvarint(w.lenb[:], uint64(len(value)))
+	w.chunk.Write(w.lenb[:n])
+	w.chunk.Write(value)
+
+	if w.chunk.Len() >= chunkSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// Close flushes any pending entries and writes the end of the snapshot. It does not
+// close the underlying writer.
+func (w *Writer) Close() error {
+	if w.chunk.Len() > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	// end marker
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+func (w *Writer) flush() error {
+	binary.BigEndian.PutUint32(w.hdr[0:4], uint32(w.chunk.Len()))
+	binary.BigEndian.PutUint32(w.hdr[4:8], crc32.ChecksumIEEE(w.chunk.Bytes()))
+	if _, err := w.dst.Write(w.hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.dst.Write(w.chunk.Bytes()); err != nil {
+		return err
+	}
+	w.chunk.Reset()
+	return nil
+}
+
+// Read decodes the snapshot from 'r', calling 'fn' for each key-value pair of the key-value
+// state, skipping any other section. Values informed to 'fn' are not reused by later calls.
+// Both the binary format and the legacy JSON encoding are supported.
+func Read(r io.Reader, fn func(key string, value []byte) error) error {
+	return ReadSections(r, func(sec Section, key string, value []byte) error {
+		if sec != State {
+			return nil
+		}
+		return fn(key, value)
+	})
+}
+
+// ReadSections decodes the snapshot from 'r' as Read does, but calling 'fn' for the entries
+// of every section.
+func ReadSections(r io.Reader, fn func(sec Section, key string, value []byte) error) error {
+	rd := bufio.NewReader(r)
+	hdr, err := rd.Peek(len(magic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.Equal(hdr, magic) {
+		return readJSON(rd, fn)
+	}
+
+	if _, err = rd.Discard(len(magic)); err != nil {
+		return err
+	}
+	var ver, flags byte
+	if ver, err = rd.ReadByte(); err != nil {
+		return err
+	}
+	if ver > Version {
+		return fmt.Errorf("unsupported snapshot version %d", ver)
+	}
+	if flags, err = rd.ReadByte(); err != nil {
+		return err
+	}
+
+	if flags&flagGzip != 0 {
+		gz, err := gzip.NewReader(rd)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return readChunks(bufio.NewReader(gz), ver, fn)
+	}
+	return readChunks(rd, ver, fn)
+}
+
+func readChunks(rd io.Reader, ver byte, fn func(sec Section, key string, value []byte) error) error {
+	var (
+		hdr   [chunkHeaderSize]byte
+		chunk []byte
+	)
+	for {
+		if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+			return unexpected(err)
+		}
+		size := binary.BigEndian.Uint32(hdr[0:4])
+		if size == 0 {
+			return nil
+		}
+
+		if uint32(cap(chunk)) < size {
+			chunk = make([]byte, size)
+		}
+		chunk = chunk[:size]
+		if _, err := io.ReadFull(rd, chunk); err != nil {
+			return unexpected(err)
+		}
+		if crc32.ChecksumIEEE(chunk) != binary.BigEndian.Uint32(hdr[4:8]) {
+			return errCorrupted
+		}
+
+		if err := readEntries(chunk, ver, fn); err != nil {
+			return err
+		}
+	}
+}
+
+func readEntries(chunk []byte, ver byte, fn func(sec Section, key string, value []byte) error) error {
+	for len(chunk) > 0 {
+		// version 1 entries carry no section, all of them holding state
+		sec := State
+		if ver > 1 {
+			sec, chunk = Section(chunk[0]), chunk[1:]
+		}
+		key, rest, err := readField(chunk)
+		if err != nil {
+			return err
+		}
+		value, rest, err := readField(rest)
+		if err != nil {
+			return err
+		}
+		chunk = rest
+
+		// copies the value, since the chunk buffer is reused
+		if err = fn(sec, string(key), append([]byte(nil), value...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readField(buf []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < l {
+		return nil, nil, errCorrupted
+	}
+	return buf[n : n+int(l)], buf[n+int(l):], nil
+}
+
+// readJSON decodes the legacy snapshot format, a JSON encoded map of the entire state.
+func readJSON(rd io.Reader, fn func(sec Section, key string, value []byte) error) error {
+	o := make(map[string][]byte)
+	if err := json.NewDecoder(rd).Decode(&o); err != nil {
+		return err
+	}
+	for k, v := range o {
+		if err := fn(State, k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	// enough entries to span multiple chunks
+	state := make(map[string][]byte)
+	value := []byte(strings.Repeat("!", 1024))
+	for i := 0; i < 3000; i++ {
+		state[strconv.Itoa(i)] = value
+	}
+	state["empty"] = []byte{}
+
+	for _, compress := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		writeState(t, buf, state, compress)
+
+		got := readState(t, buf)
+		if len(got) != len(state) {
+			t.Fatalf("compress %v: expected %d keys, got %d", compress, len(state), len(got))
+		}
+		for k, v := range state {
+			if !bytes.Equal(got[k], v) {
+				t.Fatalf("compress %v: unexpected value for key '%s'", compress, k)
+			}
+		}
+	}
+}
+
+func TestSections(t *testing.T) {
+	buf := &bytes.Buffer{}
+	wr, err := NewWriter(buf, false)
+	if err != nil {
+		t.Fatalf("failed to create writer: %s", err.Error())
+	}
+	// the same key on different sections never collides
+	entries := []struct {
+		sec   Section
+		key   string
+		value string
+	}{
+		{State, "foo", "bar"},
+		{Section(1), "foo", "meta"},
+		{Section(2), "1", "lease"},
+		{State, "1", "baz"},
+	}
+	for _, e := range entries {
+		if err = wr.WriteSection(e.sec, e.key, []byte(e.value)); err != nil {
+			t.Fatalf("failed to write entry: %s", err.Error())
+		}
+	}
+	if err = wr.Close(); err != nil {
+		t.Fatalf("failed to close writer: %s", err.Error())
+	}
+	raw := buf.Bytes()
+
+	got := readState(t, bytes.NewReader(raw))
+	if len(got) != 2 || string(got["foo"]) != "bar" || string(got["1"]) != "baz" {
+		t.Fatalf("expected only the state section read, got %v", got)
+	}
+
+	i := 0
+	err = ReadSections(bytes.NewReader(raw), func(sec Section, key string, value []byte) error {
+		if e := entries[i]; sec != e.sec || key != e.key || string(value) != e.value {
+			t.Fatalf("expected entry %v, got %d %q %q", e, sec, key, value)
+		}
+		i++
+		return nil
+	})
+	if err != nil || i != len(entries) {
+		t.Fatalf("expected %d entries, read %d (err: %v)", len(entries), i, err)
+	}
+}
+
+func TestReadVersion1(t *testing.T) {
+	// entries carry no section on version 1 snapshots
+	var chunk []byte
+	for _, field := range []string{"\x00foo", "bar"} {
+		chunk = append(chunk, byte(len(field)))
+		chunk = append(chunk, field...)
+	}
+	raw := append(append([]byte{}, magic...), 1, 0)
+	var hdr [chunkHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(chunk)))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(chunk))
+	raw = append(append(raw, hdr[:]...), chunk...)
+	raw = append(raw, make([]byte, chunkHeaderSize)...)
+
+	got := readState(t, bytes.NewReader(raw))
+	if len(got) != 1 || string(got["\x00foo"]) != "bar" {
+		t.Fatalf("unexpected state decoded from a version 1 snapshot: %v", got)
+	}
+}
+
+func TestReadLegacyJSON(t *testing.T) {
+	state := map[string][]byte{"foo": []byte("bar"), "baz": []byte("qux")}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		t.Fatalf("failed to marshal state: %s", err.Error())
+	}
+
+	got := readState(t, bytes.NewReader(raw))
+	if len(got) != 2 || string(got["foo"]) != "bar" || string(got["baz"]) != "qux" {
+		t.Fatalf("unexpected state decoded from JSON: %v", got)
+	}
+}
+
+func TestReadRejectsInvalidSnapshots(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeState(t, buf, map[string][]byte{"foo": []byte("bar")}, false)
+	raw := buf.Bytes()
+
+	future := append([]byte{}, raw...)
+	future[len(magic)] = Version + 1
+
+	corrupted := append([]byte{}, raw...)
+	corrupted[len(raw)-chunkHeaderSize-2] ^= 0xFF
+
+	truncated := raw[:len(raw)-chunkHeaderSize]
+
+	for name, snap := range map[string][]byte{"future": future, "corrupted": corrupted, "truncated": truncated} {
+		err := Read(bytes.NewReader(snap), func(string, []byte) error { return nil })
+		if err == nil {
+			t.Fatalf("expected an error when reading a %s snapshot", name)
+		}
+	}
+}
+
+func writeState(t *testing.T, buf *bytes.Buffer, state map[string][]byte, compress bool) {
+	wr, err := NewWriter(buf, compress)
+	if err != nil {
+		t.Fatalf("failed to create writer: %s", err.Error())
+	}
+	for k, v := range state {
+		if err = wr.Write(k, v); err != nil {
+			t.Fatalf("failed to write entry: %s", err.Error())
+		}
+	}
+	if err = wr.Close(); err != nil {
+		t.Fatalf("failed to close writer: %s", err.Error())
+	}
+}
+
+func readState(t *testing.T, rd io.Reader) map[string][]byte {
+	got := make(map[string][]byte)
+	err := Read(rd, func(key string, value []byte) error {
+		got[key] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %s", err.Error())
+	}
+	return got
+}
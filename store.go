@@ -6,19 +6,27 @@ import (
 	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"beelog-hraft/engine"
+	"beelog-hraft/kvpb"
+	"beelog-hraft/metrics"
+	"beelog-hraft/raftstore"
+
 	bl "github.com/Lz-Gustavo/beelog"
 	"github.com/Lz-Gustavo/beelog/pb"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 )
@@ -53,50 +61,44 @@ const (
 	BeelogConcTable
 )
 
+var logStrategyNames = [...]string{
+	"NotLog", "DiskTrad", "InmemTrad", "BeelogList", "BeelogArray", "BeelogAVL",
+	"BeelogCircBuffer", "BeelogConcTable",
+}
+
+func (ls LogStrategy) String() string {
+	if ls < 0 || int(ls) >= len(logStrategyNames) {
+		return fmt.Sprintf("LogStrategy(%d)", ls)
+	}
+	return logStrategyNames[ls]
+}
+
 const (
 	retainSnapshotCount = 2
 	raftTimeout         = 10 * time.Second
-	logLevel            = "INFO"
-	compressValues      = false
+	readIndexPoll       = 100 * time.Microsecond
 
-	preInitialize = true
-	numInitKeys   = 1000000
-	initValueSize = 1024
-
-	// Used in catastrophic fault models, where crash faults must be recoverable even if
-	// all nodes presented in the consensus cluster are down. Always set to false in any
-	// other cases, because this strong assumption greatly degradates performance.
-	catastrophicFaults = false
-
-	// defaultLogStrategy is overwritten to 'DiskTrad' if '-logfolder' flag is provided.
-	defaultLogStrategy = BeelogConcTable
-
-	// beelog configuration, ignored if 'defaultLogStrategy' isnt 'Beelog*'
-	beelogTick   = bl.Interval
-	beelogInmem  = false
-	beelogPeriod = 4000 // ignored if not Interval on 'beelogTick'
+	// maxScanCount bounds the pairs replied to a single SCAN, regardless of its 'Count'
+	maxScanCount = 10000
 )
 
-var (
-	initValue = []byte(strings.Repeat("!", initValueSize))
-)
-
-// Custom configuration over default for testing
+// Custom configuration over default for testing. Snapshots are disabled in practice unless
+// '-snapinterval' and '-snapthreshold' are informed.
 func configRaft() *raft.Config {
 	config := raft.DefaultConfig()
-	config.SnapshotInterval = 24 * time.Hour
-	config.SnapshotThreshold = 2 << 62
-	config.LogLevel = logLevel
+	config.SnapshotInterval = *snapInterval
+	config.SnapshotThreshold = *snapThreshold
+	config.LogLevel = cfg.LogLevel
 	return config
 }
 
-// Custom config over default set by const definitions
-func configBeelog() *bl.LogConfig {
+// Custom config over default set by the beelog settings of 'cfg'
+func configBeelog(ls LogStrategy) *bl.LogConfig {
 	var alg bl.Reducer
 
 	// just some defaults configuration, a real application would opt for a single
 	// structure on the first way.
-	switch defaultLogStrategy {
+	switch ls {
 	case BeelogList:
 		alg = bl.GreedyLt
 	case BeelogArray:
@@ -114,10 +116,10 @@ func configBeelog() *bl.LogConfig {
 
 	return &bl.LogConfig{
 		Alg:     alg,
-		Tick:    beelogTick,
-		Inmem:   beelogInmem,
-		Period:  beelogPeriod,
-		KeepAll: defaultLogStrategy == BeelogConcTable,
+		Tick:    cfg.beelogTick,
+		Inmem:   cfg.BeelogInmem,
+		Period:  uint32(cfg.BeelogPeriod),
+		KeepAll: ls == BeelogConcTable,
 		Fname:   "/tmp/beelog-" + svrID + ".log", // ignored if inmem
 	}
 }
@@ -128,32 +130,57 @@ type Store struct {
 	RaftBind string
 	inMem    bool
 
-	m          map[string][]byte
+	// ClientAddr is the address where clients reach this replica, advertised to others so
+	// followers can redirect clients to the leader. MembershipAddr is where membership
+	// requests are handled, advertised so followers can forward them to the leader. Empty
+	// disables advertising each one.
+	ClientAddr     string
+	MembershipAddr string
+	observer       *raft.Observer
+	observerCh     chan raft.Observation
+
+	m          engine.Engine
+	dedup      dedupTable
+	hist       history
+	watches    watchHub
+	leases     leaseTable
+	peers      peerTable
+	applied    uint64 // atomic
 	compress   bool
 	gzipBuffer bytes.Buffer
 
-	raft   *raft.Raft
-	logger hclog.Logger
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	logStore  raft.LogStore
+	logger    hclog.Logger
 
 	Logging  LogStrategy
 	LogFile  *os.File
 	LogFname string
 	logCount uint32 // atomic
-
-	st       bl.Structure
-	inMemLog *[]pb.Command
-	mu       sync.Mutex
+	logLen   uint64 // atomic, commands retained on the application log, readable outside the fsm
+
+	// Application logs are compacted up to the index of the latest persisted snapshot.
+	// 'logMu' excludes log compactions from concurrent appends and state transfers.
+	snapshots raft.SnapshotStore
+	snapIndex uint64 // atomic
+	logMu     sync.RWMutex
+
+	st         bl.Structure
+	beelogTick bl.ReduceInterval
+	inMemLog   *[]pb.Command
+	mu         sync.Mutex
 }
 
 // NewStore returns a new Store :)
 func NewStore(ctx context.Context, inMem bool) *Store {
 	s := &Store{
-		m:        make(map[string][]byte),
 		inMem:    inMem,
-		compress: compressValues,
+		compress: cfg.CompressValues,
+		hist:     history{window: cfg.HistoryWindow},
 		logger: hclog.New(&hclog.LoggerOptions{
 			Name:   "store",
-			Level:  hclog.LevelFromString(logLevel),
+			Level:  hclog.LevelFromString(cfg.LogLevel),
 			Output: os.Stderr,
 		}),
 	}
@@ -161,8 +188,13 @@ func NewStore(ctx context.Context, inMem bool) *Store {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	s.m, err = engine.New(cfg.Engine, cfg.engineDir())
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	if joinHandlerAddr != "" {
+		s.MembershipAddr = joinHandlerAddr
 		go s.ListenRaftJoins(ctx, joinHandlerAddr)
 	}
 
@@ -170,7 +202,8 @@ func NewStore(ctx context.Context, inMem bool) *Store {
 		go s.ListenStateTransfer(ctx, recovHandlerAddr)
 	}
 
-	if compressValues {
+	initValue := []byte(strings.Repeat("!", cfg.InitValueSize))
+	if cfg.CompressValues {
 		s.gzipBuffer.Reset()
 		wtr := gzip.NewWriter(&s.gzipBuffer)
 		wtr.Write([]byte(initValue))
@@ -184,19 +217,21 @@ func NewStore(ctx context.Context, inMem bool) *Store {
 		initValue = s.gzipBuffer.Bytes()
 	}
 
-	if preInitialize {
-		for i := 0; i < numInitKeys; i++ {
-			s.m[strconv.Itoa(i)] = initValue
+	if cfg.PreInitialize {
+		// every key shares the same entry, replaced on writes
+		entry := encodeEntry(revision{version: 1}, initValue)
+		for i := 0; i < cfg.NumInitKeys; i++ {
+			if err = s.m.Set(strconv.Itoa(i), entry); err != nil {
+				log.Fatalln(err)
+			}
 		}
 	}
 	return s
 }
 
 func (s *Store) initLogConfig(ctx context.Context) error {
-	s.Logging = defaultLogStrategy
-	if *logfolder != "" {
-		s.Logging = DiskTrad
-	}
+	s.Logging = cfg.logStrategy
+	s.beelogTick = cfg.beelogTick
 
 	var err error
 	switch s.Logging {
@@ -209,11 +244,13 @@ func (s *Store) initLogConfig(ctx context.Context) error {
 
 	case DiskTrad:
 		s.LogFname = *logfolder + "logfile-" + svrID + ".log"
-		s.LogFile = createWriteFile(s.LogFname, true)
+		if s.LogFile, err = createWriteFile(s.LogFname, true); err != nil {
+			return err
+		}
 		break
 
 	case BeelogAVL:
-		config := configBeelog()
+		config := configBeelog(s.Logging)
 		s.st, err = bl.NewAVLTreeHTWithConfig(config)
 		if err != nil {
 			return err
@@ -221,7 +258,7 @@ func (s *Store) initLogConfig(ctx context.Context) error {
 		break
 
 	case BeelogList:
-		config := configBeelog()
+		config := configBeelog(s.Logging)
 		s.st, err = bl.NewListHTWithConfig(config)
 		if err != nil {
 			return err
@@ -229,7 +266,7 @@ func (s *Store) initLogConfig(ctx context.Context) error {
 		break
 
 	case BeelogArray:
-		config := configBeelog()
+		config := configBeelog(s.Logging)
 		s.st, err = bl.NewArrayHTWithConfig(config)
 		if err != nil {
 			return err
@@ -237,7 +274,7 @@ func (s *Store) initLogConfig(ctx context.Context) error {
 		break
 
 	case BeelogCircBuffer:
-		config := configBeelog()
+		config := configBeelog(s.Logging)
 		s.st, err = bl.NewCircBuffHTWithConfig(ctx, config, 4000)
 		if err != nil {
 			return err
@@ -245,7 +282,9 @@ func (s *Store) initLogConfig(ctx context.Context) error {
 		break
 
 	case BeelogConcTable:
-		config := configBeelog()
+		// reduced logs are named after 'LogFname', removed once covered by a snapshot
+		config := configBeelog(s.Logging)
+		s.LogFname = config.Fname
 		s.st, err = bl.NewConcTableWithConfig(ctx, config)
 		if err != nil {
 			return err
@@ -259,38 +298,206 @@ func (s *Store) initLogConfig(ctx context.Context) error {
 }
 
 // Propose invokes Raft.Apply to propose a new command following protocol's atomic broadcast
-// to the application's FSM. Sends an "OK" repply to inform commitment. This procedure applies
-// "Get" requisitions to prevent inconsistent reads (that do not follow total ordering). etcd's
-// issue #741 gives a good explanation about this problem.
-func (s *Store) Propose(msg []byte, svr *Server, clientIP string) error {
+// to the application's FSM. Sends an "OK" repply to inform commitment. By default, this
+// procedure applies "Get" requisitions to prevent inconsistent reads (that do not follow total
+// ordering). etcd's issue #741 gives a good explanation about this problem. Commands informing
+// 'kvpb.Command_INDEX' read mode are instead served by ReadIndex, and WATCH commands subscribe
+// the session of 'origin' to changes, both without being logged. Replies are sent to the
+// client informed by 'origin', if any. Followers ignore commands, unless they request a
+// redirect, answered with the leader's client address.
+func (s *Store) Propose(msg []byte, svr *Server, origin *Request) error {
+	cmd := &kvpb.Command{}
+	if err := proto.Unmarshal(msg, cmd); err != nil {
+		return err
+	}
+	return s.propose(msg, cmd, svr, origin)
+}
+
+func (s *Store) propose(msg []byte, cmd *kvpb.Command, svr *Server, origin *Request) error {
+	if isInternal(cmd) {
+		return svr.reply(origin, cmd, "OK: "+errInternalCommand)
+	}
+	if s.raft.State() != raft.Leader {
+		if !cmd.Redirect {
+			return nil
+		}
+		return svr.reply(origin, cmd, notLeaderRepply+s.leaderClientAddr())
+	}
+
+	if cmd.Op == kvpb.Command_WATCH {
+		return s.watch(cmd, svr, origin)
+	}
+	if isIndexRead(cmd) {
+		value, err := s.readIndex(cmd)
+		if err != nil {
+			return err
+		}
+		return svr.reply(origin, cmd, "OK: "+value)
+	}
+	return s.replyApplied(s.raft.Apply(msg, raftTimeout), cmd, svr, origin)
+}
+
+// applyAsync appends 'msg' to the raft log without waiting for it to be applied, returning
+// nil if 'cmd' isn't logged (i.e. on followers, ReadIndex reads or watches).
+func (s *Store) applyAsync(msg []byte, cmd *kvpb.Command) raft.ApplyFuture {
 	if s.raft.State() != raft.Leader {
 		return nil
 	}
+	if isLocal(cmd) {
+		return nil
+	}
+	return s.raft.Apply(msg, raftTimeout)
+}
 
-	f := s.raft.Apply(msg, raftTimeout)
-	err := f.Error()
-	if err != nil {
+// isLocal reports whether 'cmd' is served by the leader without being logged, either a read
+// served by ReadIndex or a WATCH. Commands reserved to replicas are also never logged, but
+// rejected.
+func isLocal(cmd *kvpb.Command) bool {
+	return cmd.Op == kvpb.Command_WATCH || isInternal(cmd) || isIndexRead(cmd)
+}
+
+// isInternal reports whether 'cmd' is only proposed by replicas, either an ADVERTISE of their
+// client address or an EXPIRE from the leader, and must be rejected from clients.
+func isInternal(cmd *kvpb.Command) bool {
+	return cmd.Op == kvpb.Command_ADVERTISE || cmd.Op == kvpb.Command_EXPIRE
+}
+
+// isIndexRead reports whether 'cmd' is a read served by ReadIndex, never logged.
+func isIndexRead(cmd *kvpb.Command) bool {
+	switch cmd.Op {
+	case pb.Command_GET, kvpb.Command_SCAN, kvpb.Command_GETFIELDS, kvpb.Command_GETVERSION,
+		kvpb.Command_GETAT, kvpb.Command_CHANGES:
+		return cmd.Read == kvpb.Command_INDEX
+	}
+	return false
+}
+
+// readIndex serves the read 'cmd' following the same linearizable semantics of ReadIndex.
+func (s *Store) readIndex(cmd *kvpb.Command) (string, error) {
+	switch cmd.Op {
+	case kvpb.Command_SCAN:
+		return s.ScanIndex(cmd.Key, cmd.Count)
+
+	case kvpb.Command_GETFIELDS:
+		if err := s.confirmReadIndex(); err != nil {
+			return "", err
+		}
+		return (*fsm)(s).applyGetFields(cmd.Key, cmd.Fields), nil
+
+	case kvpb.Command_GETVERSION:
+		if err := s.confirmReadIndex(); err != nil {
+			return "", err
+		}
+		return (*fsm)(s).applyGetVersion(cmd.Key), nil
+
+	case kvpb.Command_GETAT, kvpb.Command_CHANGES:
+		if err := s.confirmReadIndex(); err != nil {
+			return "", err
+		}
+		applied := atomic.LoadUint64(&s.applied)
+		if cmd.Op == kvpb.Command_GETAT {
+			return (*fsm)(s).applyGetAt(cmd.Key, cmd.Index, applied), nil
+		}
+		return (*fsm)(s).applyChanges(cmd.Key, cmd.Index, cmd.Count, applied), nil
+	}
+	return s.ReadIndex(cmd.Key)
+}
+
+// replyApplied waits for the command proposed on 'f' to be applied, then replies its result
+// to the client informed by 'origin'.
+func (s *Store) replyApplied(f raft.ApplyFuture, cmd *kvpb.Command, svr *Server, origin *Request) error {
+	if err := f.Error(); err != nil {
 		return err
 	}
 
 	switch f.Response().(type) {
 	case string:
-		response := strings.Split(f.Response().(string), "-")
-		udpAddr := strings.Join([]string{clientIP, ":", response[0]}, "")
-		clientRepply := strings.Join([]string{"OK: ", response[1], "\n"}, "")
-		svr.SendUDP(udpAddr, clientRepply)
-		break
+		response := strings.SplitN(f.Response().(string), "-", 2)
+		return svr.reply(origin, cmd, "OK: "+response[1])
 
 	default:
 		return fmt.Errorf("Unrecognized data response %q", f.Response())
 	}
+}
+
+// ReadIndex returns the value of 'key' following linearizable semantics, without appending
+// any entry on the raft log. The leader registers the latest command on its log, confirms
+// its leadership through a heartbeat round, then waits until the registered command is
+// applied before reading from its local state.
+func (s *Store) ReadIndex(key string) (string, error) {
+	if err := s.confirmReadIndex(); err != nil {
+		return "", err
+	}
+	return (*fsm)(s).applyGet(key), nil
+}
+
+// ScanIndex returns up to 'count' pairs from 'start', encoded by wire.EncodePairs, following
+// the same linearizable semantics of ReadIndex.
+func (s *Store) ScanIndex(start string, count uint32) (string, error) {
+	if err := s.confirmReadIndex(); err != nil {
+		return "", err
+	}
+	return (*fsm)(s).applyScan(start, count), nil
+}
+
+// confirmReadIndex registers the latest command on the raft log, confirms leadership, and
+// waits until the registered command is applied.
+func (s *Store) confirmReadIndex() error {
+	ind, err := s.lastCommandIndex(s.raft.LastIndex())
+	if err != nil {
+		return err
+	}
+
+	if err = s.raft.VerifyLeader().Error(); err != nil {
+		return err
+	}
+	return s.waitApplied(ind, raftTimeout)
+}
+
+// lastCommandIndex returns the index of the latest command entry up to 'ind' on the raft
+// log, skipping entries never delivered to the FSM (e.g. no-ops and configuration changes).
+// Returns zero if no command is found, or if it was already compacted by a snapshot.
+func (s *Store) lastCommandIndex(ind uint64) (uint64, error) {
+	first, err := s.logStore.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	var l raft.Log
+	for ; ind > 0 && ind >= first; ind-- {
+		err = s.logStore.GetLog(ind, &l)
+		if err == raft.ErrLogNotFound {
+			return 0, nil
+
+		} else if err != nil {
+			return 0, err
+		}
+
+		if l.Type == raft.LogCommand {
+			return ind, nil
+		}
+	}
+	return 0, nil
+}
+
+// waitApplied blocks until the FSM applies the command at index 'ind', or 'timeout' expires.
+func (s *Store) waitApplied(ind uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadUint64(&s.applied) < ind {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for index %d to be applied", ind)
+		}
+		time.Sleep(readIndexPoll)
+	}
 	return nil
 }
 
 // testGet returns the value for the given key, just using in unit tests since it results
 // in an inconsistence read operation, not following total ordering.
 func (s *Store) testGet(key string) string {
-	return string(s.m[key])
+	entry, _, _ := s.m.Get(key)
+	_, value, _ := decodeEntry(entry)
+	return string(value)
 }
 
 // StartRaft opens the store. If enableSingle is set, and there are no existing peers,
@@ -311,16 +518,23 @@ func (s *Store) StartRaft(enableSingle bool, localID string, localRaftAddr strin
 		return err
 	}
 
-	// Using just in-memory storage (could use boltDB in the key-value application)
-	logStore := raft.NewInmemStore()
-	stableStore := raft.NewInmemStore()
+	dir := s.RaftDir
+	if dir == "" {
+		dir = "checkpoints/" + localID
+	}
+
+	// Using in-memory storage by default, or a durable one if '-raftstore' is set to 'file'
+	logStore, stableStore, err := newRaftStores(dir)
+	if err != nil {
+		return err
+	}
 
 	// Create a fake snapshot store
-	dir := "checkpoints/" + localID
-	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	snapshots, err := raft.NewFileSnapshotStore(dir, retainSnapshotCount, os.Stderr)
 	if err != nil {
 		return fmt.Errorf("file snapshot store: %s", err)
 	}
+	s.snapshots = snapshots
 
 	// Instantiate the Raft systems.
 	ra, err := raft.NewRaft(config, (*fsm)(s), logStore, stableStore, snapshots, transport)
@@ -328,6 +542,8 @@ func (s *Store) StartRaft(enableSingle bool, localID string, localRaftAddr strin
 		return fmt.Errorf("new raft: %s", err)
 	}
 	s.raft = ra
+	s.transport = transport
+	s.logStore = logStore
 
 	if enableSingle {
 		configuration := raft.Configuration{
@@ -340,9 +556,34 @@ func (s *Store) StartRaft(enableSingle bool, localID string, localRaftAddr strin
 		}
 		ra.BootstrapCluster(configuration)
 	}
+
+	if s.ClientAddr != "" || s.MembershipAddr != "" {
+		s.advertiseOnLeadership()
+	}
+	go s.expireOnLeadership()
 	return nil
 }
 
+// newRaftStores returns the raft log and stable stores configured by '-raftstore'. The
+// durable 'file' option persists both at 'dir', allowing a crashed replica to rejoin the
+// cluster with its term, vote and log intact.
+func newRaftStores(dir string) (raft.LogStore, raft.StableStore, error) {
+	switch *raftStore {
+	case "inmem":
+		return raft.NewInmemStore(), raft.NewInmemStore(), nil
+
+	case "file":
+		fs, err := raftstore.NewFileStore(dir+"/raftlog", !cfg.CatastrophicFaults)
+		if err != nil {
+			return nil, nil, fmt.Errorf("file raft store: %s", err)
+		}
+		return fs, fs, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknow raft store '%s' provided", *raftStore)
+	}
+}
+
 // JoinRaft joins a raft node, identified by nodeID and located at addr
 func (s *Store) JoinRaft(nodeID, addr string, voter bool) error {
 	s.logger.Debug(fmt.Sprintf("received join request for remote node %s at %s", nodeID, addr))
@@ -387,42 +628,6 @@ func (s *Store) JoinRaft(nodeID, addr string, voter bool) error {
 	return nil
 }
 
-// ListenRaftJoins receives incoming join requests to the raft cluster. Its initialized
-// when "-hjoin" flag is specified, and it can be set only in the first node in case you
-// have a static/imutable cluster architecture
-func (s *Store) ListenRaftJoins(ctx context.Context, addr string) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("failed to bind connection at %s: %s", addr, err.Error())
-	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-
-		default:
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Fatalf("accept failed: %s", err.Error())
-			}
-			request, _ := bufio.NewReader(conn).ReadString('\n')
-
-			data := strings.Split(request, "-")
-			if len(data) < 3 {
-				log.Fatalf("incorrect join request, got: %s", data)
-			}
-
-			data[2] = strings.TrimSuffix(data[2], "\n")
-			voter, _ := strconv.ParseBool(data[2])
-			err = s.JoinRaft(data[0], data[1], voter)
-			if err != nil {
-				log.Fatalf("failed to join node at %s: %s", data[1], err.Error())
-			}
-		}
-	}
-}
-
 // LogStateRecover ...
 func (s *Store) LogStateRecover(p, n uint64, activePipe net.Conn) error {
 	if n < p {
@@ -448,28 +653,19 @@ func (s *Store) LogStateRecover(p, n uint64, activePipe net.Conn) error {
 		break
 
 	case BeelogConcTable: // current only one that retrieves entire state since origin
+		s.logMu.RLock()
 		logs, nLogs, err = s.st.(*bl.ConcTable).RecovEntireLog()
+		s.logMu.RUnlock()
 		if err != nil {
 			return err
 		}
 		break
 
 	case DiskTrad:
-		fd, err := os.OpenFile(s.LogFname, os.O_RDONLY, 0644)
-		if err != nil {
-			return err
-		}
-		defer fd.Close()
-
-		// TODO: must rethink this entire procedure to threat concurrent calls between
-		// fsm.Log() and LogStateRecover(). Its currently UNSAFE due to concurrent 'logCount'
-		// increment and 'UnmarshalWithLen' calls, and a mutex acquisition on each cmd
-		// logging seems too expensive (benchmark).
-		count := atomic.LoadUint32(&s.logCount)
+		s.logMu.RLock()
+		defer s.logMu.RUnlock()
 
-		// EOL flag is not mandatory on 'UnmarshalWithLen', and its later written by
-		// 'MarshalLogIntoWriter' procedure
-		data, err := bl.UnmarshalLogWithLenFromReader(fd, int(count))
+		data, err := s.readDiskLog()
 		if err != nil {
 			return err
 		}
@@ -516,7 +712,135 @@ func (s *Store) LogStateRecover(p, n uint64, activePipe net.Conn) error {
 	return err
 }
 
-// ListenStateTransfer ...
+// readDiskLog returns every command on the DiskTrad log file. Must hold 'logMu'.
+func (s *Store) readDiskLog() ([]pb.Command, error) {
+	fd, err := os.OpenFile(s.LogFname, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	// TODO: must rethink this entire procedure to threat concurrent calls between
+	// fsm.Log() and LogStateRecover(). Its currently UNSAFE due to concurrent 'logCount'
+	// increment and 'UnmarshalWithLen' calls, and a mutex acquisition on each cmd
+	// logging seems too expensive (benchmark).
+	count := atomic.LoadUint32(&s.logCount)
+
+	// EOL flag is not mandatory on 'UnmarshalWithLen', and its later written by
+	// 'MarshalLogIntoWriter' procedure
+	return bl.UnmarshalLogWithLenFromReader(fd, int(count))
+}
+
+// SnapshotStateRecover transfers the latest persisted snapshot followed by the application
+// log suffix, starting after the snapshot index up to 'n'. The snapshot is preceded by a
+// "snapshot <index> <size>" line, where a zero size informs that no snapshot is available and
+// the log is retrieved from 'p'.
+func (s *Store) SnapshotStateRecover(p, n uint64, activePipe net.Conn) error {
+	var (
+		meta *raft.SnapshotMeta
+		rc   io.ReadCloser
+	)
+	list, err := s.snapshots.List()
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 {
+		meta, rc, err = s.snapshots.Open(list[0].ID)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+	}
+
+	if meta == nil || meta.Index < p {
+		if _, err = fmt.Fprintf(activePipe, "snapshot %d %d\n", 0, 0); err != nil {
+			return err
+		}
+		return s.LogStateRecover(p, n, activePipe)
+	}
+
+	if _, err = fmt.Fprintf(activePipe, "snapshot %d %d\n", meta.Index, meta.Size); err != nil {
+		return err
+	}
+	if _, err = io.CopyN(activePipe, rc, meta.Size); err != nil {
+		return err
+	}
+
+	if meta.Index >= n {
+		return s.writeEmptyLog(meta.Index, n, activePipe)
+	}
+	return s.LogStateRecover(meta.Index+1, n, activePipe)
+}
+
+// writeEmptyLog informs an empty log interval, following the format of the configured
+// log strategy.
+func (s *Store) writeEmptyLog(p, n uint64, activePipe net.Conn) error {
+	if s.Logging == BeelogConcTable {
+		_, err := fmt.Fprintf(activePipe, "%d\n", 0)
+		return err
+	}
+	return bl.MarshalLogIntoWriter(activePipe, &[]pb.Command{}, p, n)
+}
+
+// compactLog discards application log entries up to 'ind', already covered by a persisted
+// snapshot. Since beelog structures cannot be truncated, only the reduced logs persisted
+// by ConcTable are removed, while other structures are marked through 'snapIndex' and have
+// their log retrieved after it by SnapshotStateRecover.
+func (s *Store) compactLog(ind uint64) error {
+	atomic.StoreUint64(&s.snapIndex, ind)
+
+	switch s.Logging {
+	case DiskTrad:
+		s.logMu.Lock()
+		defer s.logMu.Unlock()
+		return (*fsm)(s).compactDiskLog(ind)
+
+	case InmemTrad:
+		s.mu.Lock()
+		retained := make([]pb.Command, 0, len(*s.inMemLog))
+		for _, c := range *s.inMemLog {
+			if c.Id > ind {
+				retained = append(retained, c)
+			}
+		}
+		s.inMemLog = &retained
+		atomic.StoreUint64(&s.logLen, uint64(len(retained)))
+		s.mu.Unlock()
+
+	case BeelogConcTable:
+		// beelog structures count every logged command on 'logLen', kept by removals
+		s.logMu.Lock()
+		defer s.logMu.Unlock()
+		return removeReducedLogs(s.LogFname, ind)
+	}
+	return nil
+}
+
+// removeReducedLogs removes every reduced log persisted by ConcTable structures, named after
+// 'fname' and the last index it contains, that is covered by index 'ind'.
+func removeReducedLogs(fname string, ind uint64) error {
+	prefix := strings.TrimSuffix(fname, "log")
+	fs, err := filepath.Glob(prefix + "*.log")
+	if err != nil {
+		return err
+	}
+
+	for _, fn := range fs {
+		last, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(fn, prefix), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if last <= ind {
+			if err = os.Remove(fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListenStateTransfer receives state requests formatted as "addr-p-n", answered by
+// LogStateRecover, or "addr-p-n-snap", answered by SnapshotStateRecover.
 func (s *Store) ListenStateTransfer(ctx context.Context, addr string) {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -535,16 +859,22 @@ func (s *Store) ListenStateTransfer(ctx context.Context, addr string) {
 			}
 
 			req, _ := bufio.NewReader(conn).ReadString('\n')
-			data := strings.Split(req, "-")
-			if len(data) != 3 {
+			data := strings.Split(strings.TrimSuffix(req, "\n"), "-")
+			if len(data) != 3 && (len(data) != 4 || data[3] != "snap") {
 				log.Fatalf("incorrect state request, got: %s", data)
 			}
 
-			data[2] = strings.TrimSuffix(data[2], "\n")
 			firstIndex, _ := strconv.Atoi(data[1])
 			lastIndex, _ := strconv.Atoi(data[2])
 
-			err = s.LogStateRecover(uint64(firstIndex), uint64(lastIndex), conn)
+			start, cc := time.Now(), &metrics.CountConn{Conn: conn}
+			if len(data) == 4 {
+				err = s.SnapshotStateRecover(uint64(firstIndex), uint64(lastIndex), cc)
+			} else {
+				err = s.LogStateRecover(uint64(firstIndex), uint64(lastIndex), cc)
+			}
+			recovBytes.Add(cc.Written())
+			recovDuration.Since(start)
 			if err != nil {
 				log.Fatalf("failed to transfer log to node located at '%s', error: %s", data[0], err.Error())
 			}
@@ -557,9 +887,9 @@ func (s *Store) ListenStateTransfer(ctx context.Context, addr string) {
 	}
 }
 
-func createWriteFile(filename string, logindex bool, extraFlags ...int) *os.File {
+func createWriteFile(filename string, logindex bool, extraFlags ...int) (*os.File, error) {
 	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY | os.O_APPEND
-	if catastrophicFaults {
+	if cfg.CatastrophicFaults {
 		flags = flags | os.O_SYNC
 	}
 
@@ -569,8 +899,7 @@ func createWriteFile(filename string, logindex bool, extraFlags ...int) *os.File
 
 	fd, err := os.OpenFile(filename, flags, 0644)
 	if err != nil {
-		log.Fatalln("could not create file '", filename, "', err:", err.Error())
-		return nil
+		return nil, fmt.Errorf("could not create file '%s': %s", filename, err.Error())
 	}
 
 	if logindex {
@@ -579,9 +908,9 @@ func createWriteFile(filename string, logindex bool, extraFlags ...int) *os.File
 		// of commands due to 'bl.MarshalLogIntoWriter()'.
 		_, err = fmt.Fprintf(fd, "%d\n%d\n%d\n", uint64(0), uint64(0), -1)
 		if err != nil {
-			log.Fatalln("Error during file creation:", err.Error())
-			return nil
+			fd.Close()
+			return nil, fmt.Errorf("could not write the header of file '%s': %s", filename, err.Error())
 		}
 	}
-	return fd
+	return fd, nil
 }
@@ -1,18 +1,38 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"beelog-hraft/applog"
+	"beelog-hraft/engine"
+	"beelog-hraft/kvpb"
+	"beelog-hraft/raftstore"
+	"beelog-hraft/record"
+	"beelog-hraft/snapshot"
+	"beelog-hraft/wire"
+
+	bl "github.com/Lz-Gustavo/beelog"
 	"github.com/Lz-Gustavo/beelog/pb"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/hashicorp/raft"
 )
 
 func TestCreate(t *testing.T) {
 	s := NewStore(context.TODO(), true)
-	if err := s.StartRaft(true, "node0", ":12000"); err != nil {
+	if err := s.StartRaft(true, "node0", freeAddr(t)); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
 
@@ -24,12 +44,10 @@ func TestCreate(t *testing.T) {
 
 func TestOperations(t *testing.T) {
 	s := NewStore(context.TODO(), true)
-	if err := s.StartRaft(true, "node0", ":12000"); err != nil {
+	if err := s.StartRaft(true, "node0", freeAddr(t)); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
-
-	// Simple way to ensure there is a leader.
-	time.Sleep(3 * time.Second)
+	waitLeader(t, s)
 
 	cmd := &pb.Command{
 		Op:    pb.Command_SET,
@@ -37,7 +55,7 @@ func TestOperations(t *testing.T) {
 		Value: "bar",
 	}
 	bytes, _ := proto.Marshal(cmd)
-	if err := s.Propose(bytes, nil, ""); err != nil {
+	if err := s.Propose(bytes, nil, nil); err != nil {
 		t.Fatalf("failed to set key: %s", err.Error())
 	}
 
@@ -48,3 +66,901 @@ func TestOperations(t *testing.T) {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 }
+
+func TestDeleteStaysDeletedAfterRecovery(t *testing.T) {
+	strategies := []LogStrategy{DiskTrad, InmemTrad, BeelogList, BeelogArray, BeelogAVL, BeelogCircBuffer, BeelogConcTable}
+	for _, ls := range strategies {
+		s := newLoggedStore(t, ls)
+		cmds := []*pb.Command{
+			{Op: pb.Command_SET, Key: "foo", Value: "bar"},
+			{Op: pb.Command_SET, Key: "baz", Value: "qux"},
+			{Op: pb.Command_DELETE, Key: "foo"},
+			{Op: pb.Command_GET, Key: "foo"},
+		}
+		for i, cmd := range cmds {
+			applyCommand(t, s, uint64(i+1), cmd)
+		}
+
+		if _, ok, _ := s.m.Get("foo"); ok {
+			t.Fatalf("strategy %d: deleted key still present on the store", ls)
+		}
+
+		state := recoverStateFromLog(t, s, 1, uint64(len(cmds)))
+		if _, ok := state["foo"]; ok {
+			t.Fatalf("strategy %d: deleted key present after recovery, got state: %v", ls, state)
+		}
+		if state["baz"] != "qux" {
+			t.Fatalf("strategy %d: expected 'qux' on recovered key, got: '%s'", ls, state["baz"])
+		}
+	}
+}
+
+// newLoggedStore creates a store without raft, logging commands with the informed strategy.
+func newLoggedStore(t *testing.T, ls LogStrategy) *Store {
+	s := &Store{
+		m:       engine.NewMemory(),
+		Logging: ls,
+	}
+
+	var err error
+	config := &bl.LogConfig{Inmem: true, Tick: bl.Delayed}
+	switch ls {
+	case DiskTrad:
+		dir, err := ioutil.TempDir("", "beelog-hraft")
+		if err != nil {
+			t.Fatalf("failed to create temp dir: %s", err.Error())
+		}
+		s.LogFname = dir + "/logfile-test.log"
+		if s.LogFile, err = createWriteFile(s.LogFname, true); err != nil {
+			t.Fatalf("failed to create log file: %s", err.Error())
+		}
+
+	case InmemTrad:
+		s.inMemLog = &[]pb.Command{}
+
+	case BeelogList:
+		config.Alg = bl.GreedyLt
+		s.st, err = bl.NewListHTWithConfig(config)
+
+	case BeelogArray:
+		config.Alg = bl.GreedyArray
+		s.st, err = bl.NewArrayHTWithConfig(config)
+
+	case BeelogAVL:
+		config.Alg = bl.IterDFSAvl
+		s.st, err = bl.NewAVLTreeHTWithConfig(config)
+
+	case BeelogCircBuffer:
+		config.Alg = bl.IterCircBuff
+		s.st, err = bl.NewCircBuffHTWithConfig(context.TODO(), config, 4000)
+
+	case BeelogConcTable:
+		// reduced on every command, persisting a log for each index named after 'LogFname'
+		var dir string
+		if dir, err = ioutil.TempDir("", "beelog-hraft"); err != nil {
+			t.Fatalf("failed to create temp dir: %s", err.Error())
+		}
+		s.LogFname = dir + "/beelog-test.log"
+		config.Alg, config.Tick, config.Period = bl.IterConcTable, bl.Interval, 1
+		config.Inmem, config.KeepAll, config.Fname = false, true, s.LogFname
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		s.st, err = bl.NewConcTableWithConfig(ctx, config)
+	}
+	if err != nil {
+		t.Fatalf("failed to create log structure: %s", err.Error())
+	}
+	s.beelogTick = config.Tick
+	return s
+}
+
+func applyCommand(t *testing.T, s *Store, ind uint64, cmd *pb.Command) interface{} {
+	raw, err := proto.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err.Error())
+	}
+	return (*fsm)(s).Apply(&raft.Log{Index: ind, Data: raw})
+}
+
+// recoverStateFromLog retrieves the [p, n] log interval from 's', then installs it on
+// an empty state by applog.Replay, the same way recovering replicas do.
+func recoverStateFromLog(t *testing.T, s *Store, p, n uint64) map[string]string {
+	state := make(map[string]string)
+	replayLog(t, recoverLog(t, s, p, n), state)
+	return state
+}
+
+// replayLog applies the writes of 'log' on 'state'.
+func replayLog(t *testing.T, log []pb.Command, state map[string]string) {
+	err := applog.Replay(log, func(_ uint64, w applog.Write) {
+		if w.Deleted {
+			delete(state, w.Key)
+			return
+		}
+		state[w.Key] = string(w.Value)
+	})
+	if err != nil {
+		t.Fatalf("failed to replay log: %s", err.Error())
+	}
+}
+
+// recoverLog retrieves the [p, n] log interval from 's', as sent to recovering replicas.
+// The concurrent table sends every reduced log, waiting for the one reduced up to 'n'.
+func recoverLog(t *testing.T, s *Store, p, n uint64) []pb.Command {
+	waitReduced(t, s, n)
+	rd, wr := net.Pipe()
+	go func() {
+		if err := s.LogStateRecover(p, n, wr); err != nil {
+			t.Errorf("failed to recover log: %s", err.Error())
+		}
+		wr.Close()
+	}()
+	return readLog(t, s, rd)
+}
+
+// waitReduced waits until ConcTable stores persist their reduced log up to index 'n', as
+// reduce runs asynchronously.
+func waitReduced(t *testing.T, s *Store, n uint64) {
+	if s.Logging != BeelogConcTable {
+		return
+	}
+	fn := strings.TrimSuffix(s.LogFname, "log") + strconv.FormatUint(n, 10) + ".log"
+	waitFor(t, "log reduced up to index "+strconv.FormatUint(n, 10), func() bool {
+		raw, err := ioutil.ReadFile(fn)
+		return err == nil && bytes.HasSuffix(raw, []byte("EOL\n"))
+	})
+}
+
+// readLog reads a log transferred by 's' from 'rd', preceded by the number of logs on
+// ConcTable stores.
+func readLog(t *testing.T, s *Store, rd io.Reader) []pb.Command {
+	nLogs := 1
+	if s.Logging == BeelogConcTable {
+		if _, err := fmt.Fscanf(rd, "%d\n", &nLogs); err != nil {
+			t.Fatalf("failed to read the number of logs: %s", err.Error())
+		}
+	}
+	var log []pb.Command
+	for i := 0; i < nLogs; i++ {
+		cmds, err := bl.UnmarshalLogFromReader(rd)
+		if err != nil {
+			t.Fatalf("failed to unmarshal recovered log: %s", err.Error())
+		}
+		log = append(log, cmds...)
+	}
+	return log
+}
+
+func TestSnapshotStateRecover(t *testing.T) {
+	for _, ls := range []LogStrategy{DiskTrad, InmemTrad, BeelogList, BeelogConcTable} {
+		s := newLoggedStore(t, ls)
+		dir, err := ioutil.TempDir("", "beelog-hraft")
+		if err != nil {
+			t.Fatalf("failed to create temp dir: %s", err.Error())
+		}
+		defer os.RemoveAll(dir)
+
+		s.snapshots, err = raft.NewFileSnapshotStore(dir, retainSnapshotCount, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("failed to create snapshot store: %s", err.Error())
+		}
+
+		applyCommand(t, s, 1, &pb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar"})
+		applyCommand(t, s, 2, &pb.Command{Op: pb.Command_SET, Key: "baz", Value: "qux"})
+		waitReduced(t, s, 2)
+		persistSnapshot(t, s, 2)
+		applyCommand(t, s, 3, &pb.Command{Op: pb.Command_SET, Key: "foo", Value: "new"})
+		applyCommand(t, s, 4, &pb.Command{Op: pb.Command_DELETE, Key: "baz"})
+		waitReduced(t, s, 4)
+
+		if ls != BeelogList {
+			// commands covered by the snapshot must be discarded from traditional logs,
+			// and from the reduced logs persisted by ConcTable
+			if state := recoverStateFromLog(t, s, 1, 4); len(state) != 1 {
+				t.Fatalf("strategy %d: expected a compacted log, got state: %v", ls, state)
+			}
+		}
+		if ls == DiskTrad || ls == InmemTrad {
+			if n := atomic.LoadUint64(&s.logLen); n != 2 {
+				t.Fatalf("strategy %d: expected 2 commands retained after compaction, got %d", ls, n)
+			}
+		}
+
+		rd, wr := net.Pipe()
+		go func() {
+			if err := s.SnapshotStateRecover(1, 4, wr); err != nil {
+				t.Errorf("failed to recover state: %s", err.Error())
+			}
+			wr.Close()
+		}()
+
+		var ind, size uint64
+		if _, err = fmt.Fscanf(rd, "snapshot %d %d\n", &ind, &size); err != nil {
+			t.Fatalf("failed to read snapshot header: %s", err.Error())
+		}
+		if ind != 2 || size == 0 {
+			t.Fatalf("strategy %d: expected snapshot at index 2, got index %d size %d", ls, ind, size)
+		}
+
+		state := make(map[string]string)
+		lr := io.LimitReader(rd, int64(size))
+		err = snapshot.Read(lr, func(key string, value []byte) error {
+			state[key] = string(value)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to decode snapshot: %s", err.Error())
+		}
+		io.Copy(ioutil.Discard, lr)
+
+		log := readLog(t, s, rd)
+		for _, cmd := range log {
+			if cmd.Id <= ind {
+				t.Fatalf("strategy %d: log suffix contains command %d already on the snapshot", ls, cmd.Id)
+			}
+		}
+		replayLog(t, log, state)
+		if _, ok := state["baz"]; ok || state["foo"] != "new" || len(state) != 1 {
+			t.Fatalf("strategy %d: unexpected recovered state: %v", ls, state)
+		}
+	}
+}
+
+func TestSnapshotMatchesLogRecovery(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		s := newLoggedStore(t, InmemTrad)
+		s.compress = compress
+		cmds := []*kvpb.Command{
+			{Op: pb.Command_SET, Key: "foo", Value: "bar"},
+			{Op: pb.Command_SET, Key: "baz", Value: "qux"},
+			{Op: pb.Command_SET, Key: "foo", Value: "new"},
+			{Op: pb.Command_DELETE, Key: "baz"},
+			{Op: kvpb.Command_INCR, Key: "n"},
+			{Op: kvpb.Command_TXN, Txn: []*kvpb.Command{
+				{Op: pb.Command_SET, Key: "a", Value: "1"},
+				{Op: pb.Command_SET, Key: "b", Value: "2"},
+			}},
+		}
+		for i, cmd := range cmds {
+			applyKvCommand(t, s, uint64(i+1), cmd)
+		}
+
+		// external consumers read the same values from snapshots as from the log
+		snap, err := (*fsm)(s).Snapshot()
+		if err != nil {
+			t.Fatalf("failed to take snapshot: %s", err.Error())
+		}
+		exp := recoverStateFromLog(t, s, 1, uint64(len(cmds)))
+		if state := persistIntoMemory(t, snap); !reflect.DeepEqual(exp, state) {
+			t.Fatalf("compress %v: expected snapshot state %v, got %v", compress, exp, state)
+		}
+
+		// while restores keep the revision of every key
+		sink := &memSink{}
+		if err = snap.Persist(sink); err != nil {
+			t.Fatalf("failed to persist snapshot: %s", err.Error())
+		}
+		r := newLoggedStore(t, NotLog)
+		r.compress = compress
+		if err = (*fsm)(r).Restore(ioutil.NopCloser(sink)); err != nil {
+			t.Fatalf("failed to restore snapshot: %s", err.Error())
+		}
+		for _, key := range []string{"foo", "baz", "n", "a", "b"} {
+			cmd := &kvpb.Command{Op: kvpb.Command_GETVERSION, Key: key}
+			if want, got := applyKvCommand(t, s, 7, cmd), applyKvCommand(t, r, 7, cmd); want != got {
+				t.Fatalf("compress %v: expected %q on key '%s' after restore, got %q", compress, want, key, got)
+			}
+		}
+	}
+}
+
+// persistSnapshot takes a snapshot of 's' at index 'ind', persisting it on its snapshot store.
+func persistSnapshot(t *testing.T, s *Store, ind uint64) {
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %s", err.Error())
+	}
+	sink, err := s.snapshots.Create(1, ind, 1, raft.Configuration{}, 0, nil)
+	if err != nil {
+		t.Fatalf("failed to create snapshot sink: %s", err.Error())
+	}
+	if err = snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err.Error())
+	}
+}
+
+func TestSnapshotConcurrentWithApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beelog-hraft")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"memory", "disk"} {
+		e, err := engine.New(name, dir)
+		if err != nil {
+			t.Fatalf("failed to create %s engine: %s", name, err.Error())
+		}
+		t.Run(name, func(t *testing.T) {
+			testSnapshotConcurrentWithApply(t, e)
+		})
+		e.Close()
+	}
+}
+
+func testSnapshotConcurrentWithApply(t *testing.T, e engine.Engine) {
+	const numKeys = 1000
+	s := newLoggedStore(t, InmemTrad)
+	s.m = e
+	for i := 0; i < numKeys; i++ {
+		applyCommand(t, s, uint64(i+1), &pb.Command{Op: pb.Command_SET, Key: strconv.Itoa(i), Value: "init"})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := numKeys; i < 20*numKeys; i++ {
+			cmd := &pb.Command{Op: pb.Command_SET, Key: strconv.Itoa(i % numKeys), Value: strconv.Itoa(i)}
+			if i%7 == 0 {
+				cmd = &pb.Command{Op: pb.Command_DELETE, Key: strconv.Itoa(i % numKeys)}
+			}
+			applyCommand(t, s, uint64(i+1), cmd)
+		}
+	}()
+
+	// reads served outside the fsm
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				s.testGet(strconv.Itoa(i % numKeys))
+			}
+		}
+	}()
+
+	var snaps []raft.FSMSnapshot
+	var states []map[string]string
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		snap, err := (*fsm)(s).Snapshot()
+		if err != nil {
+			t.Fatalf("failed to take snapshot: %s", err.Error())
+		}
+		snaps = append(snaps, snap)
+		states = append(states, persistIntoMemory(t, snap))
+	}
+
+	// captured snapshots must remain unchanged by later commands
+	for i, snap := range snaps {
+		if st := persistIntoMemory(t, snap); !reflect.DeepEqual(st, states[i]) {
+			t.Fatalf("snapshot %d changed after being captured", i)
+		}
+	}
+	if st := states[len(states)-1]; len(st) != s.m.Len() {
+		t.Fatalf("expected %d keys on the latest snapshot, got %d", s.m.Len(), len(st))
+	}
+}
+
+// memSink is a raft.SnapshotSink persisting snapshots in memory.
+type memSink struct {
+	bytes.Buffer
+}
+
+func (m *memSink) ID() string    { return "mem" }
+func (m *memSink) Cancel() error { return nil }
+func (m *memSink) Close() error  { return nil }
+
+func persistIntoMemory(t *testing.T, snap raft.FSMSnapshot) map[string]string {
+	sink := &memSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err.Error())
+	}
+
+	state := make(map[string]string)
+	err := snapshot.Read(sink, func(key string, value []byte) error {
+		state[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %s", err.Error())
+	}
+	return state
+}
+
+func TestDuplicateCommandsAppliedOnce(t *testing.T) {
+	s := newLoggedStore(t, InmemTrad)
+	cmds := []*kvpb.Command{
+		{Op: pb.Command_SET, Key: "foo", Value: "bar", ClientId: 7, Seq: 1},
+		{Op: pb.Command_GET, Key: "foo", ClientId: 7, Seq: 2},
+		{Op: pb.Command_SET, Key: "foo", Value: "baz", ClientId: 8, Seq: 1},
+
+		// retries of already applied commands
+		{Op: pb.Command_GET, Key: "foo", ClientId: 7, Seq: 2},
+		{Op: pb.Command_SET, Key: "foo", Value: "bar", ClientId: 7, Seq: 1},
+	}
+	exp := []string{"-", "-bar", "-", "-bar", "-"}
+	for i, cmd := range cmds {
+		if res := applyKvCommand(t, s, uint64(i+1), cmd); res != exp[i] {
+			t.Fatalf("expected result %q for command %d, got %q", exp[i], i, res)
+		}
+	}
+	if value := s.testGet("foo"); value != "baz" {
+		t.Fatalf("retried command was applied twice, got value: %s", value)
+	}
+	if n := len(*s.inMemLog); n != 3 {
+		t.Fatalf("expected only 3 commands logged, got %d", n)
+	}
+
+	// the deduplication table is restored from snapshots
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %s", err.Error())
+	}
+	sink := &memSink{}
+	if err = snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err.Error())
+	}
+
+	r := newLoggedStore(t, NotLog)
+	if err = (*fsm)(r).Restore(ioutil.NopCloser(sink)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err.Error())
+	}
+	if res := applyKvCommand(t, r, 6, cmds[3]); res != "-bar" {
+		t.Fatalf("expected cached result after restore, got %q", res)
+	}
+	if r.m.Len() != 1 {
+		t.Fatalf("deduplication entries restored as keys, got %d keys", r.m.Len())
+	}
+}
+
+func applyKvCommand(t *testing.T, s *Store, ind uint64, cmd *kvpb.Command) interface{} {
+	raw, err := proto.Marshal(cmd)
+	if err != nil {
+		t.Fatalf("failed to marshal command: %s", err.Error())
+	}
+	return (*fsm)(s).Apply(&raft.Log{Index: ind, Data: raw})
+}
+
+func TestScan(t *testing.T) {
+	s := newLoggedStore(t, DiskTrad)
+	s.compress = true
+	for i, k := range []string{"c", "a", "d", "b"} {
+		applyCommand(t, s, uint64(i+1), &pb.Command{Op: pb.Command_SET, Key: k, Value: k + k})
+	}
+	applyCommand(t, s, 5, &pb.Command{Op: pb.Command_DELETE, Key: "c"})
+
+	res := applyKvCommand(t, s, 6, &kvpb.Command{Op: kvpb.Command_SCAN, Key: "b", Count: 5}).(string)
+	pairs, err := wire.DecodePairs([]byte(strings.TrimPrefix(res, "-")))
+	if err != nil {
+		t.Fatalf("failed to decode scan result: %s", err.Error())
+	}
+	exp := []wire.Pair{{Key: "b", Value: []byte("bb")}, {Key: "d", Value: []byte("dd")}}
+	if !reflect.DeepEqual(exp, pairs) {
+		t.Fatalf("expected %v, got %v", exp, pairs)
+	}
+
+	// scans are logged as reads, leaving the recovered state unchanged
+	if state := recoverStateFromLog(t, s, 1, 6); len(state) != 3 || state["a"] != "aa" {
+		t.Fatalf("unexpected state recovered after a scan: %v", state)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	s := newLoggedStore(t, BeelogAVL)
+	fields := func(kv ...string) []*kvpb.Command_Field {
+		var fds []*kvpb.Command_Field
+		for i := 0; i < len(kv); i += 2 {
+			fds = append(fds, &kvpb.Command_Field{Name: kv[i], Value: kv[i+1]})
+		}
+		return fds
+	}
+
+	cmds := []*kvpb.Command{
+		{Op: kvpb.Command_PUTRECORD, Key: "user1", Fields: fields("f0", "a", "f1", "b", "f2", "c")},
+		{Op: kvpb.Command_SETFIELDS, Key: "user1", Fields: fields("f1", "B", "f3", "d")},
+		{Op: kvpb.Command_SETFIELDS, Key: "user2", Fields: fields("f0", "x")},
+		{Op: kvpb.Command_PUTRECORD, Key: "user2", Fields: fields("f1", "y")},
+	}
+	for i, cmd := range cmds {
+		applyKvCommand(t, s, uint64(i+1), cmd)
+	}
+
+	get := func(ind uint64, key string, names ...string) map[string][]byte {
+		var fds []*kvpb.Command_Field
+		for _, n := range names {
+			fds = append(fds, &kvpb.Command_Field{Name: n})
+		}
+		res := applyKvCommand(t, s, ind, &kvpb.Command{Op: kvpb.Command_GETFIELDS, Key: key, Fields: fds}).(string)
+		values, err := record.Decode([]byte(strings.TrimPrefix(res, "-")))
+		if err != nil {
+			t.Fatalf("failed to decode record: %s", err.Error())
+		}
+		return values
+	}
+
+	exp := map[string][]byte{"f0": []byte("a"), "f1": []byte("B"), "f2": []byte("c"), "f3": []byte("d")}
+	if got := get(5, "user1"); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	exp = map[string][]byte{"f1": []byte("B"), "f3": []byte("d")}
+	if got := get(6, "user1", "f1", "f3", "missing"); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	exp = map[string][]byte{"f1": []byte("y")}
+	if got := get(7, "user2"); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected replaced record %v, got %v", exp, got)
+	}
+	if got := get(8, "missing"); len(got) != 0 {
+		t.Fatalf("expected an empty record, got %v", got)
+	}
+
+	// record writes are logged as the SET of the entire record, so beelog reduction
+	// retaining only the latest one still recovers every field
+	state := recoverStateFromLog(t, s, 1, 8)
+	if rec, _ := record.Decode([]byte(state["user1"])); !reflect.DeepEqual(rec, get(9, "user1")) {
+		t.Fatalf("unexpected record recovered: %v", state["user1"])
+	}
+}
+
+func TestConditionalCommands(t *testing.T) {
+	for _, ls := range []LogStrategy{DiskTrad, BeelogList, BeelogAVL, BeelogConcTable} {
+		s := newLoggedStore(t, ls)
+		var ind uint64
+		apply := func(cmd *kvpb.Command) string {
+			ind++
+			return strings.TrimPrefix(applyKvCommand(t, s, ind, cmd).(string), "-")
+		}
+
+		apply(&kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar"})
+		steps := []struct {
+			cmd *kvpb.Command
+			exp string
+		}{
+			{&kvpb.Command{Op: kvpb.Command_CAS, Key: "foo", Expected: "wrong", Value: "x"}, "0"},
+			{&kvpb.Command{Op: kvpb.Command_CAS, Key: "foo", Expected: "bar", Value: "baz"}, "3"},
+			{&kvpb.Command{Op: kvpb.Command_CAS, Key: "foo", Version: 1, Value: "x"}, "0"},
+			{&kvpb.Command{Op: kvpb.Command_CAS, Key: "foo", Version: 3, Value: "qux"}, "5"},
+			{&kvpb.Command{Op: kvpb.Command_CAS, Key: "missing", Value: "x"}, "0"},
+			{&kvpb.Command{Op: kvpb.Command_SETNX, Key: "foo", Value: "x"}, "0"},
+			{&kvpb.Command{Op: kvpb.Command_SETNX, Key: "lock", Value: "owner"}, "8"},
+			{&kvpb.Command{Op: kvpb.Command_INCR, Key: "counter"}, "1"},
+			{&kvpb.Command{Op: kvpb.Command_INCR, Key: "counter", Delta: 10}, "11"},
+			{&kvpb.Command{Op: kvpb.Command_DECR, Key: "counter", Delta: 20}, "-9"},
+			{&kvpb.Command{Op: kvpb.Command_INCR, Key: "foo"}, errNotInteger},
+
+			// aborted, since the last CAS fails after the counter is incremented
+			{&kvpb.Command{Op: kvpb.Command_TXN, Txn: []*kvpb.Command{
+				{Op: kvpb.Command_INCR, Key: "counter"},
+				{Op: pb.Command_DELETE, Key: "lock"},
+				{Op: kvpb.Command_CAS, Key: "counter", Expected: "-9", Value: "0"},
+			}}, "0"},
+			{&kvpb.Command{Op: kvpb.Command_TXN, Txn: []*kvpb.Command{
+				{Op: kvpb.Command_INCR, Key: "counter"},
+				{Op: pb.Command_DELETE, Key: "lock"},
+				{Op: kvpb.Command_CAS, Key: "counter", Expected: "-8", Value: "100"},
+				{Op: pb.Command_SET, Key: "new", Value: "key"},
+			}}, "14"},
+			{&kvpb.Command{Op: kvpb.Command_TXN, Txn: []*kvpb.Command{
+				{Op: pb.Command_GET, Key: "foo"},
+			}}, "0"},
+		}
+		for i, st := range steps {
+			if res := apply(st.cmd); res != st.exp {
+				t.Fatalf("%s: expected reply %q on step %d, got %q", ls, st.exp, i, res)
+			}
+		}
+
+		exp := map[string]string{"foo": "qux", "counter": "100", "new": "key"}
+		for key, value := range exp {
+			if v := s.testGet(key); v != value {
+				t.Fatalf("%s: expected '%s' on key '%s', got '%s'", ls, value, key, v)
+			}
+		}
+		if _, ok, _ := s.m.Get("lock"); ok {
+			t.Fatalf("%s: key deleted by a transaction still present", ls)
+		}
+
+		// every command is logged as its effect, recovering the same state
+		if state := recoverStateFromLog(t, s, 1, ind); !reflect.DeepEqual(exp, state) {
+			t.Fatalf("%s: expected recovered state %v, got %v", ls, exp, state)
+		}
+
+		// transactions are logged as the write of each key, reduced once overwritten, except
+		// on the AVL tree and the concurrent table
+		apply(&kvpb.Command{Op: pb.Command_SET, Key: "counter", Value: "0"})
+		apply(&kvpb.Command{Op: pb.Command_SET, Key: "new", Value: "0"})
+		writes := 0
+		for _, cmd := range recoverLog(t, s, 1, ind) {
+			if cmd.Id == 14 && cmd.Op != pb.Command_GET {
+				writes++
+			}
+		}
+		if exp := map[LogStrategy]int{DiskTrad: 3, BeelogList: 1, BeelogAVL: 1, BeelogConcTable: 1}[ls]; writes != exp {
+			t.Fatalf("%s: expected %d writes logged by the transaction, got %d", ls, exp, writes)
+		}
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	s := NewStore(context.TODO(), true)
+	if err := s.StartRaft(true, "node0", freeAddr(t)); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.raft.Shutdown()
+	waitLeader(t, s)
+
+	cmd := &pb.Command{
+		Op:    pb.Command_SET,
+		Key:   "foo",
+		Value: "bar",
+	}
+	bytes, _ := proto.Marshal(cmd)
+	if err := s.Propose(bytes, nil, nil); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+
+	last := s.raft.LastIndex()
+	value, err := s.ReadIndex("foo")
+	if err != nil {
+		t.Fatalf("failed to read key: %s", err.Error())
+	}
+	if value != "bar" {
+		t.Fatalf("key has wrong value: %s", value)
+	}
+
+	scan, err := s.ScanIndex("foo", 1)
+	if err != nil {
+		t.Fatalf("failed to scan keys: %s", err.Error())
+	}
+	if pairs, _ := wire.DecodePairs([]byte(scan)); len(pairs) != 1 || pairs[0].Key != "foo" {
+		t.Fatalf("unexpected scan result: %v", pairs)
+	}
+
+	if ind := s.raft.LastIndex(); ind != last {
+		t.Fatalf("read appended entries to the raft log, last index %d, expected %d", ind, last)
+	}
+}
+
+func TestSessionReply(t *testing.T) {
+	s := NewStore(context.TODO(), true)
+	if err := s.StartRaft(true, "node0", freeAddr(t)); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.raft.Shutdown()
+	waitLeader(t, s)
+
+	srvConn, cliConn := net.Pipe()
+	session := NewSession(srvConn, 0)
+	defer session.Disconnect()
+
+	cmds := []*kvpb.Command{
+		{Op: pb.Command_SET, Key: "foo", Value: "bar", ReqId: 1, Reply: kvpb.Command_SESSION},
+		{Op: pb.Command_GET, Key: "foo", ReqId: 2, Reply: kvpb.Command_SESSION},
+		{Op: pb.Command_GET, Key: "foo", ReqId: 3, Reply: kvpb.Command_SESSION, Read: kvpb.Command_INDEX},
+	}
+	exp := []string{"OK: ", "OK: bar", "OK: bar"}
+
+	for i, cmd := range cmds {
+		raw, _ := proto.Marshal(cmd)
+		go func() {
+			if err := s.Propose(raw, &Server{}, &Request{Command: raw, Session: session}); err != nil {
+				t.Errorf("failed to propose command: %s", err.Error())
+			}
+		}()
+
+		typ, payload, err := wire.ReadFrame(cliConn)
+		if err != nil || typ != wire.MsgReply {
+			t.Fatalf("failed to read reply frame, type %d, err: %v", typ, err)
+		}
+		id, rep, err := wire.DecodeReply(payload)
+		if err != nil {
+			t.Fatalf("failed to decode reply: %s", err.Error())
+		}
+		if id != cmd.ReqId || string(rep) != exp[i] {
+			t.Fatalf("expected reply %d %q, got %d %q", cmd.ReqId, exp[i], id, rep)
+		}
+	}
+}
+
+func TestAdvertisedAddrsSnapshot(t *testing.T) {
+	s := newLoggedStore(t, InmemTrad)
+	applyKvCommand(t, s, 1, &kvpb.Command{Op: kvpb.Command_ADVERTISE, Key: peerKey(":12000"), Value: ":11000"})
+	applyKvCommand(t, s, 2, &kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar"})
+	if len(*s.inMemLog) != 1 || s.m.Len() != 1 {
+		t.Fatalf("expected advertised addresses neither logged nor stored, got %d logged and %d keys", len(*s.inMemLog), s.m.Len())
+	}
+	if res := (*fsm)(s).applyScan("", 10); res != string(wire.EncodePairs([]wire.Pair{{Key: "foo", Value: []byte("bar")}})) {
+		t.Fatalf("expected only 'foo' scanned, got %q", res)
+	}
+
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %s", err.Error())
+	}
+	sink := &memSink{}
+	if err = snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err.Error())
+	}
+	r := newLoggedStore(t, NotLog)
+	if err = (*fsm)(r).Restore(ioutil.NopCloser(sink)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err.Error())
+	}
+	if addr := r.peers.get(peerKey(":12000")); addr != ":11000" || r.m.Len() != 1 {
+		t.Fatalf("expected address ':11000' restored apart from %d keys, got '%s'", r.m.Len(), addr)
+	}
+}
+
+func TestFollowerRedirect(t *testing.T) {
+	leaderAddr, followerAddr := freeAddr(t), freeAddr(t)
+	leader := startClusterNode(t, "node0", leaderAddr, ":11004", true)
+	defer stopClusterNode(leader)
+	follower := startClusterNode(t, "node1", followerAddr, ":11005", false)
+	defer stopClusterNode(follower)
+
+	waitLeader(t, leader)
+	if err := leader.JoinRaft("node1", followerAddr, true); err != nil {
+		t.Fatalf("failed to join follower: %s", err.Error())
+	}
+
+	// the leader advertises its client address through the raft log
+	waitFor(t, "the leader address on the follower", func() bool {
+		return follower.leaderClientAddr() == ":11004"
+	})
+
+	// advertised addresses are kept apart from the key-value state, and reserved to replicas
+	if _, ok, _ := follower.m.Get(peerKey(leaderAddr)); ok {
+		t.Fatal("expected the leader address apart from the follower state")
+	}
+	adv := &kvpb.Command{Op: kvpb.Command_ADVERTISE, Key: peerKey(leaderAddr), Value: ":11666", Reply: kvpb.Command_SESSION}
+	if rep, _ := proposeOnSession(t, leader, adv); rep != "OK: "+errInternalCommand {
+		t.Fatalf("expected advertises from clients rejected, got: %q", rep)
+	}
+
+	cmd := &kvpb.Command{Op: pb.Command_SET, Key: "foo", Value: "bar", Reply: kvpb.Command_SESSION}
+	if rep, ok := proposeOnSession(t, follower, cmd); ok {
+		t.Fatalf("follower replied to a command not requesting redirect: %q", rep)
+	}
+
+	cmd.Redirect = true
+	if rep, _ := proposeOnSession(t, follower, cmd); rep != "NOT_LEADER :11004" {
+		t.Fatalf("expected a redirect to the leader, got: %q", rep)
+	}
+	if rep, _ := proposeOnSession(t, leader, cmd); rep != "OK: " {
+		t.Fatalf("expected leader to apply the command, got: %q", rep)
+	}
+}
+
+func startClusterNode(t testing.TB, id, raftAddr, clientAddr string, bootstrap bool) *Store {
+	dir, err := ioutil.TempDir("", "beelog-hraft")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+
+	s := NewStore(context.TODO(), true)
+	s.RaftDir = dir
+	s.ClientAddr = clientAddr
+	if err := s.StartRaft(bootstrap, id, raftAddr); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	return s
+}
+
+// freeAddr returns a ":<port>" address on a port currently free, for nodes started by tests.
+func freeAddr(t testing.TB) string {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %s", err.Error())
+	}
+	defer l.Close()
+	return ":" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+// waitLeader waits until 's' is elected the leader.
+func waitLeader(t testing.TB, s *Store) {
+	waitFor(t, "leader election", func() bool {
+		return s.raft.State() == raft.Leader
+	})
+}
+
+func stopClusterNode(s *Store) {
+	s.stopAdvertising()
+	s.raft.Shutdown().Error()
+	s.transport.Close()
+	os.RemoveAll(s.RaftDir)
+}
+
+// proposeOnSession proposes 'cmd' on 's' as if received from a client session, returning
+// its reply, if any is received in a second.
+func proposeOnSession(t *testing.T, s *Store, cmd *kvpb.Command) (string, bool) {
+	srvConn, cliConn := net.Pipe()
+	session := NewSession(srvConn, 0)
+	defer session.Disconnect()
+
+	raw, _ := proto.Marshal(cmd)
+	if err := s.Propose(raw, &Server{}, &Request{Command: raw, Session: session}); err != nil {
+		t.Fatalf("failed to propose command: %s", err.Error())
+	}
+
+	cliConn.SetReadDeadline(time.Now().Add(time.Second))
+	typ, payload, err := wire.ReadFrame(cliConn)
+	if err != nil || typ != wire.MsgReply {
+		return "", false
+	}
+	_, rep, err := wire.DecodeReply(payload)
+	if err != nil {
+		t.Fatalf("failed to decode reply: %s", err.Error())
+	}
+	return string(rep), true
+}
+
+func TestRestartWithDurableRaftStore(t *testing.T) {
+	prev := *raftStore
+	*raftStore = "file"
+	defer func() { *raftStore = prev }()
+
+	dir, err := ioutil.TempDir("", "beelog-hraft")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	addr := freeAddr(t)
+	s := startDurableStore(t, dir, addr)
+	cmd := &pb.Command{
+		Op:    pb.Command_SET,
+		Key:   "foo",
+		Value: "bar",
+	}
+	bytes, _ := proto.Marshal(cmd)
+	if err := s.Propose(bytes, nil, nil); err != nil {
+		t.Fatalf("failed to set key: %s", err.Error())
+	}
+	term := s.raft.Stats()["term"]
+	stopDurableStore(t, s)
+
+	// restarts the node from the same raft directory and address
+	s = startDurableStore(t, dir, addr)
+	defer stopDurableStore(t, s)
+
+	ind, err := s.lastCommandIndex(s.raft.LastIndex())
+	if err != nil {
+		t.Fatalf("failed to read raft log: %s", err.Error())
+	}
+	if err = s.waitApplied(ind, raftTimeout); err != nil {
+		t.Fatalf("failed to replay log: %s", err.Error())
+	}
+	if value := s.testGet("foo"); value != "bar" {
+		t.Fatalf("key has wrong value after restart: %s", value)
+	}
+
+	prevTerm, _ := strconv.Atoi(term)
+	curTerm, _ := strconv.Atoi(s.raft.Stats()["term"])
+	if curTerm <= prevTerm {
+		t.Fatalf("expected a term greater than %d after restart, got %d", prevTerm, curTerm)
+	}
+}
+
+func startDurableStore(t *testing.T, dir, addr string) *Store {
+	s := NewStore(context.TODO(), true)
+	s.RaftDir = dir
+	if err := s.StartRaft(true, "node0", addr); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	waitLeader(t, s)
+	return s
+}
+
+func stopDurableStore(t *testing.T, s *Store) {
+	if err := s.raft.Shutdown().Error(); err != nil {
+		t.Fatalf("failed to shutdown raft: %s", err.Error())
+	}
+	s.transport.Close()
+	s.logStore.(*raftstore.FileStore).Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// entryMarker prefixes values stored by the fsm, followed by the uvarint modification index
+// and version of the key, then the (possibly compressed) value. Every value is stored with
+// it, including pre-initialized ones and those restored from older snapshots, so entries are
+// never mistaken for raw values.
+const entryMarker byte = 0xFF
+
+var errMalformedEntry = errors.New("malformed stored entry")
+
+// revision identifies a write on a key: the raft index it was applied on, and the number of
+// writes on the key since it was created, starting from one. Pre-initialized values are
+// reported on index zero and version one.
+type revision struct {
+	modIndex uint64
+	version  uint64
+}
+
+// next returns the revision of a write on index 'index' following 'rev', the zero revision
+// if the key is missing.
+func (rev revision) next(index uint64) revision {
+	return revision{modIndex: index, version: rev.version + 1}
+}
+
+// encodeEntry returns the stored representation of 'value' written on revision 'rev'.
+func encodeEntry(rev revision, value []byte) []byte {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64+len(value))
+	buf[0] = entryMarker
+	n := 1 + binary.PutUvarint(buf[1:], rev.modIndex)
+	n += binary.PutUvarint(buf[n:], rev.version)
+	return append(buf[:n], value...)
+}
+
+// decodeEntry returns the revision and value of a stored entry, failing with
+// errMalformedEntry if it wasn't encoded by encodeEntry.
+func decodeEntry(entry []byte) (revision, []byte, error) {
+	if len(entry) == 0 || entry[0] != entryMarker {
+		return revision{}, nil, errMalformedEntry
+	}
+	rev, n := decodeRevision(entry[1:])
+	if n <= 0 {
+		return revision{}, nil, errMalformedEntry
+	}
+	return rev, entry[1+n:], nil
+}
+
+// encodeRevision returns 'rev' as written on snapshots, along the value of its key.
+func encodeRevision(rev revision) []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, rev.modIndex)
+	n += binary.PutUvarint(buf[n:], rev.version)
+	return buf[:n]
+}
+
+// decodeRevision parses a revision encoded by encodeRevision at the start of 'buf',
+// returning the number of bytes read, or zero if malformed.
+func decodeRevision(buf []byte) (revision, int) {
+	modIndex, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return revision{}, 0
+	}
+	version, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return revision{}, 0
+	}
+	return revision{modIndex, version}, n + m
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"beelog-hraft/applog"
+	"beelog-hraft/kvpb"
+	"beelog-hraft/wire"
+
+	bl "github.com/Lz-Gustavo/beelog"
+	"github.com/Lz-Gustavo/beelog/pb"
+)
+
+const (
+	// watchBufferSize bounds the indexes whose changes are pending on each watch. Watches
+	// not consuming them fast enough are cancelled, and must be resumed from the latest
+	// index received.
+	watchBufferSize = 1024
+
+	// replies to watches that can't be served or were cancelled
+	errWatchSession  = "ERR watches require session replies"
+	errWatchOverflow = "ERR watch overflow"
+
+	// watchReduced flags the first reply of resumed watches whose missed changes were
+	// retrieved from a reduced log, eliding every change superseded by a later write.
+	watchReduced = "reduced"
+)
+
+var (
+	errLogCompacted  = errors.New(errIndexCompacted)
+	errLogIncomplete = errors.New("ERR application log cannot resume watches")
+)
+
+// watch is a subscription of a client session to the changes on 'key', or on every key
+// prefixed by it. Changes applied on the same index are delivered together.
+type watch struct {
+	key     string
+	prefix  bool
+	changes chan []wire.Change // closed on overflow
+}
+
+func (w *watch) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// watchHub delivers the changes applied by the fsm to every watch. The fsm holds 'mu' while
+// applying each command, then publishes its changes at once, so watches are registered
+// between raft indexes and never observe only part of a command.
+type watchHub struct {
+	mu      sync.Mutex
+	watches map[*watch]struct{}
+	index   uint64 // latest index applied
+	pending []wire.Change
+}
+
+// begin must be called by the fsm before applying a command.
+func (h *watchHub) begin() {
+	h.mu.Lock()
+}
+
+// record registers 'c' to be published once the command being applied is committed. Must
+// be called between begin and commit.
+func (h *watchHub) record(c wire.Change) {
+	if len(h.watches) > 0 {
+		h.pending = append(h.pending, c)
+	}
+}
+
+// commit publishes the changes recorded for the command applied at raft index 'index'.
+// Watches with no room for them are removed and their channel closed.
+func (h *watchHub) commit(index uint64) {
+	defer h.mu.Unlock()
+	h.index = index
+	if len(h.pending) == 0 {
+		return
+	}
+
+	for w := range h.watches {
+		var matched []wire.Change
+		for _, c := range h.pending {
+			if w.matches(c.Key) {
+				matched = append(matched, c)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		select {
+		case w.changes <- matched:
+		default:
+			delete(h.watches, w)
+			close(w.changes)
+		}
+	}
+	h.pending = h.pending[:0]
+}
+
+// add registers 'w', returning the latest index applied. Every change applied after it is
+// delivered to 'w'.
+func (h *watchHub) add(w *watch) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watches == nil {
+		h.watches = make(map[*watch]struct{})
+	}
+	h.watches[w] = struct{}{}
+	return h.index
+}
+
+func (h *watchHub) remove(w *watch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.watches, w)
+}
+
+// watch subscribes the session of 'origin' to the changes requested by 'cmd'. The first
+// reply informs the index the watch starts after, followed by a reply carrying the changes
+// of each index applied from then on, encoded by wire.EncodeChanges. If 'cmd' informs a
+// previous index, the changes applied after it are replied first, retrieved by
+// missedChanges. The first reply is then flagged by 'watchReduced' if intermediate changes
+// were elided.
+func (s *Store) watch(cmd *kvpb.Command, svr *Server, origin *Request) error {
+	if origin == nil || origin.Session == nil || cmd.Reply != kvpb.Command_SESSION {
+		return svr.reply(origin, cmd, "OK: "+errWatchSession)
+	}
+
+	w := &watch{key: cmd.Key, prefix: cmd.Prefix, changes: make(chan []wire.Change, watchBufferSize)}
+	start := s.watches.add(w)
+
+	var (
+		missed  []wire.Change
+		reduced bool
+	)
+	if cmd.Index > 0 && cmd.Index < start {
+		var err error
+		missed, reduced, err = s.missedChanges(w, cmd.Index, start)
+		if err != nil {
+			s.watches.remove(w)
+			return svr.reply(origin, cmd, "OK: "+err.Error())
+		}
+	}
+
+	ack := "OK: " + strconv.FormatUint(start, 10)
+	if reduced {
+		ack += " " + watchReduced
+	}
+	if err := svr.reply(origin, cmd, ack); err != nil {
+		s.watches.remove(w)
+		return err
+	}
+	origin.Session.addWatch()
+	go s.streamWatch(w, origin.Session, cmd.ReqId, missed)
+	return nil
+}
+
+// missedChanges returns the changes matched by 'w' applied after raft index 'index' up to
+// 'start'. They're retrieved from the history if it still retains them, informing their
+// versions, or else from the application log. Reports whether the log was reduced,
+// retaining only the latest write on each key.
+func (s *Store) missedChanges(w *watch, index, start uint64) ([]wire.Change, bool, error) {
+	if changes, ok := (*fsm)(s).retainedChanges(w.matches, index, start); ok {
+		return changes, false, nil
+	}
+
+	cmds, reduced, err := s.loggedCommands(index+1, start)
+	if err != nil {
+		return nil, false, err
+	}
+	logged, err := loggedChanges(cmds)
+	if err != nil {
+		return nil, false, err
+	}
+	var changes []wire.Change
+	for _, c := range logged {
+		if w.matches(c.Key) {
+			changes = append(changes, c)
+		}
+	}
+	return changes, reduced, nil
+}
+
+// streamWatch replies the changes 'missed' before subscribing, then every change delivered
+// to 'w', until the session is disconnected or 'w' overflows. Changes of the same index are
+// replied together.
+func (s *Store) streamWatch(w *watch, session *Session, id uint64, missed []wire.Change) {
+	defer session.removeWatch()
+	defer s.watches.remove(w)
+	for len(missed) > 0 {
+		i := 1
+		for i < len(missed) && missed[i].Index == missed[0].Index {
+			i++
+		}
+		if err := session.Reply(id, "OK: "+string(wire.EncodeChanges(missed[:i]))); err != nil {
+			return
+		}
+		missed = missed[i:]
+	}
+
+	for {
+		select {
+		case <-session.ctx.Done():
+			return
+
+		case changes, ok := <-w.changes:
+			if !ok {
+				session.Reply(id, "OK: "+errWatchOverflow)
+				return
+			}
+			if err := session.Reply(id, "OK: "+string(wire.EncodeChanges(changes))); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// loggedCommands returns the commands on the application log from index 'p' up to 'n', in
+// index order. Beelog structures reply their reduced log, retaining only the latest write
+// on each key, and report it. Fails if the log doesn't retain every command since 'p',
+// either because it was compacted by a snapshot, or because it's only reduced on intervals
+// (i.e. on ConcTable structures, persisted as a sequence of reduced logs).
+func (s *Store) loggedCommands(p, n uint64) ([]pb.Command, bool, error) {
+	var (
+		cmds    []pb.Command
+		reduced bool
+		err     error
+	)
+	switch s.Logging {
+	case DiskTrad, InmemTrad:
+		if p <= atomic.LoadUint64(&s.snapIndex) {
+			return nil, false, errLogCompacted
+		}
+		if s.Logging == InmemTrad {
+			s.mu.Lock()
+			cmds = bl.RetainLogInterval(s.inMemLog, p, n)
+			s.mu.Unlock()
+			break
+		}
+
+		s.logMu.RLock()
+		cmds, err = s.readDiskLog()
+		s.logMu.RUnlock()
+
+	case BeelogList, BeelogArray, BeelogAVL:
+		// logs reduced on intervals miss every command since the latest reduce
+		if s.beelogTick == bl.Interval {
+			return nil, false, errLogIncomplete
+		}
+		cmds, err = s.st.Recov(p, n)
+		reduced = true
+
+	default:
+		return nil, false, errLogIncomplete
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("ERR %s", err.Error())
+	}
+
+	retained := make([]pb.Command, 0, len(cmds))
+	for _, c := range cmds {
+		if c.Id >= p && c.Id <= n {
+			retained = append(retained, c)
+		}
+	}
+	sort.SliceStable(retained, func(i, j int) bool {
+		return retained[i].Id < retained[j].Id
+	})
+	return retained, reduced, nil
+}
+
+// loggedChanges translates the commands logged by LogCommand into the changes they applied,
+// ignoring reads. Versions aren't logged, so every change is informed on version zero.
+func loggedChanges(cmds []pb.Command) ([]wire.Change, error) {
+	var changes []wire.Change
+	err := applog.Replay(cmds, func(index uint64, w applog.Write) {
+		changes = append(changes, wire.Change{Index: index, Key: w.Key, Value: w.Value, Deleted: w.Deleted})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ERR %s", err.Error())
+	}
+	return changes, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"beelog-hraft/applog"
+	"beelog-hraft/kvpb"
+	"beelog-hraft/wire"
+
+	"github.com/Lz-Gustavo/beelog/pb"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestWatch(t *testing.T) {
+	prev := cfg
+	defer func() { cfg = prev }()
+	cfg = defaultConfig()
+	cfg.LogStrategy, cfg.PreInitialize = "InmemTrad", false
+	if err := cfg.validate(""); err != nil {
+		t.Fatalf("failed to validate config: %s", err.Error())
+	}
+
+	s := startClusterNode(t, "node0", freeAddr(t), "", true)
+	defer stopClusterNode(s)
+	waitLeader(t, s)
+
+	propose := func(cmd *kvpb.Command) {
+		cmd.Reply = kvpb.Command_SESSION
+		if rep, _ := proposeOnSession(t, s, cmd); rep != "OK: " {
+			t.Fatalf("failed to apply %v, got reply: %q", cmd, rep)
+		}
+	}
+	propose(&kvpb.Command{Op: pb.Command_SET, Key: "a", Value: "1"})
+
+	conn, start := watchOnSession(t, s, &kvpb.Command{Op: kvpb.Command_WATCH, Key: "a", Prefix: true})
+	propose(&kvpb.Command{Op: pb.Command_SET, Key: "ab", Value: "2"})
+	propose(&kvpb.Command{Op: pb.Command_SET, Key: "b", Value: "3"})
+	propose(&kvpb.Command{Op: pb.Command_DELETE, Key: "a"})
+
+	exp := []wire.Change{
+		{Index: start + 1, Version: 1, Key: "ab", Value: []byte("2")},
+		{Index: start + 3, Key: "a", Value: []byte{}, Deleted: true},
+	}
+	for _, e := range exp {
+		if got := readChanges(t, conn); !reflect.DeepEqual([]wire.Change{e}, got) {
+			t.Fatalf("expected change %v, got %v", e, got)
+		}
+	}
+
+	// resumed watches catch up from the history, retaining every change with its version
+	conn, resumed := watchOnSession(t, s, &kvpb.Command{Op: kvpb.Command_WATCH, Key: "a", Prefix: true, Index: start - 1})
+	if resumed != start+3 {
+		t.Fatalf("expected resumed watch to start after index %d, got %d", start+3, resumed)
+	}
+	propose(&kvpb.Command{Op: pb.Command_SET, Key: "a", Value: "4"})
+
+	exp = []wire.Change{
+		{Index: start, Version: 1, Key: "a", Value: []byte("1")},
+		{Index: start + 1, Version: 1, Key: "ab", Value: []byte("2")},
+		{Index: start + 3, Key: "a", Value: []byte{}, Deleted: true},
+		{Index: start + 4, Version: 1, Key: "a", Value: []byte("4")},
+	}
+	for _, e := range exp {
+		if got := readChanges(t, conn); !reflect.DeepEqual([]wire.Change{e}, got) {
+			t.Fatalf("expected change %v, got %v", e, got)
+		}
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	strategies := []LogStrategy{DiskTrad, InmemTrad, BeelogList, BeelogArray, BeelogAVL, BeelogConcTable}
+	cmds := []*kvpb.Command{
+		{Op: pb.Command_SET, Key: "a", Value: "1"},
+		{Op: pb.Command_SET, Key: "ab", Value: "2"},
+		{Op: pb.Command_SET, Key: "a", Value: "3"},
+		{Op: pb.Command_DELETE, Key: "ab"},
+		{Op: pb.Command_SET, Key: "b", Value: "4"},
+	}
+	retained := []wire.Change{
+		{Index: 2, Version: 1, Key: "ab", Value: []byte("2")},
+		{Index: 3, Version: 2, Key: "a", Value: []byte("3")},
+		{Index: 4, Key: "ab", Value: []byte{}, Deleted: true},
+	}
+	logged := []wire.Change{
+		{Index: 2, Key: "ab", Value: []byte("2")},
+		{Index: 3, Key: "a", Value: []byte("3")},
+		{Index: 4, Key: "ab", Value: []byte{}, Deleted: true},
+	}
+
+	for _, ls := range strategies {
+		for _, window := range []uint64{0, 16} {
+			s := newLoggedStore(t, ls)
+			s.hist.window = window
+			for i, cmd := range cmds {
+				applyKvCommand(t, s, uint64(i+1), cmd)
+			}
+			watch := func(cmd *kvpb.Command, raw []byte, req *Request) error {
+				return s.watch(cmd, &Server{}, req)
+			}
+			conn, ack := subscribe(t, &kvpb.Command{Op: kvpb.Command_WATCH, Key: "a", Prefix: true, Index: 1}, watch)
+
+			// changes retained by the history are exact on every strategy, while reduced logs
+			// only retain the latest write on each key
+			expAck, exp := "OK: 5", retained
+			switch {
+			case window > 0:
+			case ls == DiskTrad, ls == InmemTrad:
+				exp = logged
+			case ls == BeelogConcTable:
+				expAck, exp = "OK: "+errLogIncomplete.Error(), nil
+			default:
+				expAck, exp = "OK: 5 "+watchReduced, logged[1:]
+			}
+			if ack != expAck {
+				t.Fatalf("%s: expected watch reply %q on window %d, got %q", ls, expAck, window, ack)
+			}
+			for _, e := range exp {
+				if got := readChanges(t, conn); !reflect.DeepEqual([]wire.Change{e}, got) {
+					t.Fatalf("%s: expected change %v on window %d, got %v", ls, e, window, got)
+				}
+			}
+		}
+	}
+}
+
+func TestWatchKeepsIdleSession(t *testing.T) {
+	s := newLoggedStore(t, NotLog)
+	srvConn, cliConn := net.Pipe()
+	session := NewSession(srvConn, 100*time.Millisecond)
+	defer session.Disconnect()
+
+	cmd := &kvpb.Command{Op: kvpb.Command_WATCH, Key: "a", ReqId: 1, Reply: kvpb.Command_SESSION}
+	go func() {
+		if err := s.watch(cmd, &Server{}, &Request{Session: session}); err != nil {
+			t.Errorf("failed to watch: %s", err.Error())
+		}
+	}()
+	if rep := readWatchReply(t, cliConn); rep != "OK: 0" {
+		t.Fatalf("unexpected watch reply %q", rep)
+	}
+
+	// sessions only receiving notifications outlive the idle timeout
+	time.Sleep(300 * time.Millisecond)
+	applyKvCommand(t, s, 1, &kvpb.Command{Op: pb.Command_SET, Key: "a", Value: "1"})
+	exp := []wire.Change{{Index: 1, Version: 1, Key: "a", Value: []byte("1")}}
+	if got := readChanges(t, cliConn); !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected change %v, got %v", exp, got)
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	var h watchHub
+	w := &watch{key: "a", changes: make(chan []wire.Change, 1)}
+	h.add(w)
+
+	for ind := uint64(1); ind <= 3; ind++ {
+		h.begin()
+		h.record(wire.Change{Index: ind, Key: "b"})
+		h.record(wire.Change{Index: ind, Key: "a", Value: []byte(strconv.FormatUint(ind, 10))})
+		h.commit(ind)
+	}
+	if changes := <-w.changes; len(changes) != 1 || changes[0].Index != 1 {
+		t.Fatalf("expected the only change on 'a' at index 1, got %v", changes)
+	}
+	if _, ok := <-w.changes; ok {
+		t.Fatal("expected an overflowed watch to be closed")
+	}
+	if len(h.watches) != 0 || h.index != 3 {
+		t.Fatalf("expected overflowed watch removed, got %d watches on index %d", len(h.watches), h.index)
+	}
+}
+
+func TestLoggedChanges(t *testing.T) {
+	writes := []applog.Write{{Key: "b", Value: []byte("2")}, {Key: "a", Deleted: true}}
+	cmds := []pb.Command{
+		{Id: 1, Op: pb.Command_SET, Key: "a", Value: "1"},
+		{Id: 2, Op: pb.Command_GET, Key: "a"},
+		applog.NewTombstone(3, "b"),
+		applog.NewTxn(4, writes),
+		{Id: 5, Op: pb.Command_DELETE, Key: "b"},
+	}
+	exp := []wire.Change{
+		{Index: 1, Key: "a", Value: []byte("1")},
+		{Index: 3, Key: "b", Deleted: true},
+		{Index: 4, Key: "a", Deleted: true},
+		{Index: 4, Key: "b", Value: []byte("2")},
+		{Index: 5, Key: "b", Deleted: true},
+	}
+	got, err := loggedChanges(cmds)
+	if err != nil || !reflect.DeepEqual(exp, got) {
+		t.Fatalf("expected changes %v, got %v (err: %v)", exp, got, err)
+	}
+}
+
+// watchOnSession proposes the WATCH 'cmd' on 's' from a new session, returning the client
+// end of the session and the index the watch starts after.
+func watchOnSession(t *testing.T, s *Store, cmd *kvpb.Command) (net.Conn, uint64) {
+	propose := func(cmd *kvpb.Command, raw []byte, req *Request) error {
+		return s.Propose(raw, &Server{}, req)
+	}
+	conn, rep := subscribe(t, cmd, propose)
+	start, err := strconv.ParseUint(strings.TrimPrefix(rep, "OK: "), 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected watch reply %q", rep)
+	}
+	return conn, start
+}
+
+// subscribe sends the WATCH 'cmd' from a new session through 'send', returning the client
+// end of the session and the first reply to the watch.
+func subscribe(t *testing.T, cmd *kvpb.Command, send func(*kvpb.Command, []byte, *Request) error) (net.Conn, string) {
+	srvConn, cliConn := net.Pipe()
+	session := NewSession(srvConn, 0)
+	t.Cleanup(session.Disconnect)
+
+	cmd.ReqId, cmd.Reply = 1, kvpb.Command_SESSION
+	raw, _ := proto.Marshal(cmd)
+	go func() {
+		if err := send(cmd, raw, &Request{Command: raw, Session: session}); err != nil {
+			t.Errorf("failed to send watch: %s", err.Error())
+		}
+	}()
+	return cliConn, readWatchReply(t, cliConn)
+}
+
+func readChanges(t *testing.T, conn net.Conn) []wire.Change {
+	rep := readWatchReply(t, conn)
+	changes, err := wire.DecodeChanges([]byte(strings.TrimPrefix(rep, "OK: ")))
+	if err != nil {
+		t.Fatalf("failed to decode changes %q: %s", rep, err.Error())
+	}
+	return changes
+}
+
+func readWatchReply(t *testing.T, conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, payload, err := wire.ReadFrame(conn)
+	if err != nil || typ != wire.MsgReply {
+		t.Fatalf("failed to read reply frame, type %d, err: %v", typ, err)
+	}
+	id, rep, err := wire.DecodeReply(payload)
+	if err != nil || id != 1 {
+		t.Fatalf("expected a reply to the watch, got %d %q (err: %v)", id, rep, err)
+	}
+	return string(rep)
+}
@@ -0,0 +1,268 @@
+// Package wire implements the framing of the client protocol, shared by beelog-hraft
+// replicas and clients. Every message is sent as a frame formatted as:
+//
+//	[u32 len][u8 version][u8 type][payload]
+//
+// where 'len' is the BigEndian size of the following bytes, including the version and
+// type. Since payloads are length-prefixed, arbitrary binary content is supported.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the latest protocol version, written on every frame.
+const Version byte = 1
+
+// MsgType identifies the content of a frame payload.
+type MsgType byte
+
+const (
+	// MsgCommand payloads are serialized kvpb.Command messages, proposed to the cluster.
+	MsgCommand MsgType = 1
+
+	// MsgReply payloads are replies written back on the client session, encoded by
+	// EncodeReply.
+	MsgReply MsgType = 2
+
+	// MsgClose signals a leaving client, carrying no payload.
+	MsgClose MsgType = 3
+)
+
+const (
+	// MaxFrameSize is the maximum size of a frame, excluding its length prefix. Larger
+	// frames are rejected, since a corrupted length could force huge allocations.
+	MaxFrameSize = 64 << 20
+
+	// frame header: length prefix, version and type.
+	headerSize = 6
+)
+
+var (
+	// ErrFrameTooLarge is returned when a frame exceeds MaxFrameSize.
+	ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+	// ErrMalformed is returned when a frame or reply is shorter than its header.
+	ErrMalformed = errors.New("malformed frame")
+
+	// ErrNotEscaped is returned when unescaping a string not produced by Escape.
+	ErrNotEscaped = errors.New("string not escaped")
+)
+
+// Marshal returns the frame of 'payload', informing type 'typ'.
+func Marshal(typ MsgType, payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)+2))
+	buf[4] = Version
+	buf[5] = byte(typ)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+// WriteFrame writes the frame of 'payload' into 'w' on a single Write call, so frames
+// written concurrently on the same connection are not interleaved.
+func WriteFrame(w io.Writer, typ MsgType, payload []byte) error {
+	if len(payload)+2 > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	_, err := w.Write(Marshal(typ, payload))
+	return err
+}
+
+// ReadFrame reads the next frame from 'r', returning its type and payload. Returns io.EOF
+// only if no byte of a new frame was read.
+func ReadFrame(r io.Reader) (MsgType, []byte, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	if size > MaxFrameSize {
+		return 0, nil, ErrFrameTooLarge
+	}
+	if size < 2 {
+		return 0, nil, ErrMalformed
+	}
+
+	if _, err := io.ReadFull(r, hdr[4:]); err != nil {
+		return 0, nil, unexpected(err)
+	}
+	if hdr[4] != Version {
+		return 0, nil, fmt.Errorf("unsupported protocol version %d", hdr[4])
+	}
+
+	payload := make([]byte, size-2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, unexpected(err)
+	}
+	return MsgType(hdr[5]), payload, nil
+}
+
+// EncodeReply returns a MsgReply payload, composed of the uvarint request ID 'id' followed
+// by 'value'.
+func EncodeReply(id uint64, value []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(value))
+	n := binary.PutUvarint(buf, id)
+	return append(buf[:n], value...)
+}
+
+// DecodeReply returns the request ID and value of a MsgReply payload.
+func DecodeReply(payload []byte) (uint64, []byte, error) {
+	id, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return 0, nil, ErrMalformed
+	}
+	return id, payload[n:], nil
+}
+
+// Pair is a key and its value, replied in order to a SCAN command.
+type Pair struct {
+	Key   string
+	Value []byte
+}
+
+// EncodePairs returns the reply value of a SCAN, composed of the uvarint length-prefixed
+// key and value of each pair in 'pairs'.
+func EncodePairs(pairs []Pair) []byte {
+	var buf []byte
+	var tmp [binary.MaxVarintLen64]byte
+	for _, p := range pairs {
+		n := binary.PutUvarint(tmp[:], uint64(len(p.Key)))
+		buf = append(append(buf, tmp[:n]...), p.Key...)
+		n = binary.PutUvarint(tmp[:], uint64(len(p.Value)))
+		buf = append(append(buf, tmp[:n]...), p.Value...)
+	}
+	return buf
+}
+
+// DecodePairs returns the pairs encoded by EncodePairs on 'value'.
+func DecodePairs(value []byte) ([]Pair, error) {
+	var pairs []Pair
+	for len(value) > 0 {
+		key, rest, err := readBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		val, rest, err := readBytes(rest)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, Pair{Key: string(key), Value: val})
+		value = rest
+	}
+	return pairs, nil
+}
+
+// Change is a write on 'Key' applied at raft index 'Index', replied to a CHANGES command
+// along with the resulting value and version of the key. Deletes carry neither.
+type Change struct {
+	Index   uint64
+	Version uint64
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+// EncodeChanges returns the reply value of a CHANGES, composed of a byte flagging deletes,
+// the uvarint index and version, and the uvarint length-prefixed key and value of each change
+// in 'changes'. Flags are either zero or one, so a list of changes never starts like an error
+// reply.
+func EncodeChanges(changes []Change) []byte {
+	var buf []byte
+	var tmp [binary.MaxVarintLen64]byte
+	for _, c := range changes {
+		var flag byte
+		if c.Deleted {
+			flag = 1
+		}
+		buf = append(buf, flag)
+		n := binary.PutUvarint(tmp[:], c.Index)
+		buf = append(buf, tmp[:n]...)
+		n = binary.PutUvarint(tmp[:], c.Version)
+		buf = append(buf, tmp[:n]...)
+		n = binary.PutUvarint(tmp[:], uint64(len(c.Key)))
+		buf = append(append(buf, tmp[:n]...), c.Key...)
+		n = binary.PutUvarint(tmp[:], uint64(len(c.Value)))
+		buf = append(append(buf, tmp[:n]...), c.Value...)
+	}
+	return buf
+}
+
+// DecodeChanges returns the changes encoded by EncodeChanges on 'value'.
+func DecodeChanges(value []byte) ([]Change, error) {
+	var changes []Change
+	for len(value) > 0 {
+		if value[0] > 1 {
+			return nil, ErrMalformed
+		}
+		c := Change{Deleted: value[0] == 1}
+		value = value[1:]
+
+		var n int
+		if c.Index, n = binary.Uvarint(value); n <= 0 {
+			return nil, ErrMalformed
+		}
+		value = value[n:]
+		if c.Version, n = binary.Uvarint(value); n <= 0 {
+			return nil, ErrMalformed
+		}
+
+		key, rest, err := readBytes(value[n:])
+		if err != nil {
+			return nil, err
+		}
+		val, rest, err := readBytes(rest)
+		if err != nil {
+			return nil, err
+		}
+		c.Key, c.Value = string(key), val
+		changes = append(changes, c)
+		value = rest
+	}
+	return changes, nil
+}
+
+// Escape returns 'b' as valid UTF-8, as required by the string fields of commands, mapping
+// each byte to the code point of the same value. ASCII is kept unchanged, and since the
+// mapping preserves order and prefixes, escaped keys are scanned and watched as the
+// original ones. Replies carry escaped values as written, decoded by Unescape.
+func Escape(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// Unescape returns the bytes escaped by Escape on 's'.
+func Unescape(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xFF {
+			return nil, ErrNotEscaped
+		}
+		b = append(b, byte(r))
+	}
+	return b, nil
+}
+
+// readBytes reads an uvarint length-prefixed slice from 'buf', returning the remaining bytes.
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || size > uint64(len(buf)-n) {
+		return nil, nil, ErrMalformed
+	}
+	end := n + int(size)
+	return buf[n:end], buf[end:], nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
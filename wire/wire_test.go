@@ -0,0 +1,195 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	// payloads containing '\n' bytes were truncated by the previous line delimited protocol
+	payloads := [][]byte{
+		nil,
+		[]byte("\n"),
+		{0x0A, 0x00, 0x0A, 0xFF},
+		bytes.Repeat([]byte{0x0A}, 4096),
+	}
+
+	buf := &bytes.Buffer{}
+	for _, p := range payloads {
+		if err := WriteFrame(buf, MsgCommand, p); err != nil {
+			t.Fatalf("failed to write frame: %s", err.Error())
+		}
+	}
+	for _, p := range payloads {
+		typ, payload, err := ReadFrame(buf)
+		if err != nil {
+			t.Fatalf("failed to read frame: %s", err.Error())
+		}
+		if typ != MsgCommand || !bytes.Equal(payload, p) {
+			t.Fatalf("expected payload %q, got %q", p, payload)
+		}
+	}
+	if _, _, err := ReadFrame(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF after the last frame, got: %v", err)
+	}
+}
+
+func TestReadFrameRejectsInvalidFrames(t *testing.T) {
+	frame := Marshal(MsgReply, []byte("foo"))
+
+	future := append([]byte{}, frame...)
+	future[4] = Version + 1
+
+	large := make([]byte, 4)
+	binary.BigEndian.PutUint32(large, MaxFrameSize+1)
+
+	frames := map[string][]byte{
+		"future":    future,
+		"large":     large,
+		"short":     {0, 0, 0, 1, Version},
+		"truncated": frame[:len(frame)-1],
+	}
+	for name, f := range frames {
+		if _, _, err := ReadFrame(bytes.NewReader(f)); err == nil || err == io.EOF {
+			t.Fatalf("expected an error when reading a %s frame, got: %v", name, err)
+		}
+	}
+}
+
+func TestReadArbitraryFrames(t *testing.T) {
+	inputs := [][]byte{
+		nil,
+		Marshal(MsgCommand, []byte("foo")),
+		Marshal(MsgType(0xFF), []byte{0x0A, 0x0A, 0x00}),
+		append(Marshal(MsgClose, nil), 0x0A),
+		{0, 0, 0, 2, Version},
+		{0, 0, 0, 1, Version, byte(MsgReply)},
+		{0xFF, 0xFF, 0xFF, 0xFF},
+		{0x0A},
+	}
+
+	// arbitrary input must never panic, and accepted frames must be marshaled back into the
+	// same bytes
+	for _, data := range inputs {
+		typ, payload, err := ReadFrame(bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+		frame := Marshal(typ, payload)
+		if !bytes.Equal(frame, data[:len(frame)]) {
+			t.Fatalf("frame %q re-marshaled as %q", data[:len(frame)], frame)
+		}
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	replies := []struct {
+		id    uint64
+		value []byte
+	}{
+		{1 << 40, []byte("OK: \n")},
+		{10, nil},
+		{0, []byte{0x0A, 0xFF, 0x00}},
+	}
+	for _, r := range replies {
+		id, value, err := DecodeReply(EncodeReply(r.id, r.value))
+		if err != nil {
+			t.Fatalf("failed to decode reply: %s", err.Error())
+		}
+		if id != r.id || !bytes.Equal(value, r.value) {
+			t.Fatalf("expected reply %d %q, got %d %q", r.id, r.value, id, value)
+		}
+	}
+	if _, _, err := DecodeReply(nil); err != ErrMalformed {
+		t.Fatalf("expected ErrMalformed on an empty reply, got: %v", err)
+	}
+}
+
+func TestPairsRoundTrip(t *testing.T) {
+	pairs := []Pair{
+		{Key: "a", Value: []byte("\n")},
+		{Key: "", Value: []byte{}},
+		{Key: "b", Value: bytes.Repeat([]byte{0xFF}, 300)},
+	}
+	got, err := DecodePairs(EncodePairs(pairs))
+	if err != nil {
+		t.Fatalf("failed to decode pairs: %s", err.Error())
+	}
+	if len(got) != len(pairs) {
+		t.Fatalf("expected %d pairs, got %d", len(pairs), len(got))
+	}
+	for i, p := range pairs {
+		if got[i].Key != p.Key || !bytes.Equal(got[i].Value, p.Value) {
+			t.Fatalf("expected pair %v, got %v", p, got[i])
+		}
+	}
+
+	if pairs, err = DecodePairs(nil); err != nil || len(pairs) != 0 {
+		t.Fatalf("expected no pairs on an empty value, got %v (err: %v)", pairs, err)
+	}
+	if _, err = DecodePairs([]byte{3, 'a'}); err != ErrMalformed {
+		t.Fatalf("expected ErrMalformed on a truncated key, got: %v", err)
+	}
+}
+
+func TestChangesRoundTrip(t *testing.T) {
+	changes := []Change{
+		{Index: 3, Version: 1, Key: "a", Value: []byte("\n")},
+		{Index: 300, Key: "a", Deleted: true},
+		{Index: 301, Version: 1, Key: "", Value: bytes.Repeat([]byte{0xFF}, 300)},
+	}
+	enc := EncodeChanges(changes)
+	if bytes.HasPrefix(enc, []byte("ERR")) {
+		t.Fatalf("encoded changes must never start like an error reply, got %q", enc)
+	}
+
+	got, err := DecodeChanges(enc)
+	if err != nil {
+		t.Fatalf("failed to decode changes: %s", err.Error())
+	}
+	if len(got) != len(changes) {
+		t.Fatalf("expected %d changes, got %d", len(changes), len(got))
+	}
+	for i, c := range changes {
+		g := got[i]
+		if g.Index != c.Index || g.Version != c.Version || g.Key != c.Key || g.Deleted != c.Deleted || !bytes.Equal(g.Value, c.Value) {
+			t.Fatalf("expected change %v, got %v", c, g)
+		}
+	}
+
+	if _, err = DecodeChanges([]byte("ERR index compacted")); err != ErrMalformed {
+		t.Fatalf("expected ErrMalformed on an error reply, got: %v", err)
+	}
+	if _, err = DecodeChanges([]byte{0, 1}); err != ErrMalformed {
+		t.Fatalf("expected ErrMalformed on a truncated change, got: %v", err)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	for _, b := range [][]byte{nil, []byte("foo\n"), {0x00, 0x7F, 0x80, 0xFF}, bytes.Repeat([]byte{0xC3}, 3)} {
+		s := Escape(b)
+		if !utf8.ValidString(s) {
+			t.Fatalf("expected %q escaped as valid UTF-8, got %q", b, s)
+		}
+		got, err := Unescape(s)
+		if err != nil || !bytes.Equal(got, b) {
+			t.Fatalf("expected %q unescaped, got %q (err: %v)", b, got, err)
+		}
+	}
+	if s := Escape([]byte("foo")); s != "foo" {
+		t.Fatalf("expected ASCII kept unchanged, got %q", s)
+	}
+
+	// escaped keys keep their order and prefixes
+	a, b := []byte{0x7F, 0xFF}, []byte{0x80}
+	if Escape(a) >= Escape(b) || !strings.HasPrefix(Escape(a), Escape(a[:1])) {
+		t.Fatalf("expected %q before %q, prefixed by %q", Escape(a), Escape(b), Escape(a[:1]))
+	}
+	if _, err := Unescape("€"); err != ErrNotEscaped {
+		t.Fatalf("expected ErrNotEscaped on code points above 0xFF, got: %v", err)
+	}
+}